@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	db "github.com/horriblename/go-web-server/db"
+)
+
+type DeleteUserParameters struct {
+	Password string `json:"password"`
+}
+
+// DELETE /api/users/me
+//
+// deletes the caller's account, the password has to be entered again
+func (cfg *apiConfig) handleDeleteUserMe(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params DeleteUserParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	// DeleteUser checks the password itself, failures count towards the
+	// lockout like in confirmPassword
+	account, ip := accountKey(userID, ""), clientIP(req)
+	if wait := cfg.loginLimiter.Blocked(account, ip); wait > 0 {
+		respondLockedOut(w, wait)
+		return
+	}
+
+	avatar, err := cfg.db.DeleteUser(userID, params.Password)
+	if err == db.ErrWrongPassword {
+		cfg.loginLimiter.Failure(account, ip)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err == db.ErrLastAdmin {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: "The last admin can't be deleted, make someone else admin first"})
+		return
+	} else if err != nil {
+		fmt.Printf("deleting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	cfg.loginLimiter.Success(account)
+
+	if avatar != "" {
+		if err := os.Remove(filepath.Join(cfg.mediaPath, avatar)); err != nil {
+			fmt.Printf("removing avatar of deleted user %d: %s\n", userID, err)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
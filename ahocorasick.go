@@ -0,0 +1,112 @@
+package main
+
+// acMatcher finds all occurrences of a set of patterns in a text in a single
+// pass, using the Aho-Corasick automaton. Building it is linear in the total
+// length of the patterns, scanning is linear in the length of the text plus
+// the number of matches, regardless of how many patterns there are.
+type acMatcher struct {
+	nodes    []acNode
+	patterns []string
+}
+
+type acNode struct {
+	next map[byte]int32
+	// longest proper suffix of this node that is also a node
+	fail int32
+	// nearest node along the fail chain that ends a pattern, -1 if none
+	output int32
+	// indices of the patterns ending at this node
+	ends []int32
+}
+
+func newACNode() acNode {
+	return acNode{next: map[byte]int32{}, output: -1}
+}
+
+// newACMatcher builds the automaton for patterns. Empty patterns are ignored.
+// Pattern indices passed to Scan callbacks refer to the patterns slice.
+func newACMatcher(patterns []string) *acMatcher {
+	m := acMatcher{nodes: []acNode{newACNode()}, patterns: patterns}
+
+	// build the trie
+	for i, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		cur := int32(0)
+		for j := 0; j < len(pattern); j++ {
+			next, ok := m.nodes[cur].next[pattern[j]]
+			if !ok {
+				next = int32(len(m.nodes))
+				m.nodes = append(m.nodes, newACNode())
+				m.nodes[cur].next[pattern[j]] = next
+			}
+			cur = next
+		}
+		m.nodes[cur].ends = append(m.nodes[cur].ends, int32(i))
+	}
+
+	// breadth first, so fail links always point to nodes already processed
+	queue := []int32{}
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		for b, child := range m.nodes[cur].next {
+			queue = append(queue, child)
+
+			fail := m.nodes[cur].fail
+			for {
+				if next, ok := m.nodes[fail].next[b]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					m.nodes[child].fail = 0
+					break
+				}
+				fail = m.nodes[fail].fail
+			}
+
+			failNode := m.nodes[m.nodes[child].fail]
+			if len(failNode.ends) > 0 {
+				m.nodes[child].output = m.nodes[child].fail
+			} else {
+				m.nodes[child].output = failNode.output
+			}
+		}
+	}
+
+	return &m
+}
+
+// Scan calls found for every occurrence of every pattern in text, with the
+// pattern's index and the byte offsets [start, end) of the occurrence.
+func (m *acMatcher) Scan(text string, found func(pattern, start, end int)) {
+	cur := int32(0)
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		for {
+			if next, ok := m.nodes[cur].next[b]; ok {
+				cur = next
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+
+		for out := cur; out >= 0; out = m.nodes[out].output {
+			for _, p := range m.nodes[out].ends {
+				end := i + 1
+				found(int(p), end-len(m.patterns[p]), end)
+			}
+		}
+	}
+}
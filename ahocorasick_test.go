@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestACMatcher(t *testing.T) {
+	type match struct{ pattern, start, end int }
+
+	tests := []struct {
+		patterns []string
+		text     string
+		expect   []match
+	}{
+		{[]string{"he", "she", "his", "hers"}, "ushers", []match{{0, 2, 4}, {1, 1, 4}, {3, 2, 6}}},
+		{[]string{"a", "aa", "aaa"}, "aaa", []match{{0, 0, 1}, {0, 1, 2}, {1, 0, 2}, {0, 2, 3}, {1, 1, 3}, {2, 0, 3}}},
+		{[]string{"abc", "bcd"}, "xabcdx", []match{{0, 1, 4}, {1, 2, 5}}},
+		{[]string{"dup", "dup"}, "dup", []match{{0, 0, 3}, {1, 0, 3}}},
+		{[]string{"", "x"}, "xx", []match{{1, 0, 1}, {1, 1, 2}}},
+		{[]string{"abc"}, "ab", []match{}},
+		{[]string{}, "anything", []match{}},
+	}
+
+	for _, test := range tests {
+		m := newACMatcher(test.patterns)
+		got := []match{}
+		m.Scan(test.text, func(pattern, start, end int) {
+			got = append(got, match{pattern, start, end})
+		})
+
+		// only the set of matches matters, not the order within the same end
+		sort.Slice(got, func(i, j int) bool {
+			if got[i].end != got[j].end {
+				return got[i].end < got[j].end
+			}
+			return got[i].pattern < got[j].pattern
+		})
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("patterns %q in %q: got %v, expected %v", test.patterns, test.text, got, test.expect)
+		}
+	}
+}
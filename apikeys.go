@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	db "github.com/horriblename/go-web-server/db"
+)
+
+// what API keys may be allowed to do. Access tokens may do everything.
+const (
+	scopeChirpsWrite = "chirps:write"
+	scopeChirpsRead  = "chirps:read"
+	scopeProfileRead = "profile:read"
+)
+
+var gAPIKeyScopes = []string{scopeChirpsWrite, scopeChirpsRead, scopeProfileRead}
+
+const gMaxAPIKeyNameLength = 50
+
+type PostAPIKeyParameters struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// Key is only set when the key is created
+type APIKeyResponse struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Key        string    `json:"key,omitempty"`
+}
+
+func newAPIKeyResponse(key db.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		Id:         key.Id,
+		Name:       key.Name,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+func validScope(scope string) bool {
+	for _, known := range gAPIKeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /api/users/me/api-keys
+func (cfg *apiConfig) handlePostAPIKey(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params PostAPIKeyParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || utf8.RuneCountInString(params.Name) > gMaxAPIKeyNameLength {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{
+			Error: fmt.Sprintf("name must be between 1 and %d characters", gMaxAPIKeyNameLength),
+		})
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "at least one scope is required"})
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !validScope(scope) {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: fmt.Sprintf("unknown scope %q", scope)})
+			return
+		}
+	}
+
+	plain, key, err := cfg.db.CreateAPIKey(userID, params.Name, params.Scopes)
+	if err != nil {
+		fmt.Printf("creating API key for user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	resp := newAPIKeyResponse(key)
+	resp.Key = plain
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// GET /api/users/me/api-keys
+func (cfg *apiConfig) handleGetAPIKeys(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	keys, err := cfg.db.APIKeys(userID)
+	if err != nil {
+		fmt.Printf("listing API keys of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	resp := make([]APIKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, newAPIKeyResponse(key))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// DELETE /api/users/me/api-keys/{keyID}
+func (cfg *apiConfig) handleDeleteAPIKey(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	err := cfg.db.RevokeAPIKey(userID, chi.URLParam(req, "keyID"))
+	if err == db.ErrInvalidAPIKey {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("revoking API key of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	db "github.com/horriblename/go-web-server/db"
+)
+
+var (
+	ErrWrongIssuer    = errors.New("token has the wrong issuer")
+	ErrMalformedToken = errors.New("malformed token")
+)
+
+// principal is who a request acts for, see authenticate
+type principal struct {
+	UserID int
+	// what the principal may do, nil if it may do everything
+	Scopes []string
+	// the key the request was made with, nil for access tokens
+	APIKey *db.APIKey
+	// the OAuth client the access token was issued to, empty for our own
+	ClientID string
+	// the current role of the user for our own access tokens, empty otherwise
+	Role db.Role
+}
+
+func (p *principal) can(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+// principalFrom returns the principal authenticate stored in the context of
+// req, nil if the route isn't authenticated
+func principalFrom(req *http.Request) *principal {
+	p, _ := req.Context().Value(principalContextKey).(*principal)
+	return p
+}
+
+// authenticate lets requests through that carry an access token, in the
+// Authorization header or the session cookie, or an API key as
+// "Authorization: ApiKey <key>", and stores their principal in the request
+// context. API keys and access tokens issued to OAuth clients need scope; an
+// empty scope only lets our own access tokens through.
+func (cfg *apiConfig) authenticate(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var p *principal
+			var err error
+			if plain, ok := strings.CutPrefix(req.Header.Get("Authorization"), "ApiKey "); ok {
+				p, err = cfg.apiKeyPrincipal(plain)
+			} else {
+				p, err = cfg.accessTokenPrincipal(req)
+			}
+			if err == nil && (scope == "" && p.Scopes != nil || !p.can(scope)) {
+				err = errMissingScope(scope)
+			}
+			if err != nil {
+				respondWithAuthError(w, err)
+				return
+			}
+
+			ctx := context.WithValue(req.Context(), principalContextKey, p)
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+type errMissingScope string
+
+func (scope errMissingScope) Error() string {
+	if scope == "" {
+		return "API keys and app tokens can't be used here"
+	}
+	return fmt.Sprintf("missing the %s scope", string(scope))
+}
+
+func (cfg *apiConfig) apiKeyPrincipal(plain string) (*principal, error) {
+	key, err := cfg.db.AuthenticateAPIKey(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal{UserID: key.UserID, Scopes: append([]string{}, key.Scopes...), APIKey: &key}, nil
+}
+
+func (cfg *apiConfig) accessTokenPrincipal(req *http.Request) (*principal, error) {
+	tokStr, fromCookie, err := requestAccessToken(req)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := parseToken(tokStr, cfg.jwtKeys, gAccessTokIssuer)
+	if err != nil {
+		return nil, err
+	}
+	if fromCookie {
+		if err := cfg.checkCSRF(req, claims.Family); err != nil {
+			return nil, err
+		}
+	}
+	user, err := cfg.tokenUser(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	p := principal{UserID: user.Id}
+	if claims.ClientID != "" {
+		p.ClientID = claims.ClientID
+		p.Scopes = append([]string{}, strings.Fields(claims.Scope)...)
+	} else {
+		p.Role = user.EffectiveRole()
+	}
+	return &p, nil
+}
+
+// tokenUser returns the user a token was issued to. Returns db.ErrUserNotFound
+// if the account was deleted since, and ErrUnauthorizedToken if the user's
+// tokens were revoked after it was issued or its session was logged out.
+func (cfg *apiConfig) tokenUser(claims *chirpyClaims) (*db.User, error) {
+	userID, err := claims.userID()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// e.g. a password reset revokes all tokens issued before it
+	if claims.IssuedAt == nil || user.TokenRevoked(claims.IssuedAt.Time, claims.Generation) {
+		return nil, ErrUnauthorizedToken
+	}
+
+	// logging out a session revokes its access tokens right away, not just
+	// the refresh token
+	if claims.Family != "" {
+		if err := cfg.db.CheckSession(userID, claims.Family); err == db.ErrTokenRevoked {
+			return nil, ErrUnauthorizedToken
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// bearerToken returns the token in the "Authorization: Bearer <token>" header
+func bearerToken(req *http.Request) (string, error) {
+	tokStr, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", ErrBadAuthHeader
+	}
+	return tokStr, nil
+}
+
+// parseJWT validates the bearer token of req and checks that issuer issued it.
+// Returns the token as sent and its claims.
+func parseJWT(req *http.Request, keys *jwtKeySet, issuer string) (string, *chirpyClaims, error) {
+	tokStr, err := bearerToken(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims, err := parseToken(tokStr, keys, issuer)
+	if err != nil {
+		return "", nil, err
+	}
+	return tokStr, claims, nil
+}
+
+// parseToken validates a token and checks that issuer issued it
+func parseToken(tokStr string, keys *jwtKeySet, issuer string) (*chirpyClaims, error) {
+	claims := chirpyClaims{}
+	token, err := jwt.ParseWithClaims(tokStr, &claims, keys.Keyfunc)
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) || errors.Is(err, ErrUnknownKey) || errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrUnauthorizedToken
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedToken, err)
+	}
+	if !token.Valid {
+		return nil, ErrUnauthorizedToken
+	}
+
+	if claims.Issuer != issuer {
+		return nil, ErrWrongIssuer
+	}
+
+	return &claims, nil
+}
+
+// the ID of the user the token was issued to
+func (claims *chirpyClaims) userID() (int, error) {
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, fmt.Errorf("%w: subject is not an ID", ErrMalformedToken)
+	}
+	return userID, nil
+}
+
+// answers a request that failed authentication with err
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	var missingScope errMissingScope
+	switch {
+	case errors.Is(err, ErrBadAuthHeader):
+		respondWithError(w, http.StatusBadRequest, `Malformed "Authorization" in Header`)
+	case errors.Is(err, ErrMalformedToken):
+		respondWithError(w, http.StatusBadRequest, "Bad Request")
+	case errors.Is(err, ErrWrongIssuer):
+		respondWithError(w, http.StatusUnauthorized, "Wrong Issuer")
+	case errors.Is(err, ErrUnauthorizedToken), errors.Is(err, db.ErrInvalidAPIKey), errors.Is(err, db.ErrUserNotFound):
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+	case errors.As(err, &missingScope):
+		respondWithJSON(w, http.StatusForbidden, genericErrorMsg{Error: missingScope.Error()})
+	case errors.Is(err, ErrCSRF):
+		respondWithJSON(w, http.StatusForbidden, genericErrorMsg{Error: err.Error()})
+	default:
+		fmt.Printf("authenticating request: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+	}
+}
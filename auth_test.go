@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseJWT(t *testing.T) {
+	keys, err := newJWTKeySet([]byte("testsecret"), "", nil, time.Time{})
+	if err != nil {
+		t.Fatalf("creating key set: %s", err)
+	}
+	sign := func(issuer string, expiresIn time.Duration) string {
+		tokStr, err := keys.Sign(chirpyClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "7",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+		}})
+		if err != nil {
+			t.Fatalf("signing token: %s", err)
+		}
+		return tokStr
+	}
+	other, err := newJWTKeySet([]byte("othersecret"), "", nil, time.Time{})
+	if err != nil {
+		t.Fatalf("creating key set: %s", err)
+	}
+	forged, err := other.Sign(jwt.RegisteredClaims{Issuer: gAccessTokIssuer, Subject: "7"})
+	if err != nil {
+		t.Fatalf("signing token: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		expect error
+	}{
+		{"access token", "Bearer " + sign(gAccessTokIssuer, time.Minute), nil},
+		{"refresh token", "Bearer " + sign(gRefreshTokIssuer, time.Minute), ErrWrongIssuer},
+		{"expired", "Bearer " + sign(gAccessTokIssuer, -time.Minute), ErrUnauthorizedToken},
+		{"other secret", "Bearer " + forged, ErrUnauthorizedToken},
+		{"garbage", "Bearer garbage", ErrMalformedToken},
+		{"no header", "", ErrBadAuthHeader},
+		{"API key", "ApiKey chirpy_x_y", ErrBadAuthHeader},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+
+		_, claims, err := parseJWT(req, keys, gAccessTokIssuer)
+		if !errors.Is(err, test.expect) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expect, err)
+			continue
+		}
+		if err == nil {
+			if userID, err := claims.userID(); err != nil || userID != 7 {
+				t.Errorf("%s: expected user 7, got %d (%v)", test.name, userID, err)
+			}
+		}
+	}
+}
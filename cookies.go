@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	db "github.com/horriblename/go-web-server/db"
+)
+
+// Browser sessions keep the tokens in HttpOnly cookies, out of reach of
+// scripts. Cookies are sent with every request, so requests that change
+// anything also need the CSRF token: it is set in a cookie scripts can read,
+// and has to be sent back in the X-CSRF-Token header, which other sites can't
+// do. The token is an HMAC of the session's refresh token family, so a cookie
+// planted by another site doesn't help, and it only works for its own session.
+const (
+	gAccessCookie  = "chirpy_access"
+	gRefreshCookie = "chirpy_refresh"
+	gCSRFCookie    = "chirpy_csrf"
+	gCSRFHeader    = "X-CSRF-Token"
+	// the refresh token is only sent to the session endpoints
+	gRefreshCookiePath = "/api/session"
+)
+
+var ErrCSRF = errors.New("missing or invalid CSRF token")
+
+func sessionCookie(name, value, path string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+func setSessionCookies(w http.ResponseWriter, accessToken, refreshToken, csrfToken string) {
+	http.SetCookie(w, sessionCookie(gAccessCookie, accessToken, "/api", gAccessTokenExpirationInSeconds, true))
+	http.SetCookie(w, sessionCookie(gRefreshCookie, refreshToken, gRefreshCookiePath, gRefreshTokenExpirationInSeconds, true))
+	// the web app reads it, so it has to be visible on every page
+	http.SetCookie(w, sessionCookie(gCSRFCookie, csrfToken, "/", gRefreshTokenExpirationInSeconds, false))
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, sessionCookie(gAccessCookie, "", "/api", -1, true))
+	http.SetCookie(w, sessionCookie(gRefreshCookie, "", gRefreshCookiePath, -1, true))
+	http.SetCookie(w, sessionCookie(gCSRFCookie, "", "/", -1, false))
+}
+
+func deriveCSRFKey(jwtSecret []byte) []byte {
+	sum := sha256.Sum256(append([]byte("chirpy csrf token\x00"), jwtSecret...))
+	return sum[:]
+}
+
+// the CSRF token of the session with the given refresh token family
+func (cfg *apiConfig) csrfToken(family string) string {
+	mac := hmac.New(sha256.New, cfg.csrfKey)
+	mac.Write([]byte(family))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF checks that requests with side effects carry the CSRF token of the
+// session with the given refresh token family in the header
+func (cfg *apiConfig) checkCSRF(req *http.Request, family string) error {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+
+	if family == "" {
+		return ErrCSRF
+	}
+	if !hmac.Equal([]byte(cfg.csrfToken(family)), []byte(req.Header.Get(gCSRFHeader))) {
+		return ErrCSRF
+	}
+	return nil
+}
+
+// requestAccessToken returns the access token of req. The Authorization header
+// wins over the session cookie; fromCookie tells the caller to check the CSRF
+// token.
+func requestAccessToken(req *http.Request) (tokStr string, fromCookie bool, err error) {
+	if req.Header.Get("Authorization") == "" {
+		if cookie, err := req.Cookie(gAccessCookie); err == nil {
+			return cookie.Value, true, nil
+		}
+	}
+	tokStr, err = bearerToken(req)
+	return tokStr, false, err
+}
+
+// responds to a successful login of user with new tokens, in cookies if
+// cookies is set
+func (cfg *apiConfig) respondWithLoginTokens(w http.ResponseWriter, req *http.Request, user db.UserDTO, cookies bool) {
+	resp, family, err := cfg.issueLoginTokens(user, requestClient(req))
+	if err != nil {
+		fmt.Printf("issuing tokens: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	if cookies {
+		csrfToken := cfg.csrfToken(family)
+		setSessionCookies(w, resp.Token, resp.RefreshToken, csrfToken)
+		resp.Token, resp.RefreshToken, resp.CSRFToken = "", "", csrfToken
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/session/refresh
+//
+// POST /api/refresh for cookie sessions, the new tokens replace the cookies
+func (cfg *apiConfig) handlePostSessionRefresh(w http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(gRefreshCookie)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	claims, err := parseToken(cookie.Value, cfg.jwtKeys, gRefreshTokIssuer)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	if err := cfg.checkCSRF(req, claims.Family); err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	resp, ok := cfg.refreshTokens(w, req, cookie.Value, claims)
+	if !ok {
+		return
+	}
+
+	// the CSRF token stays the same for the whole session
+	setSessionCookies(w, resp.Token, resp.RefreshToken, cfg.csrfToken(claims.Family))
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// POST /api/session/logout
+//
+// revokes the refresh token of a cookie session and clears the cookies
+func (cfg *apiConfig) handlePostSessionLogout(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(gRefreshCookie); err == nil {
+		// a token that doesn't parse has nothing left to revoke
+		if claims, err := parseToken(cookie.Value, cfg.jwtKeys, gRefreshTokIssuer); err == nil && claims.Family != "" {
+			if err := cfg.checkCSRF(req, claims.Family); err != nil {
+				respondWithAuthError(w, err)
+				return
+			}
+			err := cfg.db.RevokeRefreshFamily(claims.Family)
+			if err != nil && err != db.ErrTokenRevoked {
+				fmt.Printf("revoking refresh token family: %s\n", err)
+				respondWithError(w, http.StatusInternalServerError, "Database Error")
+				return
+			}
+		}
+	}
+
+	clearSessionCookies(w)
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
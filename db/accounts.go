@@ -0,0 +1,109 @@
+package db
+
+import (
+	"bytes"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DeleteUser permanently deletes a user after checking their password. Their
+// chirps, follows (in both directions) and reports against their chirps are
+// removed, and reports they filed are kept but no longer point to them. All of
+// it is written in a single database update.
+//
+// The user's ID is remembered so it is never handed out again; tokens issued
+// for it stay useless. Returns the file name of the user's avatar, if any, so
+// the caller can remove it. Returns ErrUserNotFound if the user doesn't exist,
+// ErrWrongPassword if the password doesn't match and ErrLastAdmin if the user
+// is the only admin.
+func (db *DB) DeleteUser(userID int, password string) (string, error) {
+	// bcrypt is slow, check the password before blocking other updates
+	user, err := db.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if err := bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password)); err != nil {
+		return "", err
+	}
+
+	var avatar string
+	err = db.update(func(dbstruct *DBStruct) error {
+		current, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		// the password changed since it was checked
+		if !bytes.Equal(current.HashedPassword, user.HashedPassword) {
+			return ErrWrongPassword
+		}
+		if current.EffectiveRole() == RoleAdmin && dbstruct.countAdmins() == 1 {
+			return ErrLastAdmin
+		}
+
+		avatar = current.Avatar
+		dbstruct.deleteUser(userID)
+		return nil
+	})
+	return avatar, err
+}
+
+// removes a user and everything that belongs to them, see DeleteUser
+func (dbstruct *DBStruct) deleteUser(userID int) {
+	for _, id := range append([]int{}, dbstruct.ChirpsByAuthor[userID]...) {
+		dbstruct.removeChirp(id)
+	}
+
+	delete(dbstruct.Follows, userID)
+	for follower, following := range dbstruct.Follows {
+		delete(following, userID)
+		if len(following) == 0 {
+			delete(dbstruct.Follows, follower)
+		}
+	}
+
+	for id, report := range dbstruct.Reports {
+		if report.ReporterID == userID {
+			report.ReporterID = 0
+			dbstruct.Reports[id] = report
+		}
+	}
+
+	for hash, tok := range dbstruct.OneTimeTokens {
+		if tok.UserID == userID {
+			delete(dbstruct.OneTimeTokens, hash)
+		}
+	}
+
+	for key, consent := range dbstruct.Consents {
+		if consent.UserID == userID {
+			delete(dbstruct.Consents, key)
+		}
+	}
+	for hash, code := range dbstruct.AuthorizationCodes {
+		if code.UserID == userID {
+			delete(dbstruct.AuthorizationCodes, hash)
+		}
+	}
+
+	for key, identity := range dbstruct.Identities {
+		if identity.UserID == userID {
+			delete(dbstruct.Identities, key)
+		}
+	}
+
+	for id, key := range dbstruct.APIKeys {
+		if key.UserID == userID {
+			delete(dbstruct.APIKeys, id)
+		}
+	}
+
+	for id, family := range dbstruct.RefreshFamilies {
+		if family.UserID == userID {
+			delete(dbstruct.RefreshFamilies, id)
+		}
+	}
+
+	delete(dbstruct.Users, userID)
+	dbstruct.DeletedUsers[userID] = time.Now()
+}
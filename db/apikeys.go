@@ -0,0 +1,147 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefix of API keys, so they are recognizable in leaked files
+const gAPIKeyPrefix = "chirpy_"
+
+// how often the last use of an API key is written down at most
+const gAPIKeyLastUsedResolution = time.Minute
+
+// APIKey lets a program act for a user within its scopes. The key itself is
+// "chirpy_<id>_<secret>"; only the SHA-256 hash of the secret is stored.
+type APIKey struct {
+	Id         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	Hash       string    `json:"hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+var ErrInvalidAPIKey = errors.New("API key is invalid or revoked")
+
+// HasScope reports whether the key was granted scope
+func (key APIKey) HasScope(scope string) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey mints a new key for a user and returns it in plain text. This
+// is the only time the key is known.
+func (db *DB) CreateAPIKey(userID int, name string, scopes []string) (string, APIKey, error) {
+	idRaw := make([]byte, 8)
+	secretRaw := make([]byte, 32)
+	if _, err := rand.Read(idRaw); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(secretRaw); err != nil {
+		return "", APIKey{}, err
+	}
+	id, secret := hex.EncodeToString(idRaw), hex.EncodeToString(secretRaw)
+
+	key := APIKey{
+		Id:        id,
+		UserID:    userID,
+		Name:      name,
+		Scopes:    append([]string{}, scopes...),
+		Hash:      hashToken(secret),
+		CreatedAt: time.Now(),
+	}
+	err := db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		dbstruct.APIKeys[id] = key
+		return nil
+	})
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	return gAPIKeyPrefix + id + "_" + secret, key, nil
+}
+
+// APIKeys returns the keys of a user, oldest first
+func (db *DB) APIKeys(userID int) ([]APIKey, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []APIKey{}
+	for _, key := range dbstruct.APIKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// RevokeAPIKey deletes a key of a user. Returns ErrInvalidAPIKey if the user
+// has no key with that ID.
+func (db *DB) RevokeAPIKey(userID int, id string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		key, ok := dbstruct.APIKeys[id]
+		if !ok || key.UserID != userID {
+			return ErrInvalidAPIKey
+		}
+		delete(dbstruct.APIKeys, id)
+
+		return nil
+	})
+}
+
+// AuthenticateAPIKey returns the APIKey of a plain text key, or
+// ErrInvalidAPIKey if there is none
+func (db *DB) AuthenticateAPIKey(plain string) (APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(plain, gAPIKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(plain, gAPIKeyPrefix) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key, ok := dbstruct.APIKeys[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashToken(secret))) != 1 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	// bots may use their key for every request, don't write each of them down
+	if now := time.Now(); now.Sub(key.LastUsedAt) >= gAPIKeyLastUsedResolution {
+		key.LastUsedAt = now
+		err := db.update(func(dbstruct *DBStruct) error {
+			current, ok := dbstruct.APIKeys[id]
+			if !ok {
+				// revoked in the meantime
+				return ErrInvalidAPIKey
+			}
+			current.LastUsedAt = now
+			dbstruct.APIKeys[id] = current
+			return nil
+		})
+		if err != nil {
+			return APIKey{}, err
+		}
+	}
+
+	return key, nil
+}
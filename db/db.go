@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,22 +14,57 @@ import (
 )
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
+	Id             int    `json:"id"`
+	AuthorID       int    `json:"author_id"`
+	Body           string `json:"body"`
+	ContentWarning string `json:"content_warning"`
+	Sensitive      bool   `json:"sensitive"`
+	// hidden by a moderator or by reaching the report threshold
+	Hidden bool `json:"hidden,omitempty"`
 }
 
 type User struct {
 	Id             int    `json:"id"`
 	Email          string `json:"email"`
+	Handle         string `json:"handle"`
 	IsChirpyRed    bool   `json:"is_chirpy_red"`
 	HashedPassword []byte `json:"hashed_password"`
+	Suspended      bool   `json:"suspended"`
+	DisplayName    string `json:"display_name"`
+	Bio            string `json:"bio"`
+	// file name of the avatar in the media directory, empty if none is set
+	Avatar string `json:"avatar"`
+	// when the handle was last changed, zero if it is the one picked at signup
+	HandleChangedAt time.Time `json:"handle_changed_at"`
+	// whether the user proved they own Email, reset when the email changes
+	EmailVerified bool `json:"email_verified"`
+	// tokens issued before this are no longer accepted
+	TokensValidAfter time.Time `json:"tokens_valid_after"`
+	// counts how often TokensValidAfter moved. Tokens carry it to tell apart
+	// those issued in the same second, before and after it moved.
+	TokenGeneration int `json:"token_generation,omitempty"`
+	// encrypted TOTP secret, set while two-factor authentication is enabled
+	TOTPSecret []byte `json:"totp_secret,omitempty"`
+	// encrypted TOTP secret waiting to be confirmed with a first code
+	PendingTOTPSecret []byte `json:"pending_totp_secret,omitempty"`
+	// the last TOTP time step a code was accepted for
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// empty for users stored before there were roles, see EffectiveRole
+	Role Role `json:"role,omitempty"`
 }
 
 type UserDTO struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	Handle        string `json:"handle"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+	EmailVerified bool   `json:"email_verified"`
+	MFAEnabled    bool   `json:"mfa_enabled"`
+	Role          Role   `json:"role"`
+	// see User.TokenGeneration, goes into the tokens issued to the user
+	TokenGeneration int `json:"-"`
 }
 
 type DB struct {
@@ -40,6 +76,29 @@ type DBStruct struct {
 	Chirps               map[int]Chirp        `json:"chirps"`
 	Users                map[int]User         `json:"users"`
 	RevokedRefreshTokens map[string]time.Time `json:"revoked_tokens"`
+	Reports              map[int]Report       `json:"reports"`
+	// follower ID -> followed user ID -> when they started following
+	Follows map[int]map[int]time.Time `json:"follows"`
+	// author ID -> IDs of their chirps in ascending order
+	ChirpsByAuthor map[int][]int `json:"chirps_by_author"`
+	// IDs of deleted users, which are never reused
+	DeletedUsers map[int]time.Time `json:"deleted_users"`
+	// IDs of deleted chirps, which are never reused either
+	DeletedChirps map[int]time.Time `json:"deleted_chirps"`
+	// hash of the token -> token
+	OneTimeTokens map[string]OneTimeToken `json:"one_time_tokens"`
+	// family ID -> family
+	RefreshFamilies map[string]RefreshFamily `json:"refresh_families"`
+	// key ID -> key
+	APIKeys map[string]APIKey `json:"api_keys"`
+	// client ID -> client
+	OAuthClients map[string]OAuthClient `json:"oauth_clients"`
+	// "<userID>:<clientID>" -> consent
+	Consents map[string]Consent `json:"consents"`
+	// hash of the code -> code
+	AuthorizationCodes map[string]AuthorizationCode `json:"authorization_codes"`
+	// "<issuer> <subject>" -> identity
+	Identities map[string]Identity `json:"identities"`
 }
 
 var (
@@ -51,6 +110,7 @@ var (
 	ErrTokenRevoked      = errors.New("token is revoked")
 	ErrChirpNotFound     = errors.New("requested chirp not found")
 	ErrUserNotFound      = errors.New("requested user not found")
+	ErrAlreadyReported   = errors.New("chirp already reported by this user")
 )
 
 // NewDB creates a new database connection
@@ -61,9 +121,10 @@ func New(path string) (*DB, error) {
 }
 
 func NewDBStruct(chirps []Chirp, users []User) DBStruct {
-	dbstruct := DBStruct{make(map[int]Chirp), make(map[int]User), make(map[string]time.Time)}
+	dbstruct := DBStruct{}
+	dbstruct.initMaps()
 	for _, chirp := range chirps {
-		dbstruct.Chirps[chirp.Id] = chirp
+		dbstruct.addChirp(chirp)
 	}
 	for _, user := range users {
 		dbstruct.Users[user.Id] = user
@@ -72,8 +133,103 @@ func NewDBStruct(chirps []Chirp, users []User) DBStruct {
 	return dbstruct
 }
 
+// creates any maps that are nil, so databases written by older versions can be
+// used after new tables are added
+func (dbstruct *DBStruct) initMaps() {
+	if dbstruct.Chirps == nil {
+		dbstruct.Chirps = make(map[int]Chirp)
+	}
+	if dbstruct.Users == nil {
+		dbstruct.Users = make(map[int]User)
+	}
+	if dbstruct.RevokedRefreshTokens == nil {
+		dbstruct.RevokedRefreshTokens = make(map[string]time.Time)
+	}
+	if dbstruct.Reports == nil {
+		dbstruct.Reports = make(map[int]Report)
+	}
+	if dbstruct.DeletedUsers == nil {
+		dbstruct.DeletedUsers = make(map[int]time.Time)
+	}
+	if dbstruct.DeletedChirps == nil {
+		dbstruct.DeletedChirps = make(map[int]time.Time)
+	}
+	if dbstruct.OAuthClients == nil {
+		dbstruct.OAuthClients = make(map[string]OAuthClient)
+	}
+	if dbstruct.Consents == nil {
+		dbstruct.Consents = make(map[string]Consent)
+	}
+	if dbstruct.AuthorizationCodes == nil {
+		dbstruct.AuthorizationCodes = make(map[string]AuthorizationCode)
+	}
+	if dbstruct.Identities == nil {
+		dbstruct.Identities = make(map[string]Identity)
+	}
+	if dbstruct.APIKeys == nil {
+		dbstruct.APIKeys = make(map[string]APIKey)
+	}
+	if dbstruct.RefreshFamilies == nil {
+		dbstruct.RefreshFamilies = make(map[string]RefreshFamily)
+	}
+	if dbstruct.OneTimeTokens == nil {
+		dbstruct.OneTimeTokens = make(map[string]OneTimeToken)
+	}
+	if dbstruct.Follows == nil {
+		dbstruct.Follows = make(map[int]map[int]time.Time)
+	}
+	if dbstruct.ChirpsByAuthor == nil {
+		dbstruct.ChirpsByAuthor = make(map[int][]int)
+		for _, chirp := range dbstruct.Chirps {
+			dbstruct.ChirpsByAuthor[chirp.AuthorID] = append(dbstruct.ChirpsByAuthor[chirp.AuthorID], chirp.Id)
+		}
+		for _, ids := range dbstruct.ChirpsByAuthor {
+			sort.Ints(ids)
+		}
+	}
+}
+
+// adds a chirp to the chirps table and the author index
+func (dbstruct *DBStruct) addChirp(chirp Chirp) {
+	dbstruct.Chirps[chirp.Id] = chirp
+
+	ids := dbstruct.ChirpsByAuthor[chirp.AuthorID]
+	i := sort.SearchInts(ids, chirp.Id)
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = chirp.Id
+	dbstruct.ChirpsByAuthor[chirp.AuthorID] = ids
+}
+
+// removes a chirp from the chirps table and the author index, along with the
+// reports against it. Its ID is remembered so it is never handed out again.
+func (dbstruct *DBStruct) removeChirp(id int) {
+	chirp, ok := dbstruct.Chirps[id]
+	if !ok {
+		return
+	}
+	delete(dbstruct.Chirps, id)
+	dbstruct.DeletedChirps[id] = time.Now()
+
+	for reportID, report := range dbstruct.Reports {
+		if report.ChirpID == id {
+			delete(dbstruct.Reports, reportID)
+		}
+	}
+
+	ids := dbstruct.ChirpsByAuthor[chirp.AuthorID]
+	if i := sort.SearchInts(ids, id); i < len(ids) && ids[i] == id {
+		ids = append(ids[:i], ids[i+1:]...)
+	}
+	if len(ids) == 0 {
+		delete(dbstruct.ChirpsByAuthor, chirp.AuthorID)
+	} else {
+		dbstruct.ChirpsByAuthor[chirp.AuthorID] = ids
+	}
+}
+
 func NewUserDTO(data User) UserDTO {
-	return UserDTO{data.Id, data.Email, data.IsChirpyRed}
+	return UserDTO{data.Id, data.Email, data.Handle, data.IsChirpyRed, data.EmailVerified, data.TOTPSecret != nil, data.EffectiveRole(), data.TokenGeneration}
 }
 
 // creates database file if it doesn't exist
@@ -88,7 +244,8 @@ func (db *DB) ensureDB() error {
 		}
 		defer f.Close()
 
-		dbStruct := DBStruct{make(map[int]Chirp), make(map[int]User), make(map[string]time.Time)}
+		dbStruct := DBStruct{}
+		dbStruct.initMaps()
 		dat, err := json.Marshal(dbStruct)
 		if err != nil {
 			return err
@@ -154,60 +311,145 @@ func (db *DB) GetUsers() ([]UserDTO, error) {
 	return users, nil
 }
 
-func (db *DB) CreateChirp(userID int, body string) (*Chirp, error) {
-	newChirp := Chirp{AuthorID: userID, Body: body}
-
-	dbstruct, err := db.loadDB()
+// GetUser returns a user by id, or ErrUserNotFound if it doesn't exist.
+func (db *DB) GetUser(id int) (*User, error) {
+	dbStruct, err := db.loadDB()
 	if err != nil {
 		return nil, err
 	}
 
-	maxID := 0
-	for id := range dbstruct.Chirps {
-		if id > maxID {
-			maxID = id
-		}
+	user, ok := dbStruct.Users[id]
+	if !ok {
+		return nil, ErrUserNotFound
 	}
-	newChirp.Id = maxID + 1
-	dbstruct.Chirps[newChirp.Id] = newChirp
 
-	err = db.writeDB(dbstruct)
+	return &user, nil
+}
+
+// CreateChirp stores a new chirp. contentWarning and sensitive are stored as-is;
+// hiding the body of flagged chirps is left to the caller.
+func (db *DB) CreateChirp(userID int, body, contentWarning string, sensitive bool) (*Chirp, error) {
+	newChirp := Chirp{
+		AuthorID:       userID,
+		Body:           body,
+		ContentWarning: contentWarning,
+		Sensitive:      sensitive,
+	}
+
+	err := db.update(func(dbstruct *DBStruct) error {
+		newChirp.Id = dbstruct.nextChirpID()
+		dbstruct.addChirp(newChirp)
+		return nil
+	})
 
 	return &newChirp, err
 }
 
-func (db *DB) CreateUser(email, password string) (UserDTO, error) {
-	newUser := User{Email: email}
+// CreateUser registers a new user. Both the email and the handle must be
+// unique, ignoring case, otherwise ErrEmailTaken or ErrHandleTaken is returned.
+// Returns ErrInvalidHandle if the handle is malformed.
+func (db *DB) CreateUser(email, handle, password string) (UserDTO, error) {
+	newUser := User{Email: email, Handle: handle}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+	if err := ValidateHandle(handle); err != nil {
 		return NewUserDTO(newUser), err
 	}
-	newUser.HashedPassword = hashed
 
-	dbstruct, err := db.loadDB()
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return NewUserDTO(newUser), err
 	}
+	newUser.HashedPassword = hashed
 
-	for _, user := range dbstruct.Users {
-		if user.Email == email {
-			return NewUserDTO(newUser), ErrEmailTaken
+	err = db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.userByEmail(email); ok {
+			return ErrEmailTaken
 		}
-	}
+		if _, ok := dbstruct.userByHandle(handle); ok {
+			return ErrHandleTaken
+		}
+
+		newUser.Id = dbstruct.nextUserID()
+		dbstruct.Users[newUser.Id] = newUser
+		return nil
+	})
 
+	return NewUserDTO(newUser), err
+}
+
+// the ID of the next new user, IDs of deleted users are never reused
+func (dbstruct *DBStruct) nextUserID() int {
 	maxID := 0
 	for id := range dbstruct.Users {
 		if id > maxID {
 			maxID = id
 		}
 	}
-	newUser.Id = maxID + 1
-	dbstruct.Users[newUser.Id] = newUser
+	for id := range dbstruct.DeletedUsers {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	return maxID + 1
+}
+
+// the ID of the next new chirp, IDs of deleted chirps are never reused
+func (dbstruct *DBStruct) nextChirpID() int {
+	maxID := 0
+	for id := range dbstruct.Chirps {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	for id := range dbstruct.DeletedChirps {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	return maxID + 1
+}
 
-	err = db.writeDB(dbstruct)
+func (user *User) revokeTokensIssuedBefore(before time.Time) {
+	user.TokensValidAfter = before
+	user.TokenGeneration++
+}
 
-	return NewUserDTO(newUser), err
+// TokenRevoked reports whether a token issued to the user at issuedAt, when
+// the user had the given token generation, was revoked since. Token times
+// only have whole seconds, so of the tokens issued in the second
+// TokensValidAfter falls in only those with the current generation are kept.
+func (user *User) TokenRevoked(issuedAt time.Time, generation int) bool {
+	validAfter := user.TokensValidAfter.Truncate(time.Second)
+	if issuedAt.Before(validAfter) {
+		return true
+	}
+	return issuedAt.Before(validAfter.Add(time.Second)) && generation < user.TokenGeneration
+}
+
+// RevokeTokensIssuedBefore makes every token issued to a user before before
+// invalid, or before now if before is zero or in the future. It never makes
+// tokens valid again that were revoked already. Returns the time tokens are
+// valid after.
+func (db *DB) RevokeTokensIssuedBefore(userID int, before time.Time) (time.Time, error) {
+	var validAfter time.Time
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		if now := time.Now(); before.IsZero() || before.After(now) {
+			before = now
+		}
+		if before.After(user.TokensValidAfter) {
+			user.revokeTokensIssuedBefore(before)
+			dbstruct.Users[userID] = user
+		}
+		validAfter = user.TokensValidAfter
+		return nil
+	})
+
+	return validAfter, err
 }
 
 // UpgradeUser marks a user as `IsChirpyRed`.
@@ -215,91 +457,167 @@ func (db *DB) CreateUser(email, password string) (UserDTO, error) {
 // if the given userID does not exist, return ErrUserNotFound. Any other
 // error is from loading/writing the database
 func (db *DB) UpgradeUser(userID int) error {
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user, ok := dbstruct.Users[userID]
-	if !ok {
-		return ErrUserNotFound
-	}
-
-	user.IsChirpyRed = true
-	dbstruct.Users[userID] = user
-	db.writeDB(dbstruct)
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
 
-	return nil
+		user.IsChirpyRed = true
+		dbstruct.Users[userID] = user
+		return nil
+	})
 }
 
 // Deletes a chirp entry by id. Returns ErrChirpNotFound if it doesn't exist.
 func (db *DB) DeleteChirp(id int) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return err
+	return db.update(func(dbStruct *DBStruct) error {
+		if _, ok := dbStruct.Chirps[id]; !ok {
+			return ErrChirpNotFound
+		}
+
+		dbStruct.removeChirp(id)
+		return nil
+	})
+}
+
+// changes to a user's email and password, nil fields are left as they are
+type UserUpdate struct {
+	Email    *string
+	Password *string
+}
+
+// UpdateUser applies the non-nil fields of update to a user, every other field
+// of the user is kept. A changed email has to be verified again. Returns
+// ErrEmailTaken if another user has the new email, ignoring case.
+func (db *DB) UpdateUser(id int, update UserUpdate) (*UserDTO, error) {
+	var hashed []byte
+	if update.Password != nil {
+		var err error
+		hashed, err = bcrypt.GenerateFromPassword([]byte(*update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if _, ok := dbStruct.Chirps[id]; !ok {
-		return ErrChirpNotFound
+	var dto UserDTO
+	err := db.update(func(dbstruct *DBStruct) error {
+		updatedUser, ok := dbstruct.Users[id]
+		if !ok {
+			return fmt.Errorf("%w, missing id: %d", ErrUserNotFound, id)
+		}
+
+		if err := dbstruct.applyUserUpdate(&updatedUser, update, hashed); err != nil {
+			return err
+		}
+		dbstruct.Users[id] = updatedUser
+
+		dto = NewUserDTO(updatedUser)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &dto, nil
+}
 
-	delete(dbStruct.Chirps, id)
-	db.writeDB(dbStruct)
+// applies update to user, with the new password already hashed
+func (dbstruct *DBStruct) applyUserUpdate(user *User, update UserUpdate, hashedPassword []byte) error {
+	if update.Email != nil {
+		if other, ok := dbstruct.userByEmail(*update.Email); ok && other.Id != user.Id {
+			return ErrEmailTaken
+		}
+		if !strings.EqualFold(user.Email, *update.Email) {
+			user.EmailVerified = false
+		}
+		user.Email = *update.Email
+	}
 
+	if update.Password != nil {
+		user.HashedPassword = hashedPassword
+	}
 	return nil
 }
 
-func (db *DB) UpdateUser(id int, new_email, new_password string) (*UserDTO, error) {
+// CheckPassword checks the password of a user, for confirming sensitive
+// changes. Returns ErrWrongPassword if it doesn't match and ErrUserNotFound if
+// the user doesn't exist.
+func (db *DB) CheckPassword(userID int, password string) error {
 	dbstruct, err := db.loadDB()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if _, ok := dbstruct.Users[id]; !ok {
-		return nil, fmt.Errorf("%w, missing id: %d", err, id)
+	user, ok := dbstruct.Users[userID]
+	if !ok {
+		return ErrUserNotFound
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(new_password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, err
-	}
+	return bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
+}
+
+var (
+	gDummyHash     []byte
+	gDummyHashOnce sync.Once
+)
+
+// a bcrypt hash no password matches, for comparing against
+func dummyHash() []byte {
+	gDummyHashOnce.Do(func() {
+		gDummyHash, _ = bcrypt.GenerateFromPassword([]byte("no user has this password"), bcrypt.DefaultCost)
+	})
+	return gDummyHash
+}
 
-	updatedUser := User{
-		Id:             id,
-		Email:          new_email,
-		HashedPassword: hashed,
+// finds a user by email or handle, ignoring case
+func (dbstruct *DBStruct) userByLogin(login string) (User, bool) {
+	user, ok := dbstruct.userByEmail(login)
+	if !ok {
+		user, ok = dbstruct.userByHandle(login)
 	}
-	dbstruct.Users[id] = updatedUser
-	db.writeDB(dbstruct)
+	return user, ok
+}
 
-	// TODO: check for duplicate emails
+// UserIDByLogin returns the ID of the user with the given email or handle, or
+// ErrUserNotFound.
+func (db *DB) UserIDByLogin(login string) (int, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
 
-	dto := NewUserDTO(updatedUser)
-	return &dto, nil
+	user, ok := dbstruct.userByLogin(login)
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return user.Id, nil
 }
 
-// validates user and returns the user's details
+// validates user and returns the user's details. login is either the email
+// or the handle of the user, both are matched ignoring case.
 // If the password is wrong, ErrWrongPassword is returned
 // user details is only returned when validation passes
-func (db *DB) ValidateUser(email, password string) (*UserDTO, error) {
+func (db *DB) ValidateUser(login, password string) (*UserDTO, error) {
 	dbstruct, err := db.loadDB()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, user := range dbstruct.Users {
-		if user.Email == email {
-			err = bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
-			if err != nil {
-				return nil, err
-			}
+	user, ok := dbstruct.userByLogin(login)
+	if !ok {
+		// take as long as checking a real password, so response times don't
+		// tell which logins exist
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrUnregisteredEmail
+	}
 
-			userDTO := NewUserDTO(user)
-			return &userDTO, nil
-		}
+	err = bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password))
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, ErrUnregisteredEmail
+	userDTO := NewUserDTO(user)
+	return &userDTO, nil
 }
 
 // Checks if a token is marked as revoked. If an error is returned, the token should not be used.
@@ -318,25 +636,40 @@ func (db *DB) CheckTokenRevocation(token string) error {
 }
 
 func (db *DB) AddTokenRevocation(token string) error {
-	dbStruct, err := db.loadDB()
+	return db.update(func(dbStruct *DBStruct) error {
+		dbStruct.RevokedRefreshTokens[token] = time.Now()
+		return nil
+	})
+}
+
+// loadDB reads the database file into memory. The result is a snapshot for
+// reading only, changes go through update.
+func (db *DB) loadDB() (DBStruct, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.readFile()
+}
+
+// update runs fn on the current database and writes the result to disk. The
+// write lock is held from loading to writing, so no other update can come in
+// between and be undone. If fn returns an error nothing is written.
+func (db *DB) update(fn func(dbstruct *DBStruct) error) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	dbstruct, err := db.readFile()
 	if err != nil {
 		return err
 	}
-
-	dbStruct.RevokedRefreshTokens[token] = time.Now()
-	err = db.writeDB(dbStruct)
-	if err != nil {
+	if err := fn(&dbstruct); err != nil {
 		return err
 	}
 
-	return nil
+	return db.writeFile(dbstruct)
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStruct, error) {
-	db.lock.RLock()
-	defer db.lock.RUnlock()
-
+func (db *DB) readFile() (DBStruct, error) {
 	var dbStruct DBStruct
 
 	f, err := os.Open(db.path)
@@ -348,21 +681,31 @@ func (db *DB) loadDB() (DBStruct, error) {
 
 	decoder := json.NewDecoder(f)
 	err = decoder.Decode(&dbStruct)
+	dbStruct.initMaps()
 
 	return dbStruct, err
 }
 
-// writes the database file to disk
-func (db *DB) writeDB(dbStruct DBStruct) error {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-
-	f, err := os.OpenFile(db.path, os.O_WRONLY, os.ModeAppend)
+// writes the database file to disk. The new contents are written to a
+// temporary file which then replaces the database file, so a failed write never
+// leaves a partially updated database behind. Needs the write lock.
+func (db *DB) writeFile(dbStruct DBStruct) error {
+	tmp := db.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	encoder := json.NewEncoder(f)
-	return encoder.Encode(dbStruct)
+	if err := encoder.Encode(dbStruct); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, db.path)
 }
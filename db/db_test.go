@@ -4,7 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const gDBPath = "/tmp/testing_db.json"
@@ -48,16 +52,38 @@ func TestDB(t *testing.T) {
 		}
 	}
 
-	assertOk(testAddUser(db, "x@ymail.com", "U@*#PFOcj mp", 1))
-	assertOk(testAddUser(db, "abc@dmail.com", "10f9j", 2))
-	err = testAddUser(db, "x@ymail.com", ";alksdjf", -1)
+	assertOk(testAddUser(db, "x@ymail.com", "x_user", "U@*#PFOcj mp", 1))
+	assertOk(testAddUser(db, "abc@dmail.com", "abc", "10f9j", 2))
+	err = testAddUser(db, "X@ymail.com", "another", ";alksdjf", -1)
 	if !errors.Is(err, ErrEmailTaken) {
 		t.Errorf("expected %s, got %s", ErrEmailTaken, err)
 	}
+	err = testAddUser(db, "another@ymail.com", "ABC", ";alksdjf", -1)
+	if !errors.Is(err, ErrHandleTaken) {
+		t.Errorf("expected %s, got %s", ErrHandleTaken, err)
+	}
+	err = testAddUser(db, "another@ymail.com", "a-b", ";alksdjf", -1)
+	if !errors.Is(err, ErrInvalidHandle) {
+		t.Errorf("expected %s, got %s", ErrInvalidHandle, err)
+	}
+
+	// handles work for logging in too
+	assertOk(testValidatePassword(db, "ABC", "10f9j", 2, true))
 
 	assertOk(testAddChirp(db, "first chirp!", 1, 1))
 	assertOk(testAddChirp(db, "second chirp", 2, 2))
 
+	// content warning and sensitive flag are stored
+	if chirp, err := db.CreateChirp(1, "spoilers ahead", "movie spoilers", true); err != nil {
+		t.Errorf("creating flagged chirp: %s", err)
+	} else if got, err := db.GetChirp(chirp.Id); err != nil {
+		t.Errorf("getting flagged chirp: %s", err)
+	} else if got.ContentWarning != "movie spoilers" || !got.Sensitive {
+		t.Errorf("expected content warning and sensitive flag to be stored, got %+v", got)
+	} else {
+		assertOk(db.DeleteChirp(chirp.Id))
+	}
+
 	assertOk(testValidatePassword(db, "x@ymail.com", "U@*#PFOcj mp", 1, true))
 	assertOk(testValidatePassword(db, "abc@dmail.com", "10f9j", 2, true))
 	err = testValidatePassword(db, "x@ymail.com", "wrong password", -1, false)
@@ -68,6 +94,23 @@ func TestDB(t *testing.T) {
 	assertOk(testUpdateUser(db, 1, "new@ymail.com", "U@*#PFOcj mp"))
 	assertOk(testUpdateUser(db, 2, "new@dmail.com", "new_password"))
 
+	// partial updates keep everything else
+	assertOk(db.UpgradeUser(2))
+	otherEmail := "other@dmail.com"
+	if user, err := db.UpdateUser(2, UserUpdate{Email: &otherEmail}); err != nil || !user.IsChirpyRed {
+		t.Errorf("expected chirpy red to survive an email change, got %+v (%v)", user, err)
+	}
+	assertOk(testValidatePassword(db, otherEmail, "new_password", 2, true))
+	newPassword := "newer_password"
+	if user, err := db.UpdateUser(2, UserUpdate{Password: &newPassword}); err != nil || user.Email != otherEmail {
+		t.Errorf("expected email to survive a password change, got %+v (%v)", user, err)
+	}
+	assertOk(db.CheckPassword(2, newPassword))
+	if err := db.CheckPassword(2, "new_password"); err != ErrWrongPassword {
+		t.Errorf(`Expected error to be %s, got %s`, ErrWrongPassword, err)
+	}
+	assertOk(testUpdateUser(db, 2, "new@dmail.com", "new_password"))
+
 	revokedToken := "revoked_token"
 	assertOk(db.AddTokenRevocation(revokedToken))
 	err = db.CheckTokenRevocation(revokedToken)
@@ -87,6 +130,380 @@ func TestDB(t *testing.T) {
 		t.Errorf("expected user.is_chirpy_red to be true, got false")
 	}
 
+	// reports hide a chirp once the threshold is reached
+	if _, err := db.ReportChirp(1, 1, ReportSpam, "", 2); err != nil {
+		t.Errorf("reporting chirp: %s", err)
+	}
+	if _, err := db.ReportChirp(1, 1, ReportSpam, "", 2); err != ErrAlreadyReported {
+		t.Errorf(`Expected error to be %s, got %s`, ErrAlreadyReported, err)
+	}
+	if chirp, _ := db.GetChirp(1); chirp.Hidden {
+		t.Errorf("expected chirp to be visible below the report threshold")
+	}
+	assertOk(func() error { _, err := db.ReportChirp(1, 2, ReportOther, "", 2); return err }())
+	if chirp, _ := db.GetChirp(1); !chirp.Hidden {
+		t.Errorf("expected chirp to be hidden after reaching the report threshold")
+	}
+	if queue, err := db.GetModerationQueue(); err != nil {
+		t.Errorf("getting moderation queue: %s", err)
+	} else if len(queue) != 1 || len(queue[0].Reports) != 2 {
+		t.Errorf("expected one chirp with two reports in the queue, got %+v", queue)
+	}
+	assertOk(db.ModerateChirp(1, ModerationApprove))
+	if chirp, _ := db.GetChirp(1); chirp.Hidden {
+		t.Errorf("expected approved chirp to be visible")
+	}
+	if queue, err := db.GetModerationQueue(); err != nil || len(queue) != 0 {
+		t.Errorf("expected empty moderation queue, got %+v (%v)", queue, err)
+	}
+	if _, err := db.ReportChirp(100, 1, ReportSpam, "", 2); err != ErrChirpNotFound {
+		t.Errorf(`Expected error to be %s, got %s`, ErrChirpNotFound, err)
+	}
+
+	// follows and timeline
+	assertOk(testAddUser(db, "follower@dmail.com", "follower", "f0ll0w", 3))
+	assertOk(db.Follow(3, 1))
+	assertOk(db.Follow(3, 2))
+	if err := db.Follow(3, 3); err != ErrFollowSelf {
+		t.Errorf(`Expected error to be %s, got %s`, ErrFollowSelf, err)
+	}
+	if err := db.Follow(3, 100); err != ErrUserNotFound {
+		t.Errorf(`Expected error to be %s, got %s`, ErrUserNotFound, err)
+	}
+	for _, author := range []int{1, 2, 1, 3, 2} {
+		if _, err := db.CreateChirp(author, "timeline chirp", "", false); err != nil {
+			t.Errorf("creating chirp: %s", err)
+		}
+	}
+	timeline, err := db.GetTimeline(3, 0, 100)
+	assertOk(err)
+	gotIDs := []int{}
+	for _, chirp := range timeline {
+		gotIDs = append(gotIDs, chirp.Id)
+	}
+	// chirps 1 and 2 from before, 3 was deleted, the new ones are 4 to 8 with
+	// 7 by user 3
+	if expect := []int{8, 6, 5, 4, 2, 1}; !reflect.DeepEqual(gotIDs, expect) {
+		t.Errorf("expected timeline %v, got %v", expect, gotIDs)
+	}
+	if timeline, err := db.GetTimeline(3, 5, 2); err != nil || len(timeline) != 2 || timeline[0].Id != 4 || timeline[1].Id != 2 {
+		t.Errorf("expected chirps 4 and 2 before chirp 5, got %+v (%v)", timeline, err)
+	}
+	assertOk(db.DeleteChirp(6))
+	if timeline, err := db.GetTimeline(3, 0, 1); err != nil || len(timeline) != 1 || timeline[0].Id != 8 {
+		t.Errorf("expected newest chirp to be 8, got %+v (%v)", timeline, err)
+	}
+	assertOk(db.Unfollow(3, 2))
+	if following, err := db.GetFollowing(3); err != nil || len(following) != 1 || following[0].UserID != 1 {
+		t.Errorf("expected user 3 to only follow user 1, got %+v (%v)", following, err)
+	}
+	if followers, err := db.GetFollowers(1); err != nil || len(followers) != 1 || followers[0].UserID != 3 {
+		t.Errorf("expected user 1 to be followed by user 3, got %+v (%v)", followers, err)
+	}
+
+	// profiles
+	name, bio := "Ex", "hello"
+	if profile, err := db.UpdateProfile(1, ProfileUpdate{DisplayName: &name}); err != nil {
+		t.Errorf("updating profile: %s", err)
+	} else if profile.DisplayName != name || profile.FollowersCount != 1 {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+	assertOk(func() error { _, err := db.UpdateProfile(1, ProfileUpdate{Bio: &bio}); return err }())
+	assertOk(testUpdateUser(db, 1, "new@ymail.com", "U@*#PFOcj mp"))
+	if profile, err := db.GetProfile(1); err != nil {
+		t.Errorf("getting profile: %s", err)
+	} else if profile.DisplayName != name || profile.Bio != bio {
+		t.Errorf("expected profile to survive updates, got %+v", profile)
+	}
+	if _, err := db.GetProfile(100); err != ErrUserNotFound {
+		t.Errorf(`Expected error to be %s, got %s`, ErrUserNotFound, err)
+	}
+
+	// changing handles
+	if _, err := db.ChangeHandle(1, "abc", time.Hour); err != ErrHandleTaken {
+		t.Errorf(`Expected error to be %s, got %s`, ErrHandleTaken, err)
+	}
+	if _, err := db.ChangeHandle(1, "new_x", time.Hour); err != nil {
+		t.Errorf("changing handle: %s", err)
+	}
+	if next, err := db.ChangeHandle(1, "newer_x", time.Hour); err != ErrHandleChangeTooSoon || time.Until(next) < 59*time.Minute {
+		t.Errorf(`Expected error to be %s an hour from now, got %s at %s`, ErrHandleChangeTooSoon, err, next)
+	}
+	if profile, err := db.GetProfileByHandle("NEW_X"); err != nil || profile.Id != 1 {
+		t.Errorf("expected to find user 1 by new handle, got %+v (%v)", profile, err)
+	}
+
+	// email verification
+	verifyToken, err := db.CreateVerificationToken(2, time.Hour)
+	assertOk(err)
+	if _, err := db.VerifyEmail("bogus"); err != ErrInvalidToken {
+		t.Errorf(`Expected error to be %s, got %s`, ErrInvalidToken, err)
+	}
+	if user, err := db.VerifyEmail(verifyToken); err != nil || !user.EmailVerified {
+		t.Errorf("expected user 2 to be verified, got %+v (%v)", user, err)
+	}
+	if _, err := db.VerifyEmail(verifyToken); err != ErrInvalidToken {
+		t.Errorf("expected token to only work once, got %v", err)
+	}
+	expiredToken, err := db.CreateVerificationToken(1, -time.Second)
+	assertOk(err)
+	if _, err := db.VerifyEmail(expiredToken); err != ErrInvalidToken {
+		t.Errorf("expected expired token to be rejected, got %v", err)
+	}
+	staleToken, err := db.CreateVerificationToken(1, time.Hour)
+	assertOk(err)
+	assertOk(testUpdateUser(db, 1, "changed@ymail.com", "pw"))
+	if _, err := db.VerifyEmail(staleToken); err != ErrInvalidToken {
+		t.Errorf("expected token for an old address to be rejected, got %v", err)
+	}
+
+	// password reset
+	if _, _, err := db.CreatePasswordResetToken("nobody@dmail.com", time.Hour); err != ErrUnregisteredEmail {
+		t.Errorf(`Expected error to be %s, got %s`, ErrUnregisteredEmail, err)
+	}
+	resetToken, _, err := db.CreatePasswordResetToken("NEW@dmail.com", time.Hour)
+	assertOk(err)
+	if _, err := db.VerifyEmail(resetToken); err != ErrInvalidToken {
+		t.Errorf("expected a reset token to not verify emails, got %v", err)
+	}
+	before := time.Now()
+	if user, err := db.ResetPassword(resetToken, "reset"); err != nil || user.Id != 2 {
+		t.Errorf("expected password of user 2 to be reset, got %+v (%v)", user, err)
+	}
+	assertOk(testValidatePassword(db, "new@dmail.com", "reset", 2, true))
+	if user, err := db.GetUser(2); err != nil || user.TokensValidAfter.Before(before) {
+		t.Errorf("expected tokens issued before the reset to be revoked, got %+v (%v)", user, err)
+	}
+	if _, err := db.ResetPassword(resetToken, "again"); err != ErrInvalidToken {
+		t.Errorf("expected reset token to only work once, got %v", err)
+	}
+
+	// two-factor authentication
+	if err := db.EnableTOTP(1, 10, nil); err != ErrNoPendingTOTP {
+		t.Errorf(`Expected error to be %s, got %s`, ErrNoPendingTOTP, err)
+	}
+	assertOk(db.BeginTOTPEnrollment(1, []byte("sealed")))
+	assertOk(db.EnableTOTP(1, 10, []string{"code1", "code2"}))
+	if err := db.BeginTOTPEnrollment(1, []byte("again")); err != ErrMFAAlreadyEnabled {
+		t.Errorf(`Expected error to be %s, got %s`, ErrMFAAlreadyEnabled, err)
+	}
+	if err := db.UseTOTPStep(1, 10); err != ErrTOTPCodeReused {
+		t.Errorf(`Expected error to be %s, got %s`, ErrTOTPCodeReused, err)
+	}
+	assertOk(db.UseTOTPStep(1, 11))
+	assertOk(db.UseRecoveryCode(1, "code2"))
+	if err := db.UseRecoveryCode(1, "code2"); err != ErrInvalidRecoveryCode {
+		t.Errorf(`Expected error to be %s, got %s`, ErrInvalidRecoveryCode, err)
+	}
+	challenge, err := db.CreateMFAChallenge(1, time.Minute)
+	assertOk(err)
+	if user, err := db.ConsumeMFAChallenge(challenge); err != nil || user.Id != 1 || user.TOTPSecret == nil {
+		t.Errorf("expected challenge for user 1 with two-factor authentication, got %+v (%v)", user, err)
+	}
+	if _, err := db.ConsumeMFAChallenge(challenge); err != ErrInvalidToken {
+		t.Errorf("expected challenge to only work once, got %v", err)
+	}
+	assertOk(db.DisableTOTP(1))
+	if user, err := db.GetUser(1); err != nil || user.TOTPSecret != nil || user.RecoveryCodes != nil {
+		t.Errorf("expected two-factor authentication to be off, got %+v (%v)", user, err)
+	}
+
+	// refresh token rotation
+	expiresAt := time.Now().Add(time.Hour)
+	family, jti1, err := db.CreateRefreshFamily(1, Client{"test", "10.0.0.1"}, expiresAt)
+	assertOk(err)
+	jti2, err := db.RotateRefreshToken(1, family, jti1, Client{"test", "10.0.0.2"}, expiresAt)
+	assertOk(err)
+	if _, err := db.RotateRefreshToken(2, family, jti2, Client{"test", "10.0.0.2"}, expiresAt); err != ErrTokenRevoked {
+		t.Errorf(`Expected error to be %s, got %s`, ErrTokenRevoked, err)
+	}
+	if _, err := db.RotateRefreshToken(1, family, jti1, Client{"test", "10.0.0.2"}, expiresAt); err != ErrRefreshTokenReused {
+		t.Errorf(`Expected error to be %s, got %s`, ErrRefreshTokenReused, err)
+	}
+	if _, err := db.RotateRefreshToken(1, family, jti2, Client{"test", "10.0.0.2"}, expiresAt); err != ErrTokenRevoked {
+		t.Errorf("expected reuse to revoke the family, got %v", err)
+	}
+	family, jti1, err = db.CreateRefreshFamily(1, Client{"test", "10.0.0.1"}, expiresAt)
+	assertOk(err)
+	assertOk(db.RevokeRefreshFamily(family))
+	if _, err := db.RotateRefreshToken(1, family, jti1, Client{"test", "10.0.0.2"}, expiresAt); err != ErrTokenRevoked {
+		t.Errorf(`Expected error to be %s, got %s`, ErrTokenRevoked, err)
+	}
+
+	// sessions
+	phone, _, err := db.CreateRefreshFamily(1, Client{"phone", "10.0.0.3"}, expiresAt)
+	assertOk(err)
+	laptop, jti1, err := db.CreateRefreshFamily(1, Client{"laptop", "10.0.0.4"}, expiresAt)
+	assertOk(err)
+	_, err = db.RotateRefreshToken(1, laptop, jti1, Client{"laptop", "10.0.0.5"}, expiresAt)
+	assertOk(err)
+	if sessions, err := db.Sessions(1); err != nil || len(sessions) != 2 || sessions[0].Id != laptop || sessions[0].IP != "10.0.0.5" || sessions[1].UserAgent != "phone" {
+		t.Errorf("expected the laptop and phone sessions, got %+v (%v)", sessions, err)
+	}
+	if err := db.RevokeSession(2, phone); err != ErrTokenRevoked {
+		t.Errorf("expected sessions of other users to be left alone, got %v", err)
+	}
+	assertOk(db.RevokeSession(1, phone))
+	if sessions, err := db.Sessions(1); err != nil || len(sessions) != 1 || sessions[0].Id != laptop {
+		t.Errorf("expected only the laptop session, got %+v (%v)", sessions, err)
+	}
+	assertOk(db.RevokeAllSessions(1))
+	if sessions, err := db.Sessions(1); err != nil || len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %+v (%v)", sessions, err)
+	}
+
+	// API keys
+	plainKey, apiKey, err := db.CreateAPIKey(1, "bot", []string{"chirps:write"})
+	assertOk(err)
+	if key, err := db.AuthenticateAPIKey(plainKey); err != nil || key.Id != apiKey.Id || !key.HasScope("chirps:write") || key.HasScope("chirps:read") {
+		t.Errorf("expected key %s with only chirps:write, got %+v (%v)", apiKey.Id, key, err)
+	}
+	for _, bad := range []string{plainKey + "0", "chirpy_" + apiKey.Id, apiKey.Hash} {
+		if _, err := db.AuthenticateAPIKey(bad); err != ErrInvalidAPIKey {
+			t.Errorf("expected %q to be rejected, got %v", bad, err)
+		}
+	}
+	if err := db.RevokeAPIKey(2, apiKey.Id); err != ErrInvalidAPIKey {
+		t.Errorf("expected keys of other users to be left alone, got %v", err)
+	}
+	assertOk(db.RevokeAPIKey(1, apiKey.Id))
+	if _, err := db.AuthenticateAPIKey(plainKey); err != ErrInvalidAPIKey {
+		t.Errorf(`Expected error to be %s, got %s`, ErrInvalidAPIKey, err)
+	}
+
+	// OAuth clients and consent
+	client, secret, err := db.CreateOAuthClient("app", []string{"https://app.example/cb"}, false)
+	assertOk(err)
+	if _, err := db.AuthenticateOAuthClient(client.Id, "wrong"); err != ErrInvalidClient {
+		t.Errorf(`Expected error to be %s, got %v`, ErrInvalidClient, err)
+	}
+	if got, err := db.AuthenticateOAuthClient(client.Id, secret); err != nil || got.Id != client.Id {
+		t.Errorf("expected client %s, got %+v (%v)", client.Id, got, err)
+	}
+	spa, spaSecret, err := db.CreateOAuthClient("spa", []string{"https://spa.example/cb"}, true)
+	assertOk(err)
+	if spaSecret != "" || !spa.Public() {
+		t.Errorf("expected a public client without secret, got %+v", spa)
+	}
+	if _, err := db.AuthenticateOAuthClient(spa.Id, ""); err != nil {
+		t.Errorf("expected public clients to authenticate without secret, got %v", err)
+	}
+	assertOk(db.GrantConsent(1, client.Id, []string{"openid"}))
+	assertOk(db.GrantConsent(1, client.Id, []string{"email"}))
+	if ok, err := db.HasConsent(1, client.Id, []string{"openid", "email"}); err != nil || !ok {
+		t.Errorf("expected granted scopes to add up, got %v (%v)", ok, err)
+	}
+	if ok, err := db.HasConsent(1, client.Id, []string{"openid", "profile"}); err != nil || ok {
+		t.Errorf("expected no consent for profile, got %v (%v)", ok, err)
+	}
+	code, err := db.CreateAuthorizationCode(AuthorizationCode{UserID: 1, ClientID: client.Id, Scopes: []string{"openid"}}, time.Minute)
+	assertOk(err)
+	if got, err := db.ConsumeAuthorizationCode(code); err != nil || got.UserID != 1 {
+		t.Errorf("expected the code of user 1, got %+v (%v)", got, err)
+	}
+	if _, err := db.ConsumeAuthorizationCode(code); err != ErrInvalidToken {
+		t.Errorf("expected codes to be single use, got %v", err)
+	}
+	code, err = db.CreateAuthorizationCode(AuthorizationCode{UserID: 1, ClientID: client.Id}, time.Minute)
+	assertOk(err)
+	assertOk(db.DeleteOAuthClient(client.Id))
+	if consents, err := db.Consents(1); err != nil || len(consents) != 0 {
+		t.Errorf("expected consents to go with the client, got %+v (%v)", consents, err)
+	}
+	if _, err := db.ConsumeAuthorizationCode(code); err != ErrInvalidToken {
+		t.Errorf("expected codes to go with the client, got %v", err)
+	}
+
+	// deleting users
+	assertOk(testAddUser(db, "leaving@dmail.com", "leaving", "g00dbye", 4))
+	assertOk(db.Follow(4, 1))
+	assertOk(db.Follow(1, 4))
+	leavingChirp, err := db.CreateChirp(4, "bye", "", false)
+	assertOk(err)
+	if _, err := db.DeleteUser(4, "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("expected ErrWrongPassword, got %s", err)
+	}
+	_, err = db.DeleteUser(4, "g00dbye")
+	assertOk(err)
+	if _, err := db.GetUser(4); err != ErrUserNotFound {
+		t.Errorf(`Expected error to be %s, got %s`, ErrUserNotFound, err)
+	}
+	if _, err := db.GetChirp(leavingChirp.Id); err != ErrChirpNotFound {
+		t.Errorf("expected chirps of deleted user to be removed, got %s", err)
+	}
+	if followers, err := db.GetFollowers(1); err != nil || len(followers) != 1 {
+		t.Errorf("expected deleted user to be removed from followers, got %+v (%v)", followers, err)
+	}
+	if following, err := db.GetFollowing(1); err != nil || len(following) != 0 {
+		t.Errorf("expected deleted user to be removed from following, got %+v (%v)", following, err)
+	}
+	if user, err := db.CreateUser("newcomer@dmail.com", "newcomer", "hello"); err != nil || user.Id != 5 {
+		t.Errorf("expected new user to get ID 5, got %+v (%v)", user, err)
+	}
+
+	// accounts at identity providers
+	ssoUser, err := db.CreateUserWithIdentity("sso@corp.example", "sso.user", true, "https://idp.example", "1")
+	assertOk(err)
+	if ssoUser.Handle != "sso_user" || !ssoUser.EmailVerified {
+		t.Errorf("expected a verified user with handle sso_user, got %+v", ssoUser)
+	}
+	if other, err := db.CreateUserWithIdentity("sso2@corp.example", "sso_user", false, "https://idp.example", "2"); err != nil || other.Handle != "sso_user2" {
+		t.Errorf("expected a number to be appended to taken handles, got %+v (%v)", other, err)
+	}
+	if other, err := db.CreateUserWithIdentity("admin@corp.example", "admin", false, "https://idp.example", "3"); err != nil || other.Handle != "admin2" {
+		t.Errorf("expected reserved handles to be avoided, got %+v (%v)", other, err)
+	}
+	if _, err := db.CreateUserWithIdentity("sso@corp.example", "again", true, "https://idp.example", "4"); err != ErrEmailTaken {
+		t.Errorf(`Expected error to be %s, got %v`, ErrEmailTaken, err)
+	}
+	if user, err := db.UserByIdentity("https://idp.example", "1"); err != nil || user.Id != ssoUser.Id {
+		t.Errorf("expected user %d, got %+v (%v)", ssoUser.Id, user, err)
+	}
+	if _, err := db.UserByIdentity("https://other.example", "1"); err != ErrUserNotFound {
+		t.Errorf("expected subjects of other providers to be separate, got %v", err)
+	}
+	if err := db.LinkIdentity(1, "https://idp.example", "1"); err != ErrIdentityLinked {
+		t.Errorf(`Expected error to be %s, got %v`, ErrIdentityLinked, err)
+	}
+	assertOk(db.LinkIdentity(1, "https://other.example", "1"))
+	if user, err := db.UserByIdentity("https://other.example", "1"); err != nil || user.Id != 1 {
+		t.Errorf("expected user 1, got %+v (%v)", user, err)
+	}
+
+	// roles
+	if user, err := db.GetUser(1); err != nil || user.EffectiveRole() != RoleUser {
+		t.Errorf("expected users to start as plain users, got %+v (%v)", user, err)
+	}
+	if _, err := db.CreateFirstAdmin("root@example.com", "admin", "password"); err != ErrHandleTaken {
+		t.Errorf(`Expected error to be %s, got %v`, ErrHandleTaken, err)
+	}
+	admin, err := db.CreateFirstAdmin("root@example.com", "first_admin", "password")
+	assertOk(err)
+	if admin.Role != RoleAdmin || !admin.EmailVerified {
+		t.Errorf("expected a verified admin, got %+v", admin)
+	}
+	if _, err := db.CreateFirstAdmin("root2@example.com", "second_admin", "password"); err != ErrAdminExists {
+		t.Errorf(`Expected error to be %s, got %v`, ErrAdminExists, err)
+	}
+	if _, err := db.SetUserRole(1, "superuser"); err != ErrUnknownRole {
+		t.Errorf(`Expected error to be %s, got %v`, ErrUnknownRole, err)
+	}
+	if _, err := db.SetUserRole(admin.Id, RoleModerator); err != ErrLastAdmin {
+		t.Errorf(`Expected error to be %s, got %v`, ErrLastAdmin, err)
+	}
+	if _, err := db.DeleteUser(admin.Id, "password"); err != ErrLastAdmin {
+		t.Errorf(`Expected error to be %s, got %v`, ErrLastAdmin, err)
+	}
+	if user, err := db.SetUserRole(1, RoleAdmin); err != nil || user.Role != RoleAdmin {
+		t.Errorf("expected user 1 to be an admin, got %+v (%v)", user, err)
+	}
+	if user, err := db.SetUserRole(admin.Id, RoleModerator); err != nil || user.Role != RoleModerator {
+		t.Errorf("expected admins to be demoted while another is left, got %+v (%v)", user, err)
+	}
+	if !RoleAdmin.AtLeast(RoleModerator) || RoleModerator.AtLeast(RoleAdmin) || Role("").AtLeast(RoleUser) {
+		t.Errorf("expected admins to outrank moderators, and no role to outrank none")
+	}
+
 	// upgrading non-existent user
 	err = db.UpgradeUser(100)
 	if err != ErrUserNotFound {
@@ -96,7 +513,7 @@ func TestDB(t *testing.T) {
 
 func testAddChirp(db *DB, content string, authorID, expectID int) error {
 	expect := Chirp{Id: expectID, Body: content, AuthorID: authorID}
-	createdChirp, err := db.CreateChirp(authorID, content)
+	createdChirp, err := db.CreateChirp(authorID, content, "", false)
 	if err != nil {
 		return err
 	}
@@ -118,8 +535,8 @@ func testAddChirp(db *DB, content string, authorID, expectID int) error {
 	return nil
 }
 
-func testAddUser(db *DB, email, password string, expectID int) error {
-	_, err := db.CreateUser(email, password)
+func testAddUser(db *DB, email, handle, password string, expectID int) error {
+	_, err := db.CreateUser(email, handle, password)
 	if err != nil {
 		return fmt.Errorf("CreateUser: %w", err)
 	}
@@ -130,7 +547,7 @@ func testAddUser(db *DB, email, password string, expectID int) error {
 	if len(users) != expectID {
 		return fmt.Errorf(`Expected 1 users, got %d`, len(users))
 	}
-	expect := UserDTO{Id: expectID, Email: email}
+	expect := UserDTO{Id: expectID, Email: email, Handle: handle, Role: RoleUser}
 	got := users[expectID-1]
 	if got != expect {
 		return fmt.Errorf(`Expected user to be %+v\n got %+v`, expect, got)
@@ -153,8 +570,8 @@ func testValidatePassword(db *DB, email, password string, expectID int, expectPa
 		return err
 	}
 
-	if user.Email != email {
-		return fmt.Errorf("expected email to be %s, got %s", email, user.Email)
+	if user.Email != email && !strings.EqualFold(user.Handle, email) {
+		return fmt.Errorf("expected email or handle to be %s, got %s", email, user.Email)
 	}
 
 	if user.Id != expectID {
@@ -165,7 +582,7 @@ func testValidatePassword(db *DB, email, password string, expectID int, expectPa
 }
 
 func testUpdateUser(db *DB, id int, new_email, new_password string) error {
-	_, err := db.UpdateUser(id, new_email, new_password)
+	_, err := db.UpdateUser(id, UserUpdate{Email: &new_email, Password: &new_password})
 	if err != nil {
 		return err
 	}
@@ -187,3 +604,186 @@ func testUpdateUser(db *DB, id int, new_email, new_password string) error {
 
 	return nil
 }
+
+// tokens issued in the second they were revoked are told apart by their
+// generation
+func TestTokenRevoked(t *testing.T) {
+	user := User{}
+	revokedAt := time.Date(2024, 1, 1, 12, 0, 0, 700*int(time.Millisecond), time.UTC)
+	user.revokeTokensIssuedBefore(revokedAt)
+
+	sameSecond := revokedAt.Truncate(time.Second)
+	tests := []struct {
+		issuedAt   time.Time
+		generation int
+		revoked    bool
+	}{
+		{sameSecond.Add(-time.Second), 1, true},
+		{sameSecond, 0, true},
+		{sameSecond, 1, false},
+		{sameSecond.Add(time.Second), 0, false},
+	}
+	for _, test := range tests {
+		if got := user.TokenRevoked(test.issuedAt, test.generation); got != test.revoked {
+			t.Errorf("expected a token issued at %s with generation %d to be revoked: %t, got %t",
+				test.issuedAt, test.generation, test.revoked, got)
+		}
+	}
+}
+
+// a deleted chirp takes its reports along, and its ID isn't handed to the next
+// chirp
+func TestDBDeleteReportedChirp(t *testing.T) {
+	db, err := New(t.TempDir() + "/db.json")
+	if err != nil {
+		t.Fatalf("Creating DB: %s", err)
+	}
+	author, err := db.CreateUser("x@ymail.com", "x_user", "password")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	reporter, err := db.CreateUser("y@ymail.com", "y_user", "password")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+
+	chirp, err := db.CreateChirp(author.Id, "reported", "", false)
+	if err != nil {
+		t.Fatalf("creating chirp: %s", err)
+	}
+	if _, err := db.ReportChirp(chirp.Id, reporter.Id, ReportSpam, "", 2); err != nil {
+		t.Fatalf("reporting chirp: %s", err)
+	}
+	if err := db.DeleteChirp(chirp.Id); err != nil {
+		t.Fatalf("deleting chirp: %s", err)
+	}
+
+	if queue, err := db.GetModerationQueue(); err != nil || len(queue) != 0 {
+		t.Errorf("expected empty moderation queue, got %+v (%v)", queue, err)
+	}
+
+	next, err := db.CreateChirp(author.Id, "innocent", "", false)
+	if err != nil {
+		t.Fatalf("creating chirp: %s", err)
+	}
+	if next.Id == chirp.Id {
+		t.Errorf("expected a new ID, got the deleted chirp's ID %d", chirp.Id)
+	}
+	// the earlier report doesn't count towards the threshold
+	if _, err := db.ReportChirp(next.Id, reporter.Id, ReportSpam, "", 2); err != nil {
+		t.Fatalf("reporting chirp: %s", err)
+	}
+	if got, err := db.GetChirp(next.Id); err != nil || got.Hidden {
+		t.Errorf("expected the new chirp to stay visible, got %+v (%v)", got, err)
+	}
+}
+
+// updates that run at the same time must not undo each other
+func TestDBConcurrentUpdates(t *testing.T) {
+	db, err := New(t.TempDir() + "/db.json")
+	if err != nil {
+		t.Fatalf("Creating DB: %s", err)
+	}
+	user, err := db.CreateUser("x@ymail.com", "x_user", "password")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.CreateChirp(user.Id, "chirp", "", false); err != nil {
+				t.Errorf("creating chirp: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if chirps, err := db.GetChirps(); err != nil || len(chirps) != n {
+		t.Errorf("expected %d chirps, got %d (%v)", n, len(chirps), err)
+	}
+}
+
+// of several refreshes with the same token only one gets a successor
+func TestDBConcurrentRefresh(t *testing.T) {
+	db, err := New(t.TempDir() + "/db.json")
+	if err != nil {
+		t.Fatalf("Creating DB: %s", err)
+	}
+	user, err := db.CreateUser("x@ymail.com", "x_user", "password")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	family, jti, err := db.CreateRefreshFamily(user.Id, Client{"test", "10.0.0.1"}, expiresAt)
+	if err != nil {
+		t.Fatalf("creating refresh family: %s", err)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.RotateRefreshToken(user.Id, family, jti, Client{"test", "10.0.0.1"}, expiresAt)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	rotated := 0
+	for err := range errs {
+		if err == nil {
+			rotated++
+		} else if err != ErrRefreshTokenReused && err != ErrTokenRevoked {
+			t.Errorf("rotating refresh token: %s", err)
+		}
+	}
+	if rotated != 1 {
+		t.Errorf("expected exactly one rotation, got %d", rotated)
+	}
+	if sessions, err := db.Sessions(user.Id); err != nil || len(sessions) != 0 {
+		t.Errorf("expected the reuse to revoke the family, got %+v (%v)", sessions, err)
+	}
+}
+
+// using a key while it is revoked must not bring it back
+func TestDBConcurrentAPIKeyRevocation(t *testing.T) {
+	db, err := New(t.TempDir() + "/db.json")
+	if err != nil {
+		t.Fatalf("Creating DB: %s", err)
+	}
+	user, err := db.CreateUser("x@ymail.com", "x_user", "password")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	plainKey, apiKey, err := db.CreateAPIKey(user.Id, "bot", []string{"chirps:read"})
+	if err != nil {
+		t.Fatalf("creating API key: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.AuthenticateAPIKey(plainKey); err != nil && err != ErrInvalidAPIKey {
+				t.Errorf("authenticating API key: %s", err)
+			}
+		}()
+	}
+	if err := db.RevokeAPIKey(user.Id, apiKey.Id); err != nil {
+		t.Errorf("revoking API key: %s", err)
+	}
+	wg.Wait()
+
+	if _, err := db.AuthenticateAPIKey(plainKey); err != ErrInvalidAPIKey {
+		t.Errorf(`Expected error to be %s, got %v`, ErrInvalidAPIKey, err)
+	}
+}
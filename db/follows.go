@@ -0,0 +1,186 @@
+package db
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrFollowSelf = errors.New("users can't follow themselves")
+
+// one side of a follow relationship, as listed for a user's followers or
+// followed users
+type Follow struct {
+	UserID int       `json:"user_id"`
+	Since  time.Time `json:"since"`
+}
+
+// Follow makes followerID follow followeeID. Following someone twice is a
+// no-op. Returns ErrUserNotFound if either user doesn't exist.
+func (db *DB) Follow(followerID, followeeID int) error {
+	if followerID == followeeID {
+		return ErrFollowSelf
+	}
+
+	return db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.Users[followerID]; !ok {
+			return ErrUserNotFound
+		}
+		if _, ok := dbstruct.Users[followeeID]; !ok {
+			return ErrUserNotFound
+		}
+
+		following, ok := dbstruct.Follows[followerID]
+		if !ok {
+			following = make(map[int]time.Time)
+			dbstruct.Follows[followerID] = following
+		}
+		if _, ok := following[followeeID]; ok {
+			return nil
+		}
+		following[followeeID] = time.Now()
+
+		return nil
+	})
+}
+
+// Unfollow removes a follow relationship, if there is one.
+func (db *DB) Unfollow(followerID, followeeID int) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		following, ok := dbstruct.Follows[followerID]
+		if !ok {
+			return nil
+		}
+		if _, ok := following[followeeID]; !ok {
+			return nil
+		}
+
+		delete(following, followeeID)
+		if len(following) == 0 {
+			delete(dbstruct.Follows, followerID)
+		}
+
+		return nil
+	})
+}
+
+// GetFollowing returns the users userID follows, oldest first.
+// Returns ErrUserNotFound if the user doesn't exist.
+func (db *DB) GetFollowing(userID int) ([]Follow, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := dbstruct.Users[userID]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	follows := []Follow{}
+	for followee, since := range dbstruct.Follows[userID] {
+		follows = append(follows, Follow{followee, since})
+	}
+	sortFollows(follows)
+
+	return follows, nil
+}
+
+// GetFollowers returns the users following userID, oldest first.
+// Returns ErrUserNotFound if the user doesn't exist.
+func (db *DB) GetFollowers(userID int) ([]Follow, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := dbstruct.Users[userID]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	follows := []Follow{}
+	for follower, following := range dbstruct.Follows {
+		if since, ok := following[userID]; ok {
+			follows = append(follows, Follow{follower, since})
+		}
+	}
+	sortFollows(follows)
+
+	return follows, nil
+}
+
+func sortFollows(follows []Follow) {
+	sort.Slice(follows, func(i, j int) bool {
+		if !follows[i].Since.Equal(follows[j].Since) {
+			return follows[i].Since.Before(follows[j].Since)
+		}
+		return follows[i].UserID < follows[j].UserID
+	})
+}
+
+// GetTimeline returns up to limit chirps by the users userID follows, newest
+// first, starting below the chirp ID before (0 starts from the newest chirp).
+// Hidden chirps are skipped.
+//
+// The whole database is still loaded, but after that the chirps are merged
+// from the per-author index (fan-out on read), so only about limit chirps are
+// looked at instead of every chirp.
+func (db *DB) GetTimeline(userID, before, limit int) ([]Chirp, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	// one cursor per followed author, pointing at their newest chirp below before
+	cursors := timelineHeap{}
+	for followee := range dbstruct.Follows[userID] {
+		ids := dbstruct.ChirpsByAuthor[followee]
+		end := len(ids)
+		if before > 0 {
+			end = sort.SearchInts(ids, before)
+		}
+		if end > 0 {
+			cursors = append(cursors, timelineCursor{ids, end - 1})
+		}
+	}
+	heap.Init(&cursors)
+
+	chirps := []Chirp{}
+	for len(chirps) < limit && len(cursors) > 0 {
+		cur := &cursors[0]
+		chirp := dbstruct.Chirps[cur.ids[cur.pos]]
+
+		cur.pos--
+		if cur.pos < 0 {
+			heap.Pop(&cursors)
+		} else {
+			heap.Fix(&cursors, 0)
+		}
+
+		if !chirp.Hidden {
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	return chirps, nil
+}
+
+// position in one author's ascending list of chirp IDs, walking backwards
+type timelineCursor struct {
+	ids []int
+	pos int
+}
+
+// max-heap of cursors by the chirp ID they point at
+type timelineHeap []timelineCursor
+
+func (h timelineHeap) Len() int           { return len(h) }
+func (h timelineHeap) Less(i, j int) bool { return h[i].ids[h[i].pos] > h[j].ids[h[j].pos] }
+func (h timelineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *timelineHeap) Push(x any)        { *h = append(*h, x.(timelineCursor)) }
+func (h *timelineHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidHandle       = errors.New("handles must be 3 to 20 letters, digits or underscores")
+	ErrHandleTaken         = errors.New("handle already taken")
+	ErrHandleChangeTooSoon = errors.New("handle was changed too recently")
+)
+
+var gHandlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,20}$`)
+
+// handles that would be confusing or could be used to impersonate staff
+var gReservedHandles = []string{"admin", "administrator", "chirpy", "me", "moderator", "root", "support"}
+
+// ValidateHandle checks that handle is well-formed and not reserved. It does
+// not check whether the handle is taken.
+func ValidateHandle(handle string) error {
+	if !gHandlePattern.MatchString(handle) {
+		return ErrInvalidHandle
+	}
+	for _, reserved := range gReservedHandles {
+		if strings.EqualFold(handle, reserved) {
+			return ErrHandleTaken
+		}
+	}
+
+	return nil
+}
+
+// finds a user by handle, ignoring case
+func (dbstruct *DBStruct) userByHandle(handle string) (User, bool) {
+	for _, user := range dbstruct.Users {
+		if user.Handle != "" && strings.EqualFold(user.Handle, handle) {
+			return user, true
+		}
+	}
+
+	return User{}, false
+}
+
+// finds a user by email, ignoring case
+func (dbstruct *DBStruct) userByEmail(email string) (User, bool) {
+	for _, user := range dbstruct.Users {
+		if strings.EqualFold(user.Email, email) {
+			return user, true
+		}
+	}
+
+	return User{}, false
+}
+
+// UserByEmail returns the user with the given email, ignoring case, or
+// ErrUserNotFound. Unlike UserIDByLogin, handles are not matched.
+func (db *DB) UserByEmail(email string) (UserDTO, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	user, ok := dbstruct.userByEmail(email)
+	if !ok {
+		return UserDTO{}, ErrUserNotFound
+	}
+	return NewUserDTO(user), nil
+}
+
+// GetProfileByHandle returns the public profile of the user with the given
+// handle, ignoring case, or ErrUserNotFound.
+func (db *DB) GetProfileByHandle(handle string) (*Profile, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := dbstruct.userByHandle(handle)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	profile := newProfile(dbstruct, user)
+	return &profile, nil
+}
+
+// ChangeHandle gives a user a new handle. A user can only change their handle
+// once per cooldown; earlier attempts return ErrHandleChangeTooSoon along with
+// the time the next change is allowed. Changing only the case of the current
+// handle is always allowed.
+func (db *DB) ChangeHandle(userID int, handle string, cooldown time.Duration) (time.Time, error) {
+	if err := ValidateHandle(handle); err != nil {
+		return time.Time{}, err
+	}
+
+	var next time.Time
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		var err error
+		if next, err = dbstruct.applyHandleChange(&user, handle, cooldown); err != nil {
+			return err
+		}
+		dbstruct.Users[userID] = user
+		return nil
+	})
+
+	return next, err
+}
+
+// gives user the already validated handle. With ErrHandleChangeTooSoon, returns
+// the time the next change is allowed.
+func (dbstruct *DBStruct) applyHandleChange(user *User, handle string, cooldown time.Duration) (time.Time, error) {
+	if user.Handle == handle {
+		return time.Time{}, nil
+	}
+
+	if !strings.EqualFold(user.Handle, handle) {
+		if other, ok := dbstruct.userByHandle(handle); ok && other.Id != user.Id {
+			return time.Time{}, ErrHandleTaken
+		}
+
+		if next := user.HandleChangedAt.Add(cooldown); !user.HandleChangedAt.IsZero() && time.Now().Before(next) {
+			return next, ErrHandleChangeTooSoon
+		}
+		user.HandleChangedAt = time.Now()
+	}
+
+	user.Handle = handle
+	return time.Time{}, nil
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"crypto/rand"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Identity links a user to their account at an external identity provider
+type Identity struct {
+	UserID int `json:"user_id"`
+	// the provider's issuer URL and its ID of the user, which together
+	// identify the account
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+var ErrIdentityLinked = errors.New("identity is linked to another user")
+
+var gHandleInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+func identityKey(issuer, subject string) string {
+	return issuer + " " + subject
+}
+
+// UserByIdentity returns the user linked to an account at an identity
+// provider, ErrUserNotFound if there is none
+func (db *DB) UserByIdentity(issuer, subject string) (UserDTO, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	identity, ok := dbstruct.Identities[identityKey(issuer, subject)]
+	if !ok {
+		return UserDTO{}, ErrUserNotFound
+	}
+	user, ok := dbstruct.Users[identity.UserID]
+	if !ok {
+		return UserDTO{}, ErrUserNotFound
+	}
+
+	return NewUserDTO(user), nil
+}
+
+// LinkIdentity links an account at an identity provider to a user, so they
+// can log in with it
+func (db *DB) LinkIdentity(userID int, issuer, subject string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		key := identityKey(issuer, subject)
+		if identity, ok := dbstruct.Identities[key]; ok && identity.UserID != userID {
+			return ErrIdentityLinked
+		}
+
+		dbstruct.Identities[key] = Identity{
+			UserID:   userID,
+			Issuer:   issuer,
+			Subject:  subject,
+			LinkedAt: time.Now(),
+		}
+		return nil
+	})
+}
+
+// CreateUserWithIdentity creates a user for an account at an identity provider
+// and links the two. The handle is derived from handleHint, with a number
+// appended if it is taken. The user gets a random password, which they can
+// replace through a password reset.
+func (db *DB) CreateUserWithIdentity(email, handleHint string, emailVerified bool, issuer, subject string) (UserDTO, error) {
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return UserDTO{}, err
+	}
+	// bcrypt only looks at 72 bytes, but they need not be valid text
+	hashed, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	var newUser User
+	err = db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.userByEmail(email); ok {
+			return ErrEmailTaken
+		}
+		key := identityKey(issuer, subject)
+		if _, ok := dbstruct.Identities[key]; ok {
+			return ErrIdentityLinked
+		}
+
+		newUser = User{
+			Id:             dbstruct.nextUserID(),
+			Email:          email,
+			Handle:         dbstruct.freeHandle(handleHint),
+			HashedPassword: hashed,
+			EmailVerified:  emailVerified,
+		}
+		dbstruct.Users[newUser.Id] = newUser
+		dbstruct.Identities[key] = Identity{
+			UserID:   newUser.Id,
+			Issuer:   issuer,
+			Subject:  subject,
+			LinkedAt: time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	return NewUserDTO(newUser), nil
+}
+
+// a valid handle that is not taken, as close to hint as possible
+func (dbstruct *DBStruct) freeHandle(hint string) string {
+	base := gHandleInvalidChars.ReplaceAllString(hint, "_")
+	base = strings.Trim(base, "_")
+	// leave room for a number
+	if len(base) > 16 {
+		base = base[:16]
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+
+	handle := base
+	for n := 2; ; n++ {
+		if ValidateHandle(handle) == nil {
+			if _, taken := dbstruct.userByHandle(handle); !taken {
+				return handle
+			}
+		}
+		handle = base + strconv.Itoa(n)
+	}
+}
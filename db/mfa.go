@@ -0,0 +1,169 @@
+package db
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+)
+
+var (
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrNoPendingTOTP       = errors.New("no two-factor enrollment in progress")
+	ErrTOTPCodeReused      = errors.New("code was already used")
+	ErrInvalidRecoveryCode = errors.New("recovery code is invalid or already used")
+)
+
+// BeginTOTPEnrollment stores a new encrypted TOTP secret for the user, which
+// takes effect once confirmed with EnableTOTP. Starting over replaces the
+// previous pending secret. Returns ErrMFAAlreadyEnabled if the user already has
+// two-factor authentication.
+func (db *DB) BeginTOTPEnrollment(userID int, encryptedSecret []byte) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if user.TOTPSecret != nil {
+			return ErrMFAAlreadyEnabled
+		}
+
+		user.PendingTOTPSecret = encryptedSecret
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+}
+
+// EnableTOTP makes the pending TOTP secret the user's active one, after the
+// caller checked a code for it at step. recoveryCodes replace any previous
+// ones and are stored hashed.
+func (db *DB) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if user.PendingTOTPSecret == nil {
+			return ErrNoPendingTOTP
+		}
+
+		user.TOTPSecret = user.PendingTOTPSecret
+		user.PendingTOTPSecret = nil
+		user.TOTPLastStep = step
+		user.RecoveryCodes = make([]string, len(recoveryCodes))
+		for i, code := range recoveryCodes {
+			user.RecoveryCodes[i] = hashToken(code)
+		}
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+}
+
+// DisableTOTP turns two-factor authentication off and forgets the secret and
+// recovery codes.
+func (db *DB) DisableTOTP(userID int) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if user.TOTPSecret == nil {
+			return ErrMFANotEnabled
+		}
+
+		user.TOTPSecret = nil
+		user.PendingTOTPSecret = nil
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+}
+
+// UseTOTPStep records that a code for step was accepted. Returns
+// ErrTOTPCodeReused if a code for the same or a later step was accepted
+// before, so every code works only once.
+func (db *DB) UseTOTPStep(userID int, step int64) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if step <= user.TOTPLastStep {
+			return ErrTOTPCodeReused
+		}
+
+		user.TOTPLastStep = step
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+}
+
+// UseRecoveryCode checks a recovery code and removes it, so it works only
+// once. Returns ErrInvalidRecoveryCode if the user has no such code.
+func (db *DB) UseRecoveryCode(userID int, code string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		hash := hashToken(code)
+		for i, stored := range user.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+				dbstruct.Users[userID] = user
+				return nil
+			}
+		}
+
+		return ErrInvalidRecoveryCode
+	})
+}
+
+// CreateMFAChallenge issues a token that stands for a login whose password was
+// checked but that still needs a second factor, valid for ttl.
+func (db *DB) CreateMFAChallenge(userID int, ttl time.Duration) (string, error) {
+	var token string
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		var err error
+		token, err = dbstruct.issueToken(user, PurposeMFAChallenge, ttl)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ConsumeMFAChallenge returns the user a challenge token was issued to. The
+// token is used up whether the second factor the caller checks next is right
+// or not, so codes can't be guessed without entering the password again.
+// Returns ErrInvalidToken if the token is unknown, used or expired.
+func (db *DB) ConsumeMFAChallenge(token string) (*User, error) {
+	var user User
+	err := db.update(func(dbstruct *DBStruct) error {
+		tok, err := dbstruct.consumeToken(token, PurposeMFAChallenge)
+		if err != nil {
+			return err
+		}
+
+		user = dbstruct.Users[tok.UserID]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+type ReportReason string
+
+const (
+	ReportSpam           ReportReason = "spam"
+	ReportHarassment     ReportReason = "harassment"
+	ReportHate           ReportReason = "hate"
+	ReportViolence       ReportReason = "violence"
+	ReportSexual         ReportReason = "sexual"
+	ReportMisinformation ReportReason = "misinformation"
+	ReportOther          ReportReason = "other"
+)
+
+var ReportReasons = []ReportReason{
+	ReportSpam,
+	ReportHarassment,
+	ReportHate,
+	ReportViolence,
+	ReportSexual,
+	ReportMisinformation,
+	ReportOther,
+}
+
+// what a moderator decided to do with a reported chirp
+type ModerationAction string
+
+const (
+	ModerationApprove ModerationAction = "approve"
+	ModerationHide    ModerationAction = "hide"
+	ModerationDelete  ModerationAction = "delete"
+)
+
+var ErrUnknownModerationAction = errors.New("unknown moderation action")
+
+type Report struct {
+	Id         int              `json:"id"`
+	ChirpID    int              `json:"chirp_id"`
+	ReporterID int              `json:"reporter_id"`
+	Reason     ReportReason     `json:"reason"`
+	Comment    string           `json:"comment"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Resolution ModerationAction `json:"resolution,omitempty"`
+	ResolvedAt *time.Time       `json:"resolved_at,omitempty"`
+}
+
+// a chirp with open reports, as shown in the moderation queue
+type ModerationItem struct {
+	Chirp   Chirp    `json:"chirp"`
+	Reports []Report `json:"reports"`
+}
+
+func ValidReportReason(reason ReportReason) bool {
+	for _, r := range ReportReasons {
+		if r == reason {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReportChirp files a report against a chirp. Each user can only have one open
+// report per chirp, a second one returns ErrAlreadyReported. Once the chirp has
+// open reports from at least threshold users it is hidden until a moderator
+// reviews it; a threshold of 0 disables auto-hiding.
+//
+// Returns ErrChirpNotFound if the chirp doesn't exist.
+func (db *DB) ReportChirp(chirpID, reporterID int, reason ReportReason, comment string, threshold int) (*Report, error) {
+	var report Report
+	err := db.update(func(dbstruct *DBStruct) error {
+		chirp, ok := dbstruct.Chirps[chirpID]
+		if !ok {
+			return ErrChirpNotFound
+		}
+
+		open := 0
+		maxID := 0
+		for id, report := range dbstruct.Reports {
+			if id > maxID {
+				maxID = id
+			}
+			if report.ChirpID != chirpID || report.ResolvedAt != nil {
+				continue
+			}
+			if report.ReporterID == reporterID {
+				return ErrAlreadyReported
+			}
+			open++
+		}
+
+		report = Report{
+			Id:         maxID + 1,
+			ChirpID:    chirpID,
+			ReporterID: reporterID,
+			Reason:     reason,
+			Comment:    comment,
+			CreatedAt:  time.Now(),
+		}
+		dbstruct.Reports[report.Id] = report
+
+		if threshold > 0 && open+1 >= threshold {
+			chirp.Hidden = true
+			dbstruct.Chirps[chirpID] = chirp
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// GetModerationQueue returns every chirp that has open reports, oldest report
+// first.
+func (db *DB) GetModerationQueue() ([]ModerationItem, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	byChirp := map[int][]Report{}
+	for _, report := range dbstruct.Reports {
+		if report.ResolvedAt == nil {
+			byChirp[report.ChirpID] = append(byChirp[report.ChirpID], report)
+		}
+	}
+
+	queue := []ModerationItem{}
+	for chirpID, reports := range byChirp {
+		sort.Slice(reports, func(i, j int) bool { return reports[i].Id < reports[j].Id })
+		queue = append(queue, ModerationItem{dbstruct.Chirps[chirpID], reports})
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Reports[0].Id < queue[j].Reports[0].Id })
+
+	return queue, nil
+}
+
+// ModerateChirp applies a moderator's decision to a chirp and resolves all of
+// its open reports. Approving a chirp makes it visible again; deleting it
+// removes its reports along with it.
+//
+// Returns ErrChirpNotFound if the chirp doesn't exist.
+func (db *DB) ModerateChirp(chirpID int, action ModerationAction) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		chirp, ok := dbstruct.Chirps[chirpID]
+		if !ok {
+			return ErrChirpNotFound
+		}
+
+		switch action {
+		case ModerationApprove:
+			chirp.Hidden = false
+			dbstruct.Chirps[chirpID] = chirp
+		case ModerationHide:
+			chirp.Hidden = true
+			dbstruct.Chirps[chirpID] = chirp
+		case ModerationDelete:
+			dbstruct.removeChirp(chirpID)
+		default:
+			return ErrUnknownModerationAction
+		}
+
+		now := time.Now()
+		for id, report := range dbstruct.Reports {
+			if report.ChirpID == chirpID && report.ResolvedAt == nil {
+				report.Resolution = action
+				report.ResolvedAt = &now
+				dbstruct.Reports[id] = report
+			}
+		}
+
+		return nil
+	})
+}
+
+// SetUserSuspended suspends or reinstates a user. Returns ErrUserNotFound if
+// the user doesn't exist.
+func (db *DB) SetUserSuspended(userID int, suspended bool) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		user.Suspended = suspended
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OAuthClient is a third-party app users can sign into with their account.
+// Public clients, like single page and mobile apps, have no secret.
+type OAuthClient struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// SHA-256 hash of the secret, empty for public clients
+	SecretHash string    `json:"secret_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Consent records that a user allowed a client to use some scopes
+type Consent struct {
+	UserID    int       `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// AuthorizationCode is what a client exchanges for tokens. Only the SHA-256
+// hash of the code is stored, as the key of DBStruct.AuthorizationCodes.
+type AuthorizationCode struct {
+	UserID      int      `json:"user_id"`
+	ClientID    string   `json:"client_id"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scopes      []string `json:"scopes"`
+	// PKCE S256 challenge
+	CodeChallenge string    `json:"code_challenge"`
+	Nonce         string    `json:"nonce"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+var (
+	ErrClientNotFound = errors.New("OAuth client not found")
+	ErrInvalidClient  = errors.New("OAuth client authentication failed")
+)
+
+func (client OAuthClient) Public() bool {
+	return client.SecretHash == ""
+}
+
+func consentKey(userID int, clientID string) string {
+	return strconv.Itoa(userID) + ":" + clientID
+}
+
+// CreateOAuthClient registers a client and returns it with its secret in plain
+// text, which is empty for public clients
+func (db *DB) CreateOAuthClient(name string, redirectURIs []string, public bool) (OAuthClient, string, error) {
+	id, err := randomID()
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+	client := OAuthClient{
+		Id:           id,
+		Name:         name,
+		RedirectURIs: append([]string{}, redirectURIs...),
+		CreatedAt:    time.Now(),
+	}
+
+	secret := ""
+	if !public {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return OAuthClient{}, "", err
+		}
+		secret = hex.EncodeToString(raw)
+		client.SecretHash = hashToken(secret)
+	}
+
+	err = db.update(func(dbstruct *DBStruct) error {
+		dbstruct.OAuthClients[id] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+	return client, secret, nil
+}
+
+// OAuthClients returns all clients, oldest first
+func (db *DB) OAuthClients() ([]OAuthClient, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []OAuthClient{}
+	for _, client := range dbstruct.OAuthClients {
+		clients = append(clients, client)
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].CreatedAt.Before(clients[j].CreatedAt) })
+	return clients, nil
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, ok := dbstruct.OAuthClients[id]
+	if !ok {
+		return OAuthClient{}, ErrClientNotFound
+	}
+	return client, nil
+}
+
+// DeleteOAuthClient removes a client along with its consents and codes
+func (db *DB) DeleteOAuthClient(id string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.OAuthClients[id]; !ok {
+			return ErrClientNotFound
+		}
+		delete(dbstruct.OAuthClients, id)
+
+		for key, consent := range dbstruct.Consents {
+			if consent.ClientID == id {
+				delete(dbstruct.Consents, key)
+			}
+		}
+		for hash, code := range dbstruct.AuthorizationCodes {
+			if code.ClientID == id {
+				delete(dbstruct.AuthorizationCodes, hash)
+			}
+		}
+
+		return nil
+	})
+}
+
+// AuthenticateOAuthClient checks the secret of a client. Public clients have
+// to send no secret. Returns ErrInvalidClient if that fails.
+func (db *DB) AuthenticateOAuthClient(id, secret string) (OAuthClient, error) {
+	client, err := db.GetOAuthClient(id)
+	if err == ErrClientNotFound {
+		return OAuthClient{}, ErrInvalidClient
+	} else if err != nil {
+		return OAuthClient{}, err
+	}
+
+	if client.Public() {
+		if secret != "" {
+			return OAuthClient{}, ErrInvalidClient
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return OAuthClient{}, ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+// GrantConsent records that a user allows a client to use scopes, in addition
+// to the ones allowed before
+func (db *DB) GrantConsent(userID int, clientID string, scopes []string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		if _, ok := dbstruct.OAuthClients[clientID]; !ok {
+			return ErrClientNotFound
+		}
+
+		key := consentKey(userID, clientID)
+		consent := dbstruct.Consents[key]
+		merged := map[string]struct{}{}
+		for _, scope := range append(consent.Scopes, scopes...) {
+			merged[scope] = struct{}{}
+		}
+		consent = Consent{
+			UserID:    userID,
+			ClientID:  clientID,
+			Scopes:    []string{},
+			GrantedAt: time.Now(),
+		}
+		for scope := range merged {
+			consent.Scopes = append(consent.Scopes, scope)
+		}
+		sort.Strings(consent.Scopes)
+		dbstruct.Consents[key] = consent
+
+		return nil
+	})
+}
+
+// HasConsent reports whether a user allowed a client to use all of scopes
+func (db *DB) HasConsent(userID int, clientID string, scopes []string) (bool, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+
+	consent, ok := dbstruct.Consents[consentKey(userID, clientID)]
+	if !ok {
+		return false, nil
+	}
+	for _, scope := range scopes {
+		found := false
+		for _, granted := range consent.Scopes {
+			found = found || granted == scope
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Consents returns the consents a user gave, oldest first
+func (db *DB) Consents(userID int) ([]Consent, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	consents := []Consent{}
+	for _, consent := range dbstruct.Consents {
+		if consent.UserID == userID {
+			consents = append(consents, consent)
+		}
+	}
+
+	sort.Slice(consents, func(i, j int) bool { return consents[i].GrantedAt.Before(consents[j].GrantedAt) })
+	return consents, nil
+}
+
+// RevokeConsent forgets the consent a user gave a client, returns
+// ErrClientNotFound if there is none
+func (db *DB) RevokeConsent(userID int, clientID string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		key := consentKey(userID, clientID)
+		if _, ok := dbstruct.Consents[key]; !ok {
+			return ErrClientNotFound
+		}
+		delete(dbstruct.Consents, key)
+
+		return nil
+	})
+}
+
+// CreateAuthorizationCode stores code, which expires after ttl, and returns
+// it in plain text
+func (db *DB) CreateAuthorizationCode(code AuthorizationCode, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	plain := hex.EncodeToString(raw)
+
+	err := db.update(func(dbstruct *DBStruct) error {
+		now := time.Now()
+		for hash, other := range dbstruct.AuthorizationCodes {
+			if now.After(other.ExpiresAt) {
+				delete(dbstruct.AuthorizationCodes, hash)
+			}
+		}
+
+		code.ExpiresAt = now.Add(ttl)
+		dbstruct.AuthorizationCodes[hashToken(plain)] = code
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return plain, nil
+}
+
+// ConsumeAuthorizationCode returns a code and deletes it, so it can be used
+// only once. Returns ErrInvalidToken if it is unknown or expired.
+func (db *DB) ConsumeAuthorizationCode(plain string) (AuthorizationCode, error) {
+	hash := hashToken(plain)
+	var code AuthorizationCode
+	err := db.update(func(dbstruct *DBStruct) error {
+		var ok bool
+		code, ok = dbstruct.AuthorizationCodes[hash]
+		if !ok {
+			return ErrInvalidToken
+		}
+		delete(dbstruct.AuthorizationCodes, hash)
+		return nil
+	})
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	if time.Now().After(code.ExpiresAt) {
+		return AuthorizationCode{}, ErrInvalidToken
+	}
+	return code, nil
+}
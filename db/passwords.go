@@ -0,0 +1,63 @@
+package db
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CreatePasswordResetToken issues a token to reset the password of the user
+// with the given email, valid for ttl, and returns it together with the user.
+// Older reset tokens of the user stop working. Returns ErrUnregisteredEmail if
+// no user has that email.
+func (db *DB) CreatePasswordResetToken(email string, ttl time.Duration) (string, UserDTO, error) {
+	var token string
+	var user User
+	err := db.update(func(dbstruct *DBStruct) error {
+		var ok bool
+		user, ok = dbstruct.userByEmail(email)
+		if !ok {
+			return ErrUnregisteredEmail
+		}
+
+		var err error
+		token, err = dbstruct.issueToken(user, PurposeResetPassword, ttl)
+		return err
+	})
+	if err != nil {
+		return "", UserDTO{}, err
+	}
+
+	return token, NewUserDTO(user), nil
+}
+
+// ResetPassword sets a new password for the user a reset token was issued to.
+// All refresh tokens issued to the user so far are revoked. Since the token was
+// delivered by email, the email counts as verified afterwards.
+// Returns ErrInvalidToken if the token is unknown, used or expired.
+func (db *DB) ResetPassword(token, password string) (UserDTO, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	var user User
+	err = db.update(func(dbstruct *DBStruct) error {
+		tok, err := dbstruct.consumeToken(token, PurposeResetPassword)
+		if err != nil {
+			return err
+		}
+
+		user = dbstruct.Users[tok.UserID]
+		user.HashedPassword = hashed
+		user.EmailVerified = true
+		user.revokeTokensIssuedBefore(time.Now())
+		dbstruct.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	return NewUserDTO(user), nil
+}
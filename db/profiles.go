@@ -0,0 +1,184 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the public view of a user. Never includes the email address.
+type Profile struct {
+	Id          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	// file name of the avatar in the media directory, empty if none is set.
+	// Callers turn this into a URL.
+	Avatar         string `json:"-"`
+	FollowersCount int    `json:"followers_count"`
+	FollowingCount int    `json:"following_count"`
+}
+
+// changes to a profile, nil fields are left as they are
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+}
+
+func newProfile(dbstruct DBStruct, user User) Profile {
+	followers := 0
+	for _, following := range dbstruct.Follows {
+		if _, ok := following[user.Id]; ok {
+			followers++
+		}
+	}
+
+	return Profile{
+		Id:             user.Id,
+		Handle:         user.Handle,
+		DisplayName:    user.DisplayName,
+		Bio:            user.Bio,
+		IsChirpyRed:    user.IsChirpyRed,
+		Avatar:         user.Avatar,
+		FollowersCount: followers,
+		FollowingCount: len(dbstruct.Follows[user.Id]),
+	}
+}
+
+// GetProfile returns the public profile of a user, or ErrUserNotFound.
+func (db *DB) GetProfile(userID int) (*Profile, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := dbstruct.Users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	profile := newProfile(dbstruct, user)
+	return &profile, nil
+}
+
+// UpdateProfile applies the non-nil fields of update to a user's profile.
+// Returns ErrUserNotFound if the user doesn't exist.
+func (db *DB) UpdateProfile(userID int, update ProfileUpdate) (*Profile, error) {
+	var profile Profile
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		user.applyProfileUpdate(update)
+		dbstruct.Users[userID] = user
+
+		profile = newProfile(*dbstruct, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+func (user *User) applyProfileUpdate(update ProfileUpdate) {
+	if update.DisplayName != nil {
+		user.DisplayName = *update.DisplayName
+	}
+	if update.Bio != nil {
+		user.Bio = *update.Bio
+	}
+}
+
+// changes to a user's account and profile at once, nil fields are left as they
+// are
+type AccountUpdate struct {
+	UserUpdate
+	ProfileUpdate
+	Handle *string
+}
+
+type AccountUpdateResult struct {
+	Profile Profile
+	// the email changed and has to be verified again
+	EmailChanged bool
+	// with ErrHandleChangeTooSoon, the time the handle can be changed again
+	NextHandleChange time.Time
+}
+
+// UpdateAccount applies the non-nil fields of update to a user in a single
+// database update: either every change is made or, if one of them fails, none.
+// Fails like UpdateUser and ChangeHandle do.
+func (db *DB) UpdateAccount(userID int, update AccountUpdate, handleCooldown time.Duration) (AccountUpdateResult, error) {
+	if update.Handle != nil {
+		if err := ValidateHandle(*update.Handle); err != nil {
+			return AccountUpdateResult{}, err
+		}
+	}
+
+	var hashed []byte
+	if update.Password != nil {
+		var err error
+		hashed, err = bcrypt.GenerateFromPassword([]byte(*update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return AccountUpdateResult{}, err
+		}
+	}
+
+	var result AccountUpdateResult
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		oldEmail := user.Email
+
+		if update.Handle != nil {
+			next, err := dbstruct.applyHandleChange(&user, *update.Handle, handleCooldown)
+			if err != nil {
+				result.NextHandleChange = next
+				return err
+			}
+		}
+		if err := dbstruct.applyUserUpdate(&user, update.UserUpdate, hashed); err != nil {
+			return err
+		}
+		user.applyProfileUpdate(update.ProfileUpdate)
+		dbstruct.Users[userID] = user
+
+		result.Profile = newProfile(*dbstruct, user)
+		result.EmailChanged = !strings.EqualFold(oldEmail, user.Email)
+		return nil
+	})
+
+	return result, err
+}
+
+// SetAvatar sets the file name of a user's avatar and returns the previous one
+// so the caller can remove it. Returns ErrUserNotFound if the user doesn't
+// exist.
+func (db *DB) SetAvatar(userID int, avatar string) (string, error) {
+	var previous string
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		previous = user.Avatar
+		user.Avatar = avatar
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return previous, nil
+}
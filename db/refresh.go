@@ -0,0 +1,264 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Client describes the device a refresh token family was last used from
+type Client struct {
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+}
+
+// RefreshFamily is the chain of refresh tokens that started with one login,
+// users see it as a session. Every refresh replaces the family's current token
+// with a new one; showing an older token means it was copied, so the whole
+// family is revoked.
+type RefreshFamily struct {
+	Id     string `json:"id"`
+	UserID int    `json:"user_id"`
+	Client
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// jti of the only refresh token of the family that may be used
+	CurrentJTI string `json:"current_jti"`
+	// zero while the family is active
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+var ErrRefreshTokenReused = errors.New("refresh token was already used, the family is revoked")
+
+func randomID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Session is what users see of a RefreshFamily
+type Session struct {
+	Id string `json:"id"`
+	Client
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (family RefreshFamily) active(now time.Time) bool {
+	return family.RevokedAt.IsZero() && now.Before(family.ExpiresAt)
+}
+
+// CreateRefreshFamily starts a new family for a login from client and returns
+// its ID and the jti of its first refresh token, which expires at expiresAt.
+func (db *DB) CreateRefreshFamily(userID int, client Client, expiresAt time.Time) (string, string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+	jti, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+
+	err = db.update(func(dbstruct *DBStruct) error {
+		if _, ok := dbstruct.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+
+		now := time.Now()
+		for familyID, family := range dbstruct.RefreshFamilies {
+			if now.After(family.ExpiresAt) {
+				delete(dbstruct.RefreshFamilies, familyID)
+			}
+		}
+
+		dbstruct.RefreshFamilies[id] = RefreshFamily{
+			Id:         id,
+			UserID:     userID,
+			Client:     client,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ExpiresAt:  expiresAt,
+			CurrentJTI: jti,
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return id, jti, nil
+}
+
+// RotateRefreshToken uses up the refresh token jti of a user's family, sent by
+// client, and returns the jti of the token replacing it, which expires at
+// expiresAt.
+//
+// If jti is not the family's current token, the family is revoked and
+// ErrRefreshTokenReused is returned. Returns ErrTokenRevoked if the family is
+// unknown, revoked, expired or belongs to another user.
+func (db *DB) RotateRefreshToken(userID int, familyID, jti string, client Client, expiresAt time.Time) (string, error) {
+	newJTI, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	// checking and replacing the jti happen in one update, otherwise two
+	// requests with the same token could both get a successor
+	reused := false
+	err = db.update(func(dbstruct *DBStruct) error {
+		now := time.Now()
+		family, ok := dbstruct.RefreshFamilies[familyID]
+		if !ok || family.UserID != userID || !family.active(now) {
+			return ErrTokenRevoked
+		}
+
+		if family.CurrentJTI != jti {
+			family.RevokedAt = now
+			dbstruct.RefreshFamilies[familyID] = family
+			reused = true
+			return nil
+		}
+
+		family.CurrentJTI = newJTI
+		family.Client = client
+		family.LastUsedAt = now
+		family.ExpiresAt = expiresAt
+		dbstruct.RefreshFamilies[familyID] = family
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if reused {
+		return "", ErrRefreshTokenReused
+	}
+
+	return newJTI, nil
+}
+
+// CheckRefreshToken returns ErrTokenRevoked unless jti is the current refresh
+// token of an active family of the user. Unlike RotateRefreshToken it changes
+// nothing.
+func (db *DB) CheckRefreshToken(userID int, familyID, jti string) error {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	family, ok := dbstruct.RefreshFamilies[familyID]
+	if !ok || family.UserID != userID || !family.active(time.Now()) || family.CurrentJTI != jti {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// CheckSession returns ErrTokenRevoked unless familyID is an active refresh
+// token family of the user, i.e. a session that wasn't logged out.
+func (db *DB) CheckSession(userID int, familyID string) error {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	family, ok := dbstruct.RefreshFamilies[familyID]
+	if !ok || family.UserID != userID || !family.active(time.Now()) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// RevokeRefreshFamily revokes every refresh token of a family. Revoking a
+// family twice is not an error. Returns ErrTokenRevoked if the family is
+// unknown.
+func (db *DB) RevokeRefreshFamily(familyID string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		family, ok := dbstruct.RefreshFamilies[familyID]
+		if !ok {
+			return ErrTokenRevoked
+		}
+		if family.RevokedAt.IsZero() {
+			family.RevokedAt = time.Now()
+			dbstruct.RefreshFamilies[familyID] = family
+		}
+
+		return nil
+	})
+}
+
+// Sessions returns the active refresh token families of a user, the most
+// recently used first
+func (db *DB) Sessions(userID int) ([]Session, error) {
+	dbstruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := dbstruct.Users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, family := range dbstruct.RefreshFamilies {
+		// the current token was issued when the family was last used
+		if family.UserID != userID || !family.active(now) || family.LastUsedAt.Before(user.TokensValidAfter) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			Id:         family.Id,
+			Client:     family.Client,
+			CreatedAt:  family.CreatedAt,
+			LastUsedAt: family.LastUsedAt,
+			ExpiresAt:  family.ExpiresAt,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// RevokeSession revokes a refresh token family of a user. Returns ErrTokenRevoked
+// if the user has no such active family.
+func (db *DB) RevokeSession(userID int, familyID string) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		family, ok := dbstruct.RefreshFamilies[familyID]
+		if !ok || family.UserID != userID || !family.active(time.Now()) {
+			return ErrTokenRevoked
+		}
+		family.RevokedAt = time.Now()
+		dbstruct.RefreshFamilies[familyID] = family
+
+		return nil
+	})
+}
+
+// RevokeAllSessions revokes every refresh token of a user, including those
+// that predate refresh token families
+func (db *DB) RevokeAllSessions(userID int) error {
+	return db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		now := time.Now()
+		for id, family := range dbstruct.RefreshFamilies {
+			if family.UserID == userID && family.RevokedAt.IsZero() {
+				family.RevokedAt = now
+				dbstruct.RefreshFamilies[id] = family
+			}
+		}
+		user.revokeTokensIssuedBefore(now)
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+}
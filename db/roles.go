@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// what a user may do besides using their own account. Each role may do
+// everything the ones before it may.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var Roles = []Role{RoleUser, RoleModerator, RoleAdmin}
+
+var (
+	ErrUnknownRole = errors.New("unknown role")
+	ErrLastAdmin   = errors.New("the last admin can't be demoted or deleted")
+	ErrAdminExists = errors.New("there already is an admin")
+)
+
+func ValidRole(role Role) bool {
+	return role.rank() >= 0
+}
+
+func (role Role) rank() int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// AtLeast reports whether role may do everything other may
+func (role Role) AtLeast(other Role) bool {
+	return ValidRole(role) && role.rank() >= other.rank()
+}
+
+// EffectiveRole returns the role of user. Users stored before there were roles
+// have none, they are plain users.
+func (user *User) EffectiveRole() Role {
+	if user.Role == "" {
+		return RoleUser
+	}
+	return user.Role
+}
+
+// SetUserRole changes the role of a user. Returns ErrLastAdmin if that would
+// leave no admin.
+func (db *DB) SetUserRole(userID int, role Role) (UserDTO, error) {
+	if !ValidRole(role) {
+		return UserDTO{}, ErrUnknownRole
+	}
+
+	var user User
+	err := db.update(func(dbstruct *DBStruct) error {
+		var ok bool
+		user, ok = dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if user.EffectiveRole() == RoleAdmin && role != RoleAdmin && dbstruct.countAdmins() == 1 {
+			return ErrLastAdmin
+		}
+
+		user.Role = role
+		dbstruct.Users[userID] = user
+
+		return nil
+	})
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	return NewUserDTO(user), nil
+}
+
+// CreateFirstAdmin creates an admin account while there is none, e.g. right
+// after setting up the server. The email counts as verified. Returns
+// ErrAdminExists once there is an admin, who can then hand out roles.
+func (db *DB) CreateFirstAdmin(email, handle, password string) (UserDTO, error) {
+	if err := ValidateHandle(handle); err != nil {
+		return UserDTO{}, err
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	var newUser User
+	err = db.update(func(dbstruct *DBStruct) error {
+		if dbstruct.countAdmins() > 0 {
+			return ErrAdminExists
+		}
+		if _, ok := dbstruct.userByEmail(email); ok {
+			return ErrEmailTaken
+		}
+		if _, ok := dbstruct.userByHandle(handle); ok {
+			return ErrHandleTaken
+		}
+
+		newUser = User{
+			Id:             dbstruct.nextUserID(),
+			Email:          email,
+			Handle:         handle,
+			HashedPassword: hashed,
+			EmailVerified:  true,
+			Role:           RoleAdmin,
+		}
+		dbstruct.Users[newUser.Id] = newUser
+
+		return nil
+	})
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	return NewUserDTO(newUser), nil
+}
+
+func (dbstruct *DBStruct) countAdmins() int {
+	count := 0
+	for _, user := range dbstruct.Users {
+		if user.EffectiveRole() == RoleAdmin {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// what a one-time token can be used for
+type TokenPurpose string
+
+const (
+	PurposeVerifyEmail   TokenPurpose = "verify_email"
+	PurposeResetPassword TokenPurpose = "reset_password"
+	PurposeMFAChallenge  TokenPurpose = "mfa_challenge"
+)
+
+// OneTimeToken is a token sent to a user by email. Only the SHA-256 hash of
+// the token is stored, as the key of DBStruct.OneTimeTokens.
+type OneTimeToken struct {
+	UserID  int          `json:"user_id"`
+	Purpose TokenPurpose `json:"purpose"`
+	// the address the token was sent to
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var ErrInvalidToken = errors.New("token is invalid or expired")
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issues a new token for the user and purpose, replacing the ones issued
+// before, and returns it in plain text
+func (dbstruct *DBStruct) issueToken(user User, purpose TokenPurpose, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	now := time.Now()
+	for hash, tok := range dbstruct.OneTimeTokens {
+		if (tok.UserID == user.Id && tok.Purpose == purpose) || now.After(tok.ExpiresAt) {
+			delete(dbstruct.OneTimeTokens, hash)
+		}
+	}
+
+	dbstruct.OneTimeTokens[hashToken(token)] = OneTimeToken{
+		UserID:    user.Id,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	return token, nil
+}
+
+// removes the token and returns it if it is valid for purpose. Tokens sent to
+// an address the user no longer has are not valid. Expired tokens are left for
+// issueToken to clean up.
+func (dbstruct *DBStruct) consumeToken(token string, purpose TokenPurpose) (OneTimeToken, error) {
+	hash := hashToken(token)
+	tok, ok := dbstruct.OneTimeTokens[hash]
+	if !ok || tok.Purpose != purpose || time.Now().After(tok.ExpiresAt) {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+
+	user, ok := dbstruct.Users[tok.UserID]
+	if !ok || !strings.EqualFold(user.Email, tok.Email) {
+		return OneTimeToken{}, ErrInvalidToken
+	}
+
+	delete(dbstruct.OneTimeTokens, hash)
+	return tok, nil
+}
+
+// CreateVerificationToken issues a token that verifies the user's current
+// email address, valid for ttl. Older verification tokens of the user stop
+// working. Returns ErrUserNotFound if the user doesn't exist.
+func (db *DB) CreateVerificationToken(userID int, ttl time.Duration) (string, error) {
+	var token string
+	err := db.update(func(dbstruct *DBStruct) error {
+		user, ok := dbstruct.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		var err error
+		token, err = dbstruct.issueToken(user, PurposeVerifyEmail, ttl)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// VerifyEmail marks the email of the token's user as verified and returns the
+// user. Each token works only once. Returns ErrInvalidToken if the token is
+// unknown, expired or was sent to an address the user has changed since.
+func (db *DB) VerifyEmail(token string) (UserDTO, error) {
+	var user User
+	err := db.update(func(dbstruct *DBStruct) error {
+		tok, err := dbstruct.consumeToken(token, PurposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+
+		user = dbstruct.Users[tok.UserID]
+		user.EmailVerified = true
+		dbstruct.Users[user.Id] = user
+
+		return nil
+	})
+	if err != nil {
+		return UserDTO{}, err
+	}
+
+	return NewUserDTO(user), nil
+}
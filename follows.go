@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	db "github.com/horriblename/go-web-server/db"
+)
+
+const (
+	gDefaultTimelineLimit = 20
+	gMaxTimelineLimit     = 100
+)
+
+type TimelineResponse struct {
+	Chirps []db.Chirp `json:"chirps"`
+	// pass as `before` to get the next page, omitted on the last page
+	NextBefore int `json:"next_before,omitempty"`
+}
+
+func (cfg *apiConfig) handlePostFollow(w http.ResponseWriter, req *http.Request) {
+	followerID := principalFrom(req).UserID
+
+	followeeID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	err := cfg.db.Follow(followerID, followeeID)
+	if err == db.ErrFollowSelf {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Can't follow yourself"})
+		return
+	} else if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("following user %d: %s\n", followeeID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+func (cfg *apiConfig) handleDeleteFollow(w http.ResponseWriter, req *http.Request) {
+	followerID := principalFrom(req).UserID
+
+	followeeID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if err := cfg.db.Unfollow(followerID, followeeID); err != nil {
+		fmt.Printf("unfollowing user %d: %s\n", followeeID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+func (cfg *apiConfig) handleGetFollowers(w http.ResponseWriter, req *http.Request) {
+	cfg.respondWithFollows(w, req, cfg.db.GetFollowers)
+}
+
+func (cfg *apiConfig) handleGetFollowing(w http.ResponseWriter, req *http.Request) {
+	cfg.respondWithFollows(w, req, cfg.db.GetFollowing)
+}
+
+func (cfg *apiConfig) respondWithFollows(w http.ResponseWriter, req *http.Request, get func(int) ([]db.Follow, error)) {
+	userID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	follows, err := get(userID)
+	if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("getting follows of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, follows)
+}
+
+// GET /api/timeline?limit=20&before=<chirpID>
+//
+// chirps by everyone the caller follows, newest first
+func (cfg *apiConfig) handleGetTimeline(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var err error
+	limit := gDefaultTimelineLimit
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > gMaxTimelineLimit {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{
+				Error: fmt.Sprintf("limit must be between 1 and %d", gMaxTimelineLimit),
+			})
+			return
+		}
+	}
+
+	before := 0
+	if beforeStr := req.URL.Query().Get("before"); beforeStr != "" {
+		before, err = strconv.Atoi(beforeStr)
+		if err != nil || before < 1 {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "before must be a chirp ID"})
+			return
+		}
+	}
+
+	chirps, err := cfg.db.GetTimeline(userID, before, limit)
+	if err != nil {
+		fmt.Printf("getting timeline of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	resp := TimelineResponse{Chirps: chirps}
+	if len(chirps) == limit {
+		resp.NextBefore = chirps[len(chirps)-1].Id
+	}
+
+	expand := expandSensitive(req)
+	for i := range resp.Chirps {
+		resp.Chirps[i] = hideSensitive(resp.Chirps[i], expand)
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
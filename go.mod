@@ -8,3 +8,5 @@ require (
 	github.com/joho/godotenv v1.5.1
 	golang.org/x/crypto v0.11.0
 )
+
+require golang.org/x/text v0.13.0
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/horriblename/go-web-server/db"
+)
+
+// token types in introspection responses
+const (
+	tokenTypeAccess  = "access_token"
+	tokenTypeRefresh = "refresh_token"
+	tokenTypeAPIKey  = "api_key"
+)
+
+// IntrospectionResponse tells whether a token is active, RFC 7662 section
+// 2.2. Inactive tokens only get Active.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	TokenType string `json:"token_type,omitempty"`
+	// empty for our own tokens, which may do everything
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Subject  string `json:"sub,omitempty"`
+	Username string `json:"username,omitempty"`
+	Issuer   string `json:"iss,omitempty"`
+	// seconds since the epoch, expiry is missing for API keys
+	ExpiresAt int64 `json:"exp,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+}
+
+type PostRevokeUserTokensParameters struct {
+	// tokens issued before are revoked, now if empty
+	Before time.Time `json:"before"`
+}
+
+type RevokeUserTokensResponse struct {
+	TokensValidAfter time.Time `json:"tokens_valid_after"`
+}
+
+func (cfg *apiConfig) middlewareIntrospectionAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if cfg.introspectionApiKey == "" || req.Header.Get("Authorization") != "ApiKey "+cfg.introspectionApiKey {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// POST /api/introspect
+//
+// tells other services whether a token is active, RFC 7662. The token is sent
+// form encoded as token; token_type_hint is not needed, the token's type is
+// recognized.
+func (cfg *apiConfig) handlePostIntrospect(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil || req.PostForm.Get("token") == "" {
+		respondWithJSON(w, http.StatusBadRequest, OAuthError{oauthInvalidRequest, "token is required"})
+		return
+	}
+
+	resp, err := cfg.introspect(req.PostForm.Get("token"))
+	if err != nil {
+		fmt.Printf("introspecting token: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// what is known about tokStr. Errors are only returned if that can't be found
+// out, tokens that are invalid for any reason are inactive.
+func (cfg *apiConfig) introspect(tokStr string) (IntrospectionResponse, error) {
+	inactive := IntrospectionResponse{}
+
+	if strings.HasPrefix(tokStr, "chirpy_") {
+		key, err := cfg.db.AuthenticateAPIKey(tokStr)
+		if err == db.ErrInvalidAPIKey {
+			return inactive, nil
+		} else if err != nil {
+			return inactive, err
+		}
+		user, err := cfg.db.GetUser(key.UserID)
+		if err == db.ErrUserNotFound {
+			return inactive, nil
+		} else if err != nil {
+			return inactive, err
+		}
+
+		return IntrospectionResponse{
+			Active:    true,
+			TokenType: tokenTypeAPIKey,
+			Scope:     strings.Join(key.Scopes, " "),
+			Subject:   strconv.Itoa(user.Id),
+			Username:  user.Handle,
+			IssuedAt:  key.CreatedAt.Unix(),
+		}, nil
+	}
+
+	// refresh tokens are the only ones on the old revocation list, but nothing
+	// revoked should look active
+	if err := cfg.db.CheckTokenRevocation(tokStr); err == db.ErrTokenRevoked {
+		return inactive, nil
+	} else if err != nil {
+		return inactive, err
+	}
+
+	tokenType := tokenTypeAccess
+	claims, err := parseToken(tokStr, cfg.jwtKeys, gAccessTokIssuer)
+	if errors.Is(err, ErrWrongIssuer) {
+		tokenType = tokenTypeRefresh
+		claims, err = parseToken(tokStr, cfg.jwtKeys, gRefreshTokIssuer)
+	}
+	if err != nil {
+		return inactive, nil
+	}
+
+	user, err := cfg.tokenUser(claims)
+	if errors.Is(err, ErrUnauthorizedToken) || errors.Is(err, ErrMalformedToken) || err == db.ErrUserNotFound {
+		return inactive, nil
+	} else if err != nil {
+		return inactive, err
+	}
+
+	// only the latest refresh token of an active family can be used
+	if tokenType == tokenTypeRefresh && claims.Family != "" {
+		err := cfg.db.CheckRefreshToken(user.Id, claims.Family, claims.ID)
+		if err == db.ErrTokenRevoked {
+			return inactive, nil
+		} else if err != nil {
+			return inactive, err
+		}
+	}
+
+	resp := IntrospectionResponse{
+		Active:    true,
+		TokenType: tokenType,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Subject:   claims.Subject,
+		Username:  user.Handle,
+		Issuer:    claims.Issuer,
+		IssuedAt:  claims.IssuedAt.Unix(),
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	return resp, nil
+}
+
+// POST /admin/users/{userID}/revoke-tokens
+//
+// revokes every token issued to the user before the given time: access and
+// refresh tokens, also those of apps they signed in to. API keys are left
+// alone, they are revoked one by one.
+func (cfg *apiConfig) handlePostRevokeUserTokens(w http.ResponseWriter, req *http.Request) {
+	userID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	var params PostRevokeUserTokensParameters
+	if req.ContentLength != 0 {
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&params); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+			return
+		}
+	}
+
+	validAfter, err := cfg.db.RevokeTokensIssuedBefore(userID, params.Before)
+	if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("revoking tokens of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, RevokeUserTokensResponse{validAfter})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwtKey is an asymmetric key tokens are signed or verified with
+type jwtKey struct {
+	// the kid header of tokens signed with it, the key's RFC 7638 thumbprint
+	id     string
+	method jwt.SigningMethod
+	// nil for keys that only verify
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// jwtKeySet holds the keys tokens are signed and verified with.
+//
+// Without a signing key tokens are signed with the HS256 secret. Tokens
+// without a kid header are checked against the secret. After switching to a key
+// pair they are only accepted until secretUntil, so tokens signed before the
+// switch can keep working until they expire, but the secret is retired in the
+// end. Retired keys stay in the set as verification keys until all their tokens
+// expired.
+type jwtKeySet struct {
+	secret []byte
+	// nil to sign with secret
+	signing *jwtKey
+	// with a signing key, tokens signed with secret are rejected from then on
+	secretUntil time.Time
+	// kid -> key
+	keys map[string]*jwtKey
+	now  func() time.Time
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 and, for identity providers' keys, EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// newJWTKeySet creates a key set signing with the private key in the PEM file
+// signingKeyPath, or with secret if it is empty, and additionally accepting
+// tokens signed by the keys in verificationKeyPaths. With a signing key, tokens
+// signed with secret are accepted until secretUntil, never if it is zero.
+func newJWTKeySet(secret []byte, signingKeyPath string, verificationKeyPaths []string, secretUntil time.Time) (*jwtKeySet, error) {
+	keys := jwtKeySet{
+		secret:      secret,
+		secretUntil: secretUntil,
+		keys:        map[string]*jwtKey{},
+		now:         time.Now,
+	}
+
+	if signingKeyPath != "" {
+		key, err := loadJWTKey(signingKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyPath)
+		}
+		keys.signing = key
+		keys.keys[key.id] = key
+	}
+
+	for _, path := range verificationKeyPaths {
+		key, err := loadJWTKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keys.keys[key.id]; !ok {
+			// only the public half is ever used
+			key.private = nil
+			keys.keys[key.id] = key
+		}
+	}
+
+	return &keys, nil
+}
+
+// loadJWTKey reads an RSA or Ed25519 key from a PEM file. Private keys may be
+// PKCS #8 or PKCS #1, public keys PKIX.
+func loadJWTKey(path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWT key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: parsing key: %w", path, err)
+	}
+
+	key := jwtKey{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		key.public = signer.Public()
+	} else {
+		key.public = parsed
+	}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%s: RSA keys must have at least 2048 bits", path)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T, use RSA or Ed25519", path, key.public)
+	}
+	key.id = thumbprint(key.publicJWK())
+
+	return &key, nil
+}
+
+// publicJWK returns the public half of key, without kid
+func (key *jwtKey) publicJWK() JWK {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}
+	}
+	return JWK{}
+}
+
+// the RFC 7638 thumbprint of a public JWK
+func thumbprint(jwk JWK) string {
+	// only the required members, in lexicographic order
+	var canonical string
+	switch jwk.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Crv, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sign signs claims with the signing key, or with the secret if there is none
+func (keys *jwtKeySet) Sign(claims jwt.Claims) (string, error) {
+	if keys.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(keys.secret)
+	}
+
+	token := jwt.NewWithClaims(keys.signing.method, claims)
+	token.Header["kid"] = keys.signing.id
+	return token.SignedString(keys.signing.private)
+}
+
+// Keyfunc picks the key a token is verified with by its kid header, for
+// jwt.Parse. The token's algorithm has to be the one of the key.
+func (keys *jwtKeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"]
+	if !ok {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("%w: %s token without kid", ErrUnknownKey, token.Method.Alg())
+		}
+		if keys.signing != nil && !keys.now().Before(keys.secretUntil) {
+			return nil, fmt.Errorf("%w: the JWT secret was retired", ErrUnknownKey)
+		}
+		return keys.secret, nil
+	}
+
+	kidStr, _ := kid.(string)
+	key, ok := keys.keys[kidStr]
+	if !ok {
+		return nil, fmt.Errorf("%w: kid %v", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("%w: %s token for %s key", ErrUnknownKey, token.Method.Alg(), key.method.Alg())
+	}
+
+	return key.public, nil
+}
+
+// JWKS returns the public keys tokens may be signed with, sorted by kid. The
+// HS256 secret is never published.
+func (keys *jwtKeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range keys.keys {
+		jwk := key.publicJWK()
+		jwk.Kid = key.id
+		jwk.Use = "sig"
+		jwk.Alg = key.method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// GET /.well-known/jwks.json
+func (cfg *apiConfig) handleGetJWKS(w http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(cfg.jwtKeys.JWKS())
+	if err != nil {
+		fmt.Printf("encoding JWKS: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// writes key to a PEM file in dir, the public half if public is set
+func writePEMKey(t *testing.T, dir, name string, key any, public bool) string {
+	var block pem.Block
+	var err error
+	if public {
+		block.Type = "PUBLIC KEY"
+		block.Bytes, err = x509.MarshalPKIXPublicKey(key)
+	} else {
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatalf("encoding %s: %s", name, err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&block), 0600); err != nil {
+		t.Fatalf("writing %s: %s", name, err)
+	}
+	return path
+}
+
+func testClaims() jwt.Claims {
+	return jwt.RegisteredClaims{
+		Issuer:    gAccessTokIssuer,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+func parseWith(keys *jwtKeySet, tokStr string) error {
+	_, err := jwt.ParseWithClaims(tokStr, &chirpyClaims{}, keys.Keyfunc)
+	return err
+}
+
+func TestJWTKeySet(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("testsecret")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %s", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating Ed25519 key: %s", err)
+	}
+	rsaPath := writePEMKey(t, dir, "rsa.pem", rsaKey, false)
+	rsaPubPath := writePEMKey(t, dir, "rsa.pub.pem", &rsaKey.PublicKey, true)
+	edPath := writePEMKey(t, dir, "ed25519.pem", edKey, false)
+
+	// HS256 by default, nothing is published
+	hmacKeys, err := newJWTKeySet(secret, "", nil, time.Time{})
+	if err != nil {
+		t.Fatalf("creating HS256 key set: %s", err)
+	}
+	legacyTok, err := hmacKeys.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing with HS256: %s", err)
+	}
+	if err := parseWith(hmacKeys, legacyTok); err != nil {
+		t.Errorf("expected HS256 token to verify, got %s", err)
+	}
+	if jwks := hmacKeys.JWKS(); len(jwks.Keys) != 0 {
+		t.Errorf("expected no public keys, got %+v", jwks)
+	}
+
+	// first RSA
+	secretUntil := time.Now().Add(time.Hour)
+	rsaKeys, err := newJWTKeySet(secret, rsaPath, nil, secretUntil)
+	if err != nil {
+		t.Fatalf("creating RS256 key set: %s", err)
+	}
+	rsaTok, err := rsaKeys.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing with RS256: %s", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(rsaTok, &chirpyClaims{})
+	if err != nil || token.Header["kid"] != rsaKeys.signing.id || token.Method != jwt.SigningMethodRS256 {
+		t.Errorf("expected RS256 token with kid %s, got %v (%v)", rsaKeys.signing.id, token.Header, err)
+	}
+	if err := parseWith(rsaKeys, rsaTok); err != nil {
+		t.Errorf("expected RS256 token to verify, got %s", err)
+	}
+	if err := parseWith(rsaKeys, legacyTok); err != nil {
+		t.Errorf("expected tokens signed before the switch to verify, got %s", err)
+	}
+	// but only until the secret is retired
+	rsaKeys.now = func() time.Time { return secretUntil }
+	if err := parseWith(rsaKeys, legacyTok); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected tokens signed with the secret to be rejected after it was retired, got %v", err)
+	}
+	rsaKeys.now = time.Now
+	if noSecretKeys, err := newJWTKeySet(secret, rsaPath, nil, time.Time{}); err != nil {
+		t.Fatalf("creating RS256 key set: %s", err)
+	} else if err := parseWith(noSecretKeys, legacyTok); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected tokens signed with the secret to be rejected without a cutoff, got %v", err)
+	}
+	if err := parseWith(hmacKeys, rsaTok); err == nil {
+		t.Errorf("expected RS256 token to not verify without its key")
+	}
+
+	// then rotate to Ed25519, keeping the RSA key for verification
+	edKeys, err := newJWTKeySet(secret, edPath, []string{rsaPubPath}, secretUntil)
+	if err != nil {
+		t.Fatalf("creating EdDSA key set: %s", err)
+	}
+	edTok, err := edKeys.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing with EdDSA: %s", err)
+	}
+	for name, tokStr := range map[string]string{"EdDSA": edTok, "RS256": rsaTok, "HS256": legacyTok} {
+		if err := parseWith(edKeys, tokStr); err != nil {
+			t.Errorf("expected %s token to verify after rotation, got %s", name, err)
+		}
+	}
+	if err := parseWith(rsaKeys, edTok); err == nil {
+		t.Errorf("expected EdDSA token to not verify with an unknown kid")
+	}
+
+	jwks := edKeys.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected 2 public keys, got %+v", jwks)
+	}
+	for _, jwk := range jwks.Keys {
+		switch jwk.Kid {
+		case edKeys.signing.id:
+			if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.Alg != "EdDSA" || jwk.X == "" {
+				t.Errorf("unexpected Ed25519 JWK %+v", jwk)
+			}
+		case rsaKeys.signing.id:
+			if jwk.Kty != "RSA" || jwk.Alg != "RS256" || jwk.N == "" || jwk.E != "AQAB" {
+				t.Errorf("unexpected RSA JWK %+v", jwk)
+			}
+		default:
+			t.Errorf("unexpected kid %s", jwk.Kid)
+		}
+	}
+
+	// a token may not pick another algorithm than the one of its key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	forged.Header["kid"] = rsaKeys.signing.id
+	forgedStr, err := forged.SignedString(secret)
+	if err != nil {
+		t.Fatalf("signing forged token: %s", err)
+	}
+	if err := parseWith(edKeys, forgedStr); err == nil {
+		t.Errorf("expected HS256 token with the kid of an RSA key to be rejected")
+	}
+
+	if _, err := newJWTKeySet(secret, rsaPubPath, nil, time.Time{}); err == nil {
+		t.Errorf("expected a public key to be rejected as signing key")
+	}
+}
+
+// RFC 7638 section 3.1
+func TestThumbprint(t *testing.T) {
+	jwk := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	if got, expect := thumbprint(jwk), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != expect {
+		t.Errorf("thumbprint = %s, expected %s", got, expect)
+	}
+}
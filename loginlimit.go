@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	gDefaultAccountFreeFailures = 5
+	gDefaultIPFreeFailures      = 20
+	gLoginBackoffBase           = 1 * time.Second
+	gLoginBackoffMax            = 15 * time.Minute
+	// failures are forgotten once there was none for this long
+	gLoginFailureWindow = 1 * time.Hour
+)
+
+// kinds of lockouts
+const (
+	lockoutAccount = "account"
+	lockoutIP      = "ip"
+)
+
+type Lockout struct {
+	Type        string    `json:"type"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter slows down password guessing. Failed logins are counted per
+// account and per client IP; after a number of free failures each further one
+// locks the account or IP out for twice as long as the one before, up to
+// gLoginBackoffMax. The counts are kept in memory only.
+type loginLimiter struct {
+	lock                *sync.Mutex
+	accountFreeFailures int
+	ipFreeFailures      int
+	accounts            map[string]*loginFailures
+	ips                 map[string]*loginFailures
+	lastSweep           time.Time
+	now                 func() time.Time
+}
+
+// newLoginLimiter creates a loginLimiter, 0 selects the default number of free
+// failures
+func newLoginLimiter(accountFreeFailures, ipFreeFailures int) *loginLimiter {
+	if accountFreeFailures <= 0 {
+		accountFreeFailures = gDefaultAccountFreeFailures
+	}
+	if ipFreeFailures <= 0 {
+		ipFreeFailures = gDefaultIPFreeFailures
+	}
+
+	return &loginLimiter{
+		lock:                &sync.Mutex{},
+		accountFreeFailures: accountFreeFailures,
+		ipFreeFailures:      ipFreeFailures,
+		accounts:            map[string]*loginFailures{},
+		ips:                 map[string]*loginFailures{},
+		now:                 time.Now,
+	}
+}
+
+// the key failures against a registered user are counted under. Logins that
+// don't belong to anyone are counted under the login itself, so they behave
+// the same.
+func accountKey(userID int, login string) string {
+	if userID > 0 {
+		return "user:" + strconv.Itoa(userID)
+	}
+	return "login:" + strings.ToLower(login)
+}
+
+// the IP address of the client, without the port
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func backoff(failures, free int) time.Duration {
+	over := failures - free
+	if over <= 0 {
+		return 0
+	}
+	if over > 30 {
+		return gLoginBackoffMax
+	}
+
+	delay := gLoginBackoffBase * time.Duration(math.Pow(2, float64(over-1)))
+	if delay > gLoginBackoffMax {
+		return gLoginBackoffMax
+	}
+	return delay
+}
+
+// Blocked returns how long the account and IP have to wait before trying
+// again, 0 if they may try now.
+func (l *loginLimiter) Blocked(account, ip string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	wait := time.Duration(0)
+	for _, failures := range []*loginFailures{l.accounts[account], l.ips[ip]} {
+		if failures != nil && failures.lockedUntil.After(now) && failures.lockedUntil.Sub(now) > wait {
+			wait = failures.lockedUntil.Sub(now)
+		}
+	}
+
+	return wait
+}
+
+// Failure records a failed login for account from ip
+func (l *loginLimiter) Failure(account, ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	record := func(table map[string]*loginFailures, key string, free int) {
+		failures, ok := table[key]
+		if !ok || now.Sub(failures.last) > gLoginFailureWindow {
+			failures = &loginFailures{}
+			table[key] = failures
+		}
+		failures.count++
+		failures.last = now
+		if delay := backoff(failures.count, free); delay > 0 {
+			failures.lockedUntil = now.Add(delay)
+		}
+	}
+
+	record(l.accounts, account, l.accountFreeFailures)
+	record(l.ips, ip, l.ipFreeFailures)
+}
+
+// Success forgets the failures of account. Those of the IP are kept, so
+// logging into an account of one's own doesn't allow guessing more passwords
+// of others.
+func (l *loginLimiter) Success(account string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.accounts, account)
+}
+
+// UnlockAccount forgets the failures of account, returns false if there were none
+func (l *loginLimiter) UnlockAccount(account string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, ok := l.accounts[account]
+	delete(l.accounts, account)
+	return ok
+}
+
+// UnlockIP forgets the failures of ip, returns false if there were none
+func (l *loginLimiter) UnlockIP(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, ok := l.ips[ip]
+	delete(l.ips, ip)
+	return ok
+}
+
+// Lockouts returns the accounts and IPs that are currently locked out
+func (l *loginLimiter) Lockouts() []Lockout {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	lockouts := []Lockout{}
+	collect := func(kind string, table map[string]*loginFailures) {
+		for key, failures := range table {
+			if failures.lockedUntil.After(now) {
+				lockouts = append(lockouts, Lockout{kind, key, failures.count, failures.lockedUntil})
+			}
+		}
+	}
+	collect(lockoutAccount, l.accounts)
+	collect(lockoutIP, l.ips)
+
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].LockedUntil.Before(lockouts[j].LockedUntil) })
+	return lockouts
+}
+
+// drops failures that are too old to matter, at most once per window
+func (l *loginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < gLoginFailureWindow {
+		return
+	}
+	l.lastSweep = now
+
+	for _, table := range []map[string]*loginFailures{l.accounts, l.ips} {
+		for key, failures := range table {
+			if now.Sub(failures.last) > gLoginFailureWindow && !failures.lockedUntil.After(now) {
+				delete(table, key)
+			}
+		}
+	}
+}
+
+// answers a login attempt that has to wait
+func respondLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithJSON(w, http.StatusTooManyRequests, genericErrorMsg{Error: "Too many failed logins, try again later"})
+}
+
+// GET /admin/lockouts
+func (cfg *apiConfig) handleGetLockouts(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, cfg.loginLimiter.Lockouts())
+}
+
+// DELETE /admin/lockouts/users/{userID}
+func (cfg *apiConfig) handleDeleteUserLockout(w http.ResponseWriter, req *http.Request) {
+	userID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if !cfg.loginLimiter.UnlockAccount(accountKey(userID, "")) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// DELETE /admin/lockouts/ips/{ip}
+func (cfg *apiConfig) handleDeleteIPLockout(w http.ResponseWriter, req *http.Request) {
+	ip := chi.URLParam(req, "ip")
+	if net.ParseIP(ip) == nil {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: fmt.Sprintf("%q is not an IP address", ip)})
+		return
+	}
+
+	if !cfg.loginLimiter.UnlockIP(ip) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
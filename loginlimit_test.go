@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newLoginLimiter(3, 5)
+	limiter.now = func() time.Time { return now }
+
+	account := accountKey(1, "user@example.com")
+	for i := 0; i < 3; i++ {
+		if wait := limiter.Blocked(account, "10.0.0.1"); wait != 0 {
+			t.Fatalf("expected free failure %d to not block, got %s", i+1, wait)
+		}
+		limiter.Failure(account, "10.0.0.1")
+	}
+	if wait := limiter.Blocked(account, "10.0.0.1"); wait != 0 {
+		t.Errorf("expected the free failures to not block, got %s", wait)
+	}
+
+	// each further failure doubles the lockout
+	for _, expect := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		limiter.Failure(account, "10.0.0.2")
+		if wait := limiter.Blocked(account, "10.0.0.3"); wait != expect {
+			t.Errorf("expected to be locked out for %s, got %s", expect, wait)
+		}
+	}
+
+	// other accounts from other IPs are not affected
+	if wait := limiter.Blocked(accountKey(2, ""), "10.0.0.3"); wait != 0 {
+		t.Errorf("expected other accounts to not be locked out, got %s", wait)
+	}
+
+	now = now.Add(4 * time.Second)
+	if wait := limiter.Blocked(account, "10.0.0.3"); wait != 0 {
+		t.Errorf("expected lockout to be over, got %s", wait)
+	}
+
+	if lockouts := limiter.Lockouts(); len(lockouts) != 0 {
+		t.Errorf("expected no current lockouts, got %+v", lockouts)
+	}
+	limiter.Failure(account, "10.0.0.2")
+	if lockouts := limiter.Lockouts(); len(lockouts) != 1 || lockouts[0].Key != "user:1" || lockouts[0].Failures != 7 {
+		t.Errorf("expected user 1 to be locked out after 7 failures, got %+v", lockouts)
+	}
+	if !limiter.UnlockAccount(account) || limiter.UnlockAccount(account) {
+		t.Errorf("expected unlocking to succeed exactly once")
+	}
+	if wait := limiter.Blocked(account, "10.0.0.3"); wait != 0 {
+		t.Errorf("expected unlocked account to not be blocked, got %s", wait)
+	}
+
+	// failures are forgotten after a while
+	for i := 0; i < 4; i++ {
+		limiter.Failure(account, "10.0.0.4")
+	}
+	now = now.Add(gLoginFailureWindow + time.Second)
+	limiter.Failure(account, "10.0.0.4")
+	if wait := limiter.Blocked(account, "10.0.0.4"); wait != 0 {
+		t.Errorf("expected old failures to be forgotten, got %s", wait)
+	}
+}
+
+func TestLoginLimiterIP(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newLoginLimiter(3, 5)
+	limiter.now = func() time.Time { return now }
+
+	// guessing one password each for many accounts
+	for i := 0; i < 6; i++ {
+		limiter.Failure(accountKey(0, string(rune('a'+i))), "10.0.0.1")
+	}
+	if wait := limiter.Blocked(accountKey(0, "z"), "10.0.0.1"); wait != time.Second {
+		t.Errorf("expected IP to be locked out for a second, got %s", wait)
+	}
+	if wait := limiter.Blocked(accountKey(0, "z"), "10.0.0.2"); wait != 0 {
+		t.Errorf("expected other IPs to not be locked out, got %s", wait)
+	}
+
+	// logging in successfully doesn't help the IP
+	limiter.Success(accountKey(0, "a"))
+	if wait := limiter.Blocked(accountKey(0, "a"), "10.0.0.1"); wait == 0 {
+		t.Errorf("expected IP to stay locked out after a success")
+	}
+	if !limiter.UnlockIP("10.0.0.1") {
+		t.Errorf("expected IP to be unlocked")
+	}
+	if wait := limiter.Blocked(accountKey(0, "z"), "10.0.0.1"); wait != 0 {
+		t.Errorf("expected unlocked IP to not be blocked, got %s", wait)
+	}
+}
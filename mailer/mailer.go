@@ -0,0 +1,85 @@
+// Package mailer sends the emails Chirpy needs, like address verification.
+// SMTPMailer delivers through an SMTP server, WriterMailer just prints the
+// messages, which is handy during development.
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer that sends through the SMTP server at addr
+// (host:port). If username is empty, no authentication is done. net/smtp only
+// sends the credentials over TLS or to localhost.
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &m
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg)); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", msg.To, err)
+	}
+
+	return nil
+}
+
+// WriterMailer writes every message to w instead of sending it.
+type WriterMailer struct {
+	w    io.Writer
+	lock *sync.Mutex
+}
+
+func NewWriterMailer(w io.Writer) *WriterMailer {
+	return &WriterMailer{w: w, lock: &sync.Mutex{}}
+}
+
+func (m *WriterMailer) Send(msg Message) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "--- mail to %s ---\nSubject: %s\n\n%s\n---\n", msg.To, msg.Subject, msg.Body)
+	return err
+}
+
+// formats msg as an RFC 5322 message with CRLF line endings
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return []byte(b.String())
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
+	"net/mail"
 	"os"
 	"sort"
 	"strconv"
@@ -18,17 +18,31 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
 	db "github.com/horriblename/go-web-server/db"
+	"github.com/horriblename/go-web-server/mailer"
 	godotenv "github.com/joho/godotenv"
 )
 
 const (
 	DEFAULT_DATABASE_FILE            = "/tmp/database.json"
 	DEBUG_DATABASE_FILE              = "/tmp/debug-database.json"
+	DEFAULT_MEDIA_DIR                = "/tmp/chirpy-media"
+	DEBUG_MEDIA_DIR                  = "/tmp/debug-chirpy-media"
 	gAccessTokenExpirationInSeconds  = 1 * 60 * 60       // 1 hours
 	gRefreshTokenExpirationInSeconds = 60 * 24 * 60 * 60 // 60 days
 	gAccessTokIssuer                 = "chirpy-access"
 	gRefreshTokIssuer                = "chirpy-refresh"
 	gWebhookEventUserUpgraded        = "user.upgraded"
+	gMaxChirpLength                  = 140
+	gMaxContentWarningLength         = 100
+	gProfanityWarning                = "profanity"
+	gWordListWatchInterval           = 5 * time.Second
+	gDefaultMailFrom                 = "chirpy@localhost"
+)
+
+// profanity policies, selects what profanityFilter hits do to a chirp
+const (
+	profanityPolicyMask = "mask" // replace banned words with ****
+	profanityPolicyWarn = "warn" // keep the text, attach a content warning
 )
 
 var (
@@ -37,32 +51,107 @@ var (
 )
 
 type apiConfig struct {
-	fileserverHits int
-	db             *db.DB
-	jwtSecret      []byte
-	polkaApiKey    string
+	fileserverHits  int
+	db              *db.DB
+	jwtKeys         *jwtKeySet
+	polkaApiKey     string
+	profanityPolicy string
+	profanity       *profanityFilter
+	adminApiKey     string
+	reportThreshold int
+	mediaPath       string
+	mailer          mailer.Mailer
+	passwordPolicy  *passwordPolicy
+	// key TOTP secrets are encrypted with
+	mfaKey []byte
+	// key CSRF tokens are derived with
+	csrfKey      []byte
+	loginLimiter *loginLimiter
+	// the OpenID provider is disabled if empty
+	oidcIssuer       string
+	oidcAuthorizeURL string
+	// login with an external identity provider, disabled if nil
+	sso *ssoProvider
+	// API key other services introspect tokens with, disabled if empty
+	introspectionApiKey string
 }
 
 type serverConfig struct {
 	databasePath string
 	address      string
+	// directory uploaded media like avatars is stored in
+	mediaPath       string
+	profanityPolicy string
+	// file with the banned word lists, the built-in list is used if empty
+	wordListPath string
+	// how often the word list file is checked for changes, 0 disables watching
+	wordListWatchInterval time.Duration
+	// API key for /admin, all admin endpoints are disabled if empty
+	adminApiKey string
+	// API key for /api/introspect, which is disabled if empty
+	introspectionApiKey string
+	// number of reports after which a chirp is hidden, 0 disables auto-hiding
+	reportThreshold int
+	// sends verification emails, they are printed to stdout if nil
+	mailer mailer.Mailer
+	// password policy, see newPasswordPolicy
+	passwordMinLength  int
+	passwordMaxLength  int
+	passwordMinClasses int
+	// file with breached passwords that can't be used, none if empty
+	breachedPasswordsPath string
+	// 32 byte key TOTP secrets are encrypted with, derived from the JWT secret
+	// if empty
+	mfaKey []byte
+	// failed logins allowed before logins are slowed down, 0 for the defaults
+	accountFreeLoginFailures int
+	ipFreeLoginFailures      int
+	// PEM file with the RSA or Ed25519 private key tokens are signed with,
+	// they are signed with the JWT secret if empty
+	jwtSigningKeyPath string
+	// PEM files with keys that are no longer used for signing, but whose
+	// tokens are still accepted
+	jwtVerificationKeyPaths []string
+	// with a signing key, tokens signed with the JWT secret are accepted until
+	// then, never if zero
+	jwtSecretAcceptedUntil time.Time
+	// public base URL of the server, e.g. https://chirpy.example. The OpenID
+	// provider is disabled if empty or if tokens are signed with the JWT secret.
+	oidcIssuer string
+	// the web app's consent page clients send users to, issuer/app/authorize
+	// if empty
+	oidcAuthorizeURL string
+	// external OpenID provider users can log in with, disabled if ssoIssuer
+	// is empty
+	ssoIssuer       string
+	ssoClientID     string
+	ssoClientSecret string
+	// the web app's page the provider sends users back to
+	ssoRedirectURL string
 }
 
 type genericErrorMsg struct {
 	Error string `json:"error"`
 }
 
+// users log in with either their email or their handle
 type PostLoginParameters struct {
 	Email    string `json:"email"`
+	Handle   string `json:"handle"`
 	Password string `json:"password"`
+	// set the tokens as cookies instead of returning them, see
+	// respondWithLoginTokens
+	Cookies bool `json:"cookies"`
 }
 
+// the tokens are empty for cookie sessions, which get the CSRF token instead
 type LoginSuccessResponse struct {
 	Id           int    `json:"id"`
 	Email        string `json:"email"`
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	CSRFToken    string `json:"csrf_token,omitempty"`
 }
 
 type PostRefreshParameters struct {
@@ -70,7 +159,23 @@ type PostRefreshParameters struct {
 }
 
 type PostRefreshResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// claims of the tokens we issue
+type chirpyClaims struct {
+	jwt.RegisteredClaims
+	// refresh tokens and our own access tokens, the db.RefreshFamily (session)
+	// the token belongs to
+	Family string `json:"fam,omitempty"`
+	// access tokens issued to OAuth clients only, what the client may do
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// our own access tokens only, the role of the user when it was issued
+	Role db.Role `json:"role,omitempty"`
+	// the db.User.TokenGeneration of the user when it was issued
+	Generation int `json:"gen,omitempty"`
 }
 
 type PostPolkaWebhooksParameters struct {
@@ -80,8 +185,6 @@ type PostPolkaWebhooksParameters struct {
 	} `json:"data"`
 }
 
-var gProfanity []string = []string{"kerfuffle", "sharbert", "fornax"}
-
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		cfg.fileserverHits += 1
@@ -132,22 +235,28 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 
 func (apiCfg apiConfig) handlePostChirp(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
-		Body string `json:"body"`
+		Body           string `json:"body"`
+		ContentWarning string `json:"content_warning"`
+		Sensitive      bool   `json:"sensitive"`
 	}
 
-	token, err := validateJWT(w, req, apiCfg.jwtSecret)
-	if err != nil {
-		return
-	}
+	userID := principalFrom(req).UserID
 
-	subject, err := token.Claims.GetSubject()
-	if err != nil {
+	user, err := apiCfg.db.GetUser(userID)
+	if err == db.ErrUserNotFound {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
+	} else if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
 	}
-	userID, err := strconv.Atoi(subject)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Bad Request")
+	if user.Suspended {
+		respondWithJSON(w, http.StatusForbidden, genericErrorMsg{Error: "Account suspended"})
+		return
+	}
+	if !user.EmailVerified {
+		respondWithJSON(w, http.StatusForbidden, genericErrorMsg{Error: "Email not verified"})
 		return
 	}
 
@@ -160,7 +269,7 @@ func (apiCfg apiConfig) handlePostChirp(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	if len(params.Body) > 140 {
+	if len(params.Body) > gMaxChirpLength {
 		respBody := genericErrorMsg{
 			Error: "Chirp is too long",
 		}
@@ -168,17 +277,18 @@ func (apiCfg apiConfig) handlePostChirp(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	filtered, err := profanityFilter(params.Body)
-	if err != nil {
+	if len(params.ContentWarning) > gMaxContentWarningLength {
 		respBody := genericErrorMsg{
-			Error: "Internal Server Error",
+			Error: "Content warning is too long",
 		}
-		respondWithJSON(w, http.StatusInternalServerError, respBody)
+		respondWithJSON(w, http.StatusBadRequest, respBody)
 		return
 	}
 
+	body, contentWarning := applyProfanityPolicy(apiCfg.profanity, apiCfg.profanityPolicy, params.Body, params.ContentWarning)
+
 	// success response
-	chirp, err := apiCfg.db.CreateChirp(userID, filtered)
+	chirp, err := apiCfg.db.CreateChirp(userID, body, contentWarning, params.Sensitive)
 	if err != nil {
 		respBody := genericErrorMsg{
 			Error: "Database Error",
@@ -190,41 +300,24 @@ func (apiCfg apiConfig) handlePostChirp(w http.ResponseWriter, req *http.Request
 	respondWithJSON(w, 201, chirp)
 }
 
-func profanityFilter(input string) (string, error) {
-	var err error
-	for _, word := range gProfanity {
-		input, err = caseInsensitiveReplace(strings.NewReader(input), word, "****")
-		if err != nil {
-			return input, err
-		}
-	}
-
-	return input, err
-}
-
-func caseInsensitiveReplace(input io.Reader, search, replace string) (string, error) {
-	out := strings.Builder{}
-	reader := bufio.NewReader(input)
-	var s string
-	var err error
-	for err == nil {
-		s, err = reader.ReadString(' ')
+// applyProfanityPolicy runs body through filter and returns the body and
+// content warning to store, according to policy:
+//
+//   - profanityPolicyMask (default): banned words are masked
+//   - profanityPolicyWarn: the body is kept as-is and, if it contains banned
+//     words, gProfanityWarning is attached unless the author already set one
+func applyProfanityPolicy(filter *profanityFilter, policy, body, contentWarning string) (string, string) {
+	filtered := filter.Filter(body)
 
-		if strings.EqualFold(strings.TrimRight(s, " "), search) {
-			out.WriteString(replace)
-			if s[len(s)-1] == ' ' {
-				out.WriteByte(' ')
-			}
-		} else {
-			out.WriteString(s)
-		}
+	if policy != profanityPolicyWarn {
+		return filtered, contentWarning
 	}
 
-	if err == io.EOF {
-		err = nil
+	if filtered != body && contentWarning == "" {
+		contentWarning = gProfanityWarning
 	}
 
-	return out.String(), err
+	return body, contentWarning
 }
 
 func (cfg *apiConfig) handlePostLogin(w http.ResponseWriter, req *http.Request) {
@@ -237,9 +330,27 @@ func (cfg *apiConfig) handlePostLogin(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	user, err := cfg.db.ValidateUser(params.Email, params.Password)
-	if err == db.ErrWrongPassword {
-		fmt.Printf("user %s failed password check\n", params.Email)
+	login := params.Email
+	if login == "" {
+		login = params.Handle
+	}
+
+	userID, err := cfg.db.UserIDByLogin(login)
+	if err != nil && err != db.ErrUserNotFound {
+		fmt.Printf("looking up user: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	account, ip := accountKey(userID, login), clientIP(req)
+	if wait := cfg.loginLimiter.Blocked(account, ip); wait > 0 {
+		respondLockedOut(w, wait)
+		return
+	}
+
+	// unknown users and wrong passwords look the same
+	user, err := cfg.db.ValidateUser(login, params.Password)
+	if err == db.ErrWrongPassword || err == db.ErrUnregisteredEmail {
+		cfg.loginLimiter.Failure(account, ip)
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
@@ -256,39 +367,114 @@ func (cfg *apiConfig) handlePostLogin(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	accessTokClaims := jwt.RegisteredClaims{
-		Issuer:    gAccessTokIssuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(gAccessTokenExpirationInSeconds) * time.Second)),
-		Subject:   strconv.Itoa(user.Id),
+	if !user.MFAEnabled {
+		cfg.loginLimiter.Success(account)
 	}
-	refreshTokClaims := jwt.RegisteredClaims{
-		Issuer:    gRefreshTokIssuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(gRefreshTokenExpirationInSeconds) * time.Second)),
-		Subject:   strconv.Itoa(user.Id),
+
+	cfg.completeLogin(w, req, *user, params.Cookies)
+}
+
+// responds to a login of user with tokens, or with a challenge for the second
+// factor if they enabled one
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, req *http.Request, user db.UserDTO, cookies bool) {
+	if user.MFAEnabled {
+		token, err := cfg.db.CreateMFAChallenge(user.Id, gMFAChallengeTTL)
+		if err != nil {
+			fmt.Printf("creating MFA challenge: %s\n", err)
+			respondWithError(w, http.StatusInternalServerError, "Database Error")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, MFAChallengeResponse{MFARequired: true, MFAToken: token})
+		return
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokClaims)
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshTokClaims)
 
-	accessTokStr, err := accessToken.SignedString(cfg.jwtSecret)
+	cfg.respondWithLoginTokens(w, req, user, cookies)
+}
+
+// signs a new access and refresh token for user, starting a new refresh token
+// family, i.e. session, on client
+func (cfg *apiConfig) issueLoginTokens(user db.UserDTO, client db.Client) (LoginSuccessResponse, string, error) {
+	expiresAt := time.Now().Add(time.Duration(gRefreshTokenExpirationInSeconds) * time.Second)
+	family, jti, err := cfg.db.CreateRefreshFamily(user.Id, client, expiresAt)
 	if err != nil {
-		fmt.Printf("signing JWT token: %s\n", err)
-		respondWithError(w, http.StatusInternalServerError, "Internal Error")
-		return
+		return LoginSuccessResponse{}, "", fmt.Errorf("creating refresh token family: %w", err)
 	}
 
-	refreshTokStr, err := refreshToken.SignedString(cfg.jwtSecret)
+	accessTokStr, err := cfg.signAccessToken(user.Id, user.TokenGeneration, user.Role, family)
+	if err != nil {
+		return LoginSuccessResponse{}, "", err
+	}
+	refreshTokStr, err := cfg.signRefreshToken(user.Id, user.TokenGeneration, family, jti, expiresAt)
+	if err != nil {
+		return LoginSuccessResponse{}, "", err
+	}
+
+	return LoginSuccessResponse{
+		Id:           user.Id,
+		Email:        user.Email,
+		Token:        accessTokStr,
+		RefreshToken: refreshTokStr,
+		IsChirpyRed:  user.IsChirpyRed,
+	}, family, nil
+}
+
+// signs an access token of our own, which may do everything, for the session
+// with the given refresh token family. The role is only informational,
+// requests are authorized with the user's current role.
+func (cfg *apiConfig) signAccessToken(userID, generation int, role db.Role, family string) (string, error) {
+	claims := newAccessTokenClaims(userID, generation)
+	claims.Role = role
+	claims.Family = family
+	return cfg.signAccessTokenClaims(claims)
+}
+
+// signs an access token for an OAuth client, which may only use scopes
+func (cfg *apiConfig) signClientAccessToken(userID, generation int, clientID string, scopes []string) (string, error) {
+	claims := newAccessTokenClaims(userID, generation)
+	claims.ClientID = clientID
+	claims.Scope = strings.Join(scopes, " ")
+	return cfg.signAccessTokenClaims(claims)
+}
 
-	resp := LoginSuccessResponse{
-		user.Id,
-		user.Email,
-		accessTokStr,
-		refreshTokStr,
-		user.IsChirpyRed,
+func newAccessTokenClaims(userID, generation int) chirpyClaims {
+	return chirpyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    gAccessTokIssuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(gAccessTokenExpirationInSeconds) * time.Second)),
+			Subject:   strconv.Itoa(userID),
+		},
+		Generation: generation,
 	}
+}
 
-	respondWithJSON(w, http.StatusOK, resp)
+func (cfg *apiConfig) signAccessTokenClaims(claims chirpyClaims) (string, error) {
+	tokStr, err := cfg.jwtKeys.Sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("signing access token: %w", err)
+	}
+	return tokStr, nil
+}
+
+func (cfg *apiConfig) signRefreshToken(userID, generation int, family, jti string, expiresAt time.Time) (string, error) {
+	claims := chirpyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    gRefreshTokIssuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			Subject:   strconv.Itoa(userID),
+			ID:        jti,
+		},
+		Family:     family,
+		Generation: generation,
+	}
+
+	tokStr, err := cfg.jwtKeys.Sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("signing refresh token: %w", err)
+	}
+	return tokStr, nil
 }
 
 func (cfg *apiConfig) handleGetChirps(w http.ResponseWriter, req *http.Request) {
@@ -302,6 +488,8 @@ func (cfg *apiConfig) handleGetChirps(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	chirps = filter(func(chirp db.Chirp) bool { return !chirp.Hidden }, chirps)
+
 	authorIDStr := req.URL.Query().Get("author_id")
 	if authorID, err := strconv.Atoi(authorIDStr); err == nil {
 		chirps = filter(func(chirp db.Chirp) bool { return chirp.AuthorID == authorID }, chirps)
@@ -314,6 +502,11 @@ func (cfg *apiConfig) handleGetChirps(w http.ResponseWriter, req *http.Request)
 		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
 	}
 
+	expand := expandSensitive(req)
+	for i := range chirps {
+		chirps[i] = hideSensitive(chirps[i], expand)
+	}
+
 	respondWithJSON(w, http.StatusOK, chirps)
 }
 
@@ -321,7 +514,7 @@ func (cfg *apiConfig) handleGetChirpByID(w http.ResponseWriter, req *http.Reques
 	chirpID := req.Context().Value("chirpID")
 	if chirpID, ok := chirpID.(int); ok {
 		chirp, err := cfg.db.GetChirp(chirpID)
-		if err == db.ErrChirpNotFound {
+		if err == db.ErrChirpNotFound || (err == nil && chirp.Hidden) {
 			respondWithError(w, http.StatusNotFound, "Not Found")
 			return
 		} else if err != nil {
@@ -330,30 +523,34 @@ func (cfg *apiConfig) handleGetChirpByID(w http.ResponseWriter, req *http.Reques
 			return
 		}
 
-		respondWithJSON(w, http.StatusOK, chirp)
+		respondWithJSON(w, http.StatusOK, hideSensitive(*chirp, expandSensitive(req)))
 		return
 	}
 
 	respondWithError(w, http.StatusNotFound, "Not Found")
 }
 
-func (cfg *apiConfig) handleDeleteChirpByID(w http.ResponseWriter, req *http.Request) {
-	token, err := validateJWT(w, req, cfg.jwtSecret)
-	if err != nil {
-		return
-	}
+// reports whether the client asked for sensitive chirps to be sent in full
+// with `?expand_sensitive=true`
+func expandSensitive(req *http.Request) bool {
+	expand, err := strconv.ParseBool(req.URL.Query().Get("expand_sensitive"))
+	return err == nil && expand
+}
 
-	subject, err := token.Claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Token Missing Subject")
-		return
-	}
-	userID, err := strconv.Atoi(subject)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Token Subject Not ID")
-		return
+// hideSensitive blanks the body of a chirp that is marked sensitive or carries a
+// content warning, unless expand is set. The flags themselves are kept so
+// clients know why the body is missing.
+func hideSensitive(chirp db.Chirp, expand bool) db.Chirp {
+	if !expand && (chirp.Sensitive || chirp.ContentWarning != "") {
+		chirp.Body = ""
 	}
 
+	return chirp
+}
+
+func (cfg *apiConfig) handleDeleteChirpByID(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
 	chirpID := req.Context().Value("chirpID")
 	if chirpID, ok := chirpID.(int); ok {
 		chirp, err := cfg.db.GetChirp(chirpID)
@@ -401,6 +598,7 @@ func (cfg *apiConfig) handleDeleteChirpByID(w http.ResponseWriter, req *http.Req
 func (cfg *apiConfig) handlePostUsers(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
+		Handle   string `json:"handle"`
 		Password string `json:"password"`
 	}
 
@@ -412,145 +610,201 @@ func (cfg *apiConfig) handlePostUsers(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	user, err := cfg.db.CreateUser(params.Email, params.Password)
-	if err != nil {
+	if !validEmail(params.Email) {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Invalid email"})
+		return
+	}
+
+	if errs := cfg.passwordPolicy.Check(params.Password); errs != nil {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	user, err := cfg.db.CreateUser(params.Email, params.Handle, params.Password)
+	if err == db.ErrInvalidHandle {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err == db.ErrEmailTaken || err == db.ErrHandleTaken {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, "Database Error")
 		return
 	}
+
+	cfg.sendVerificationEmail(user.Id, user.Email)
 	respondWithJSON(w, 201, user)
 }
 
 func (cfg *apiConfig) handlePutUserById(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		CurrentPassword string `json:"current_password"`
 	}
 	var params parameters
-	token, err := validateJWT(w, req, cfg.jwtSecret)
+	userID := principalFrom(req).UserID
+
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&params)
 	if err != nil {
+		fmt.Printf("decoding json: %s\n", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
 
-	if iss, err := token.Claims.GetIssuer(); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Missing Issuer in Token")
-		return
-	} else if iss != gAccessTokIssuer {
-		respondWithError(w, http.StatusUnauthorized, "Wrong Issuer")
+	if !validEmail(params.Email) {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Invalid email"})
 		return
 	}
 
-	userIDStr, err := token.Claims.GetSubject()
-	if err != nil {
-		// TODO: log?
-		respondWithError(w, http.StatusBadRequest, "Missing Subject in Token")
+	if errs := cfg.passwordPolicy.Check(params.Password); errs != nil {
+		respondWithValidationErrors(w, errs)
 		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	err = decoder.Decode(&params)
-	if err != nil {
-		fmt.Printf("decoding json: %s\n", err)
-		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+	if !cfg.confirmPassword(w, req, userID, params.CurrentPassword) {
 		return
 	}
 
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Token Subject is not an ID")
+	oldUser, err := cfg.db.GetUser(userID)
+	if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
 		return
 	}
 
-	updatedUser, err := cfg.db.UpdateUser(userID, params.Email, params.Password)
-	if err != nil {
+	updatedUser, err := cfg.db.UpdateUser(userID, db.UserUpdate{Email: &params.Email, Password: &params.Password})
+	if err == db.ErrEmailTaken {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Database Error")
 		return
 	}
 
+	// a new address has to be verified again
+	if !strings.EqualFold(oldUser.Email, updatedUser.Email) {
+		cfg.sendVerificationEmail(userID, updatedUser.Email)
+	}
+
 	respondWithJSON(w, http.StatusOK, updatedUser)
 }
 
 func (cfg *apiConfig) handlePostRefresh(w http.ResponseWriter, req *http.Request) {
-	token, err := validateJWT(w, req, cfg.jwtSecret)
+	tokStr, claims, err := parseJWT(req, cfg.jwtKeys, gRefreshTokIssuer)
 	if err != nil {
+		respondWithAuthError(w, err)
 		return
 	}
 
-	auth := req.Header.Get("Authorization")
-
-	const prefix = "Bearer "
-	if !strings.HasPrefix(auth, prefix) {
-		respondWithError(w, http.StatusBadRequest, `Malformed "Authorization" in Header`)
+	resp, ok := cfg.refreshTokens(w, req, tokStr, claims)
+	if !ok {
 		return
 	}
-	tokStr := strings.TrimPrefix(auth, prefix)
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// exchanges the refresh token tokStr with claims for a new access and refresh
+// token. Responds with an error and returns false if it can't be used.
+func (cfg *apiConfig) refreshTokens(w http.ResponseWriter, req *http.Request, tokStr string, claims *chirpyClaims) (PostRefreshResponse, bool) {
 	if err := cfg.db.CheckTokenRevocation(tokStr); err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Token Revoked or Database Error")
-		return
+		return PostRefreshResponse{}, false
 	}
 
-	if iss, err := token.Claims.GetIssuer(); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Token Missing Issuer")
-		return
-	} else if iss != gRefreshTokIssuer {
-		fmt.Printf("request refresh: wrong issuer %s\n", iss)
-		respondWithError(w, http.StatusUnauthorized, "Wrong Issuer")
-		return
+	userID, err := claims.userID()
+	if err != nil {
+		respondWithAuthError(w, err)
+		return PostRefreshResponse{}, false
 	}
 
-	subject, err := token.Claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Token Missing Subject")
-		return
+	// refresh tokens of deleted users are dead
+	user, err := cfg.db.GetUser(userID)
+	if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return PostRefreshResponse{}, false
+	} else if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return PostRefreshResponse{}, false
+	}
+
+	// e.g. a password reset revokes all refresh tokens issued before it
+	if claims.IssuedAt == nil || user.TokenRevoked(claims.IssuedAt.Time, claims.Generation) {
+		respondWithError(w, http.StatusUnauthorized, "Token Revoked")
+		return PostRefreshResponse{}, false
 	}
 
-	accessTokClaims := jwt.RegisteredClaims{
-		Issuer:    gAccessTokIssuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(gAccessTokenExpirationInSeconds) * time.Second)),
-		Subject:   subject,
+	// every refresh token can be used once, the response carries its successor
+	expiresAt := time.Now().Add(time.Duration(gRefreshTokenExpirationInSeconds) * time.Second)
+	family, jti := claims.Family, ""
+	if family == "" {
+		// issued before refresh tokens were rotated, retire it and start a family
+		if err := cfg.db.AddTokenRevocation(tokStr); err != nil {
+			fmt.Printf("revoking refresh token: %s\n", err)
+			respondWithError(w, http.StatusInternalServerError, "Database Error")
+			return PostRefreshResponse{}, false
+		}
+		family, jti, err = cfg.db.CreateRefreshFamily(userID, requestClient(req), expiresAt)
+	} else {
+		jti, err = cfg.db.RotateRefreshToken(userID, family, claims.ID, requestClient(req), expiresAt)
+	}
+	if err == db.ErrRefreshTokenReused {
+		fmt.Printf("refresh token of user %d was used twice, revoked its family\n", userID)
+		respondWithError(w, http.StatusUnauthorized, "Token Revoked")
+		return PostRefreshResponse{}, false
+	} else if err == db.ErrTokenRevoked {
+		respondWithError(w, http.StatusUnauthorized, "Token Revoked")
+		return PostRefreshResponse{}, false
+	} else if err != nil {
+		fmt.Printf("rotating refresh token: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return PostRefreshResponse{}, false
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokClaims)
 
-	accessTokStr, err := accessToken.SignedString(cfg.jwtSecret)
+	accessTokStr, err := cfg.signAccessToken(userID, user.TokenGeneration, user.EffectiveRole(), family)
 	if err != nil {
 		fmt.Printf("signing JWT token: %s\n", err)
 		respondWithError(w, http.StatusInternalServerError, "Internal Error")
-		return
+		return PostRefreshResponse{}, false
 	}
-
-	resp := PostRefreshResponse{
-		Token: accessTokStr,
+	refreshTokStr, err := cfg.signRefreshToken(userID, user.TokenGeneration, family, jti, expiresAt)
+	if err != nil {
+		fmt.Printf("signing JWT token: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return PostRefreshResponse{}, false
 	}
-	respondWithJSON(w, http.StatusOK, resp)
+
+	return PostRefreshResponse{
+		Token:        accessTokStr,
+		RefreshToken: refreshTokStr,
+	}, true
 }
 
 func (cfg *apiConfig) handlePostRevoke(w http.ResponseWriter, req *http.Request) {
-	token, err := validateJWT(w, req, cfg.jwtSecret)
+	tokStr, claims, err := parseJWT(req, cfg.jwtKeys, gRefreshTokIssuer)
 	if err != nil {
+		respondWithAuthError(w, err)
 		return
 	}
 
-	if iss, err := token.Claims.GetIssuer(); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Token Missing Issuer")
-		return
-	} else if iss != gRefreshTokIssuer {
-		fmt.Printf("request refresh: wrong issuer %s\n", iss)
-		respondWithError(w, http.StatusUnauthorized, "Wrong Issuer")
-		return
-	}
-
-	auth := req.Header.Get("Authorization")
-
-	const prefix = "Bearer "
-	if !strings.HasPrefix(auth, prefix) {
-		respondWithError(w, http.StatusBadRequest, `Malformed "Authorization" in Header`)
-		return
+	// revoking any token of a family revokes the rest of it as well
+	if family := claims.Family; family != "" {
+		err = cfg.db.RevokeRefreshFamily(family)
+		if err == db.ErrTokenRevoked {
+			// nothing left to revoke
+			err = nil
+		}
+	} else {
+		err = cfg.db.AddTokenRevocation(tokStr)
 	}
-	tokStr := strings.TrimPrefix(auth, prefix)
-
-	err = cfg.db.AddTokenRevocation(tokStr)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
 	}
 
 	respondWithJSON(w, http.StatusOK, struct{}{})
@@ -603,23 +857,90 @@ func chirpCtx(next http.Handler) http.Handler {
 	})
 }
 
+func userCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userIDStr := chi.URLParam(req, "userID")
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Expected an ID")
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), "userID", userID)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
 func apiRouter(cfg *apiConfig) chi.Router {
+	// access tokens only, no API keys
+	loggedIn := cfg.authenticate("")
+
 	router := chi.NewRouter()
 	router.Get("/healthz", handleReadinessCheck)
 	router.Post("/login", cfg.handlePostLogin)
+	router.Post("/login/mfa", cfg.handlePostLoginMFA)
+	router.Route("/sso", func(r chi.Router) {
+		r.Use(cfg.middlewareSSOEnabled)
+		r.Post("/login", cfg.handlePostSSOLogin)
+		r.Post("/callback", cfg.handlePostSSOCallback)
+	})
 	router.Route("/chirps", func(r chi.Router) {
 		r.Get("/", cfg.handleGetChirps)
-		r.Post("/", cfg.handlePostChirp)
+		r.With(cfg.authenticate(scopeChirpsWrite)).Post("/", cfg.handlePostChirp)
 		r.With(chirpCtx).Get("/{chirpID}", cfg.handleGetChirpByID)
-		r.With(chirpCtx).Delete("/{chirpID}", cfg.handleDeleteChirpByID)
+		r.With(chirpCtx, cfg.authenticate(scopeChirpsWrite)).Delete("/{chirpID}", cfg.handleDeleteChirpByID)
+		r.With(chirpCtx, cfg.authenticate(scopeChirpsWrite)).Post("/{chirpID}/report", cfg.handlePostChirpReport)
 	})
 	router.Route("/users", func(r chi.Router) {
 		r.Post("/", cfg.handlePostUsers)
-		r.Put("/", cfg.handlePutUserById)
+		r.With(loggedIn).Put("/", cfg.handlePutUserById)
+		r.Post("/verify", cfg.handlePostVerify)
+		r.With(loggedIn).Post("/verify/resend", cfg.handlePostResendVerification)
+		r.Route("/me", func(r chi.Router) {
+			r.With(cfg.authenticate(scopeProfileRead)).Get("/", cfg.handleGetUserMe)
+			r.Group(func(r chi.Router) {
+				r.Use(loggedIn)
+				r.Patch("/", cfg.handlePatchUserMe)
+				r.Delete("/", cfg.handleDeleteUserMe)
+				r.Post("/mfa/totp", cfg.handlePostEnrollTOTP)
+				r.Post("/mfa/totp/confirm", cfg.handlePostConfirmTOTP)
+				r.Delete("/mfa/totp", cfg.handleDeleteTOTP)
+				r.Get("/sessions", cfg.handleGetSessions)
+				r.Delete("/sessions", cfg.handleDeleteSessions)
+				r.Delete("/sessions/{sessionID}", cfg.handleDeleteSession)
+				r.Get("/api-keys", cfg.handleGetAPIKeys)
+				r.Post("/api-keys", cfg.handlePostAPIKey)
+				r.Delete("/api-keys/{keyID}", cfg.handleDeleteAPIKey)
+				r.Get("/consents", cfg.handleGetConsents)
+				r.Delete("/consents/{clientID}", cfg.handleDeleteConsent)
+				r.Put("/avatar", cfg.handlePutAvatar)
+				r.Delete("/avatar", cfg.handleDeleteAvatar)
+			})
+		})
+		r.Get("/by-handle/{handle}", cfg.handleGetUserByHandle)
+		r.With(userCtx).Get("/{userID}", cfg.handleGetUserByID)
+		r.With(userCtx).Get("/{userID}/avatar", cfg.handleGetAvatar)
+		r.With(userCtx, loggedIn).Post("/{userID}/follow", cfg.handlePostFollow)
+		r.With(userCtx, loggedIn).Delete("/{userID}/follow", cfg.handleDeleteFollow)
+		r.With(userCtx).Get("/{userID}/followers", cfg.handleGetFollowers)
+		r.With(userCtx).Get("/{userID}/following", cfg.handleGetFollowing)
 	})
+	router.With(cfg.authenticate(scopeChirpsRead)).Get("/timeline", cfg.handleGetTimeline)
+	router.Post("/password/forgot", cfg.handlePostForgotPassword)
+	router.Post("/password/reset", cfg.handlePostResetPassword)
 	router.Post("/refresh", cfg.handlePostRefresh)
 	router.Post("/revoke", cfg.handlePostRevoke)
+	router.With(cfg.middlewareIntrospectionAuth).Post("/introspect", cfg.handlePostIntrospect)
+	router.Post("/session/refresh", cfg.handlePostSessionRefresh)
+	router.Post("/session/logout", cfg.handlePostSessionLogout)
 	router.Post("/polka/webhooks", cfg.handlePostPolkaWebhooks)
+	router.Route("/oauth", func(r chi.Router) {
+		r.Use(cfg.middlewareOIDCEnabled)
+		r.With(loggedIn).Get("/authorize", cfg.handleGetAuthorize)
+		r.With(loggedIn).Post("/authorize", cfg.handlePostAuthorize)
+		r.Post("/token", cfg.handlePostOAuthToken)
+		r.With(cfg.authenticate(scopeOpenID)).Get("/userinfo", cfg.handleGetUserinfo)
+	})
 
 	return router
 }
@@ -627,7 +948,36 @@ func apiRouter(cfg *apiConfig) chi.Router {
 func adminRouter(cfg *apiConfig) chi.Router {
 	router := chi.NewRouter()
 
-	router.Get("/metrics", cfg.HandleMetricRequest)
+	// moderators only review chirps and users
+	router.Route("/moderation", func(r chi.Router) {
+		r.Use(cfg.middlewareAdminAuth(db.RoleModerator))
+		r.Get("/", cfg.handleGetModerationQueue)
+		r.With(chirpCtx).Post("/chirps/{chirpID}", cfg.handlePostModerationAction)
+		r.With(userCtx).Post("/users/{userID}/suspend", cfg.handleSetUserSuspended(true))
+		r.With(userCtx).Delete("/users/{userID}/suspend", cfg.handleSetUserSuspended(false))
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(cfg.middlewareAdminAuth(db.RoleAdmin))
+		r.Get("/metrics", cfg.HandleMetricRequest)
+		r.Route("/profanity", func(r chi.Router) {
+			r.Get("/", cfg.handleGetProfanityLists)
+			r.Put("/", cfg.handlePutProfanityLists)
+			r.Post("/reload", cfg.handlePostProfanityReload)
+		})
+		r.Route("/lockouts", func(r chi.Router) {
+			r.Get("/", cfg.handleGetLockouts)
+			r.With(userCtx).Delete("/users/{userID}", cfg.handleDeleteUserLockout)
+			r.Delete("/ips/{ip}", cfg.handleDeleteIPLockout)
+		})
+		r.With(userCtx).Put("/users/{userID}/role", cfg.handlePutUserRole)
+		r.With(userCtx).Post("/users/{userID}/revoke-tokens", cfg.handlePostRevokeUserTokens)
+		r.Route("/oauth/clients", func(r chi.Router) {
+			r.Use(cfg.middlewareOIDCEnabled)
+			r.Get("/", cfg.handleGetOAuthClients)
+			r.Post("/", cfg.handlePostOAuthClient)
+			r.Delete("/{clientID}", cfg.handleDeleteOAuthClient)
+		})
+	})
 
 	return router
 }
@@ -640,6 +990,14 @@ func handleReadinessCheck(w http.ResponseWriter, req *http.Request) {
 }
 
 func startServer(serverCfg serverConfig, jwtSecret []byte, polkaApiKey string) error {
+	switch serverCfg.profanityPolicy {
+	case "":
+		serverCfg.profanityPolicy = profanityPolicyMask
+	case profanityPolicyMask, profanityPolicyWarn:
+	default:
+		return fmt.Errorf("unknown profanity policy %q", serverCfg.profanityPolicy)
+	}
+
 	router := chi.NewRouter()
 
 	db, err := db.New(serverCfg.databasePath)
@@ -647,7 +1005,74 @@ func startServer(serverCfg serverConfig, jwtSecret []byte, polkaApiKey string) e
 		panic(fmt.Sprintf("Creating DB: %s", err))
 	}
 
-	apiCfg := apiConfig{0, db, jwtSecret, polkaApiKey}
+	if serverCfg.mailer == nil {
+		serverCfg.mailer = mailer.NewWriterMailer(os.Stdout)
+	}
+
+	if serverCfg.mediaPath == "" {
+		serverCfg.mediaPath = DEFAULT_MEDIA_DIR
+	}
+	if err := os.MkdirAll(serverCfg.mediaPath, 0755); err != nil {
+		return fmt.Errorf("creating media directory: %w", err)
+	}
+
+	passwordPolicy, err := newPasswordPolicy(serverCfg.passwordMinLength, serverCfg.passwordMaxLength,
+		serverCfg.passwordMinClasses, serverCfg.breachedPasswordsPath)
+	if err != nil {
+		return fmt.Errorf("setting up password policy: %w", err)
+	}
+
+	if serverCfg.mfaKey == nil {
+		serverCfg.mfaKey = deriveMFAKey(jwtSecret)
+	} else if len(serverCfg.mfaKey) != gMFAKeySize {
+		return fmt.Errorf("MFA encryption key must be %d bytes, got %d", gMFAKeySize, len(serverCfg.mfaKey))
+	}
+
+	jwtKeys, err := newJWTKeySet(jwtSecret, serverCfg.jwtSigningKeyPath, serverCfg.jwtVerificationKeyPaths, serverCfg.jwtSecretAcceptedUntil)
+	if err != nil {
+		return fmt.Errorf("loading JWT keys: %w", err)
+	}
+
+	serverCfg.oidcIssuer = strings.TrimSuffix(serverCfg.oidcIssuer, "/")
+	if serverCfg.oidcIssuer != "" && serverCfg.oidcAuthorizeURL == "" {
+		serverCfg.oidcAuthorizeURL = serverCfg.oidcIssuer + "/app/authorize"
+	}
+
+	var sso *ssoProvider
+	if serverCfg.ssoIssuer != "" {
+		if serverCfg.ssoClientID == "" || serverCfg.ssoRedirectURL == "" {
+			return fmt.Errorf("SSO needs a client ID and redirect URL")
+		}
+		sso = newSSOProvider(serverCfg.ssoIssuer, serverCfg.ssoClientID, serverCfg.ssoClientSecret, serverCfg.ssoRedirectURL)
+	}
+
+	profanity, err := newProfanityFilter(serverCfg.wordListPath)
+	if err != nil {
+		return fmt.Errorf("loading word lists: %w", err)
+	}
+	if serverCfg.wordListPath != "" && serverCfg.wordListWatchInterval > 0 {
+		go profanity.Watch(serverCfg.wordListWatchInterval)
+	}
+
+	apiCfg := apiConfig{
+		db:                  db,
+		jwtKeys:             jwtKeys,
+		polkaApiKey:         polkaApiKey,
+		profanityPolicy:     serverCfg.profanityPolicy,
+		profanity:           profanity,
+		adminApiKey:         serverCfg.adminApiKey,
+		reportThreshold:     serverCfg.reportThreshold,
+		mediaPath:           serverCfg.mediaPath,
+		mailer:              serverCfg.mailer,
+		passwordPolicy:      passwordPolicy,
+		mfaKey:              serverCfg.mfaKey,
+		csrfKey:             deriveCSRFKey(jwtSecret),
+		loginLimiter:        newLoginLimiter(serverCfg.accountFreeLoginFailures, serverCfg.ipFreeLoginFailures),
+		oidcIssuer:          serverCfg.oidcIssuer,
+		oidcAuthorizeURL:    serverCfg.oidcAuthorizeURL,
+		sso:                 sso,
+		introspectionApiKey: serverCfg.introspectionApiKey,
+	}
 	fileServer := apiCfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))
 
 	// if not using chi
@@ -656,6 +1081,8 @@ func startServer(serverCfg serverConfig, jwtSecret []byte, polkaApiKey string) e
 
 	router.Get("/app/*", http.StripPrefix("/app", fileServer).ServeHTTP)
 	router.Get("/app", emptyPath(fileServer).ServeHTTP)
+	router.Get("/.well-known/jwks.json", apiCfg.handleGetJWKS)
+	router.With(apiCfg.middlewareOIDCEnabled).Get("/.well-known/openid-configuration", apiCfg.handleGetOpenIDConfiguration)
 	router.Mount("/api", apiRouter(&apiCfg))
 	router.Mount("/admin", adminRouter(&apiCfg))
 
@@ -675,12 +1102,78 @@ func main() {
 	godotenv.Load()
 
 	serverCfg := serverConfig{
-		databasePath: DEFAULT_DATABASE_FILE,
-		address:      host,
+		databasePath:          DEFAULT_DATABASE_FILE,
+		address:               host,
+		mediaPath:             DEFAULT_MEDIA_DIR,
+		profanityPolicy:       os.Getenv("PROFANITY_POLICY"),
+		wordListPath:          os.Getenv("WORD_LIST_FILE"),
+		wordListWatchInterval: gWordListWatchInterval,
+		adminApiKey:           os.Getenv("ADMIN_API_KEY"),
+		introspectionApiKey:   os.Getenv("INTROSPECTION_API_KEY"),
+		reportThreshold:       envNonNegativeInt("REPORT_THRESHOLD", gDefaultReportThreshold),
+		passwordMinLength:     envNonNegativeInt("PASSWORD_MIN_LENGTH", gDefaultPasswordMinLength),
+		passwordMaxLength:     envNonNegativeInt("PASSWORD_MAX_LENGTH", gBcryptMaxPasswordLength),
+		passwordMinClasses:    envNonNegativeInt("PASSWORD_MIN_CLASSES", gDefaultPasswordMinClasses),
+		breachedPasswordsPath: os.Getenv("BREACHED_PASSWORDS_FILE"),
+		oidcIssuer:            os.Getenv("OIDC_ISSUER"),
+		oidcAuthorizeURL:      os.Getenv("OIDC_AUTHORIZE_URL"),
+		ssoIssuer:             os.Getenv("SSO_ISSUER"),
+		ssoClientID:           os.Getenv("SSO_CLIENT_ID"),
+		ssoClientSecret:       os.Getenv("SSO_CLIENT_SECRET"),
+		ssoRedirectURL:        os.Getenv("SSO_REDIRECT_URL"),
+	}
+
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			from = gDefaultMailFrom
+		}
+		serverCfg.mailer = mailer.NewSMTPMailer(smtpAddr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+
+	if key := os.Getenv("MFA_ENCRYPTION_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			fmt.Printf("MFA_ENCRYPTION_KEY must be base64: %s\n", err)
+			os.Exit(1)
+		}
+		serverCfg.mfaKey = decoded
+	}
+	serverCfg.jwtSigningKeyPath = os.Getenv("JWT_SIGNING_KEY_FILE")
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEY_FILES"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			serverCfg.jwtVerificationKeyPaths = append(serverCfg.jwtVerificationKeyPaths, path)
+		}
+	}
+	if until := os.Getenv("JWT_SECRET_ACCEPTED_UNTIL"); until != "" {
+		parsed, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			fmt.Printf("JWT_SECRET_ACCEPTED_UNTIL must be an RFC 3339 time: %s\n", err)
+			os.Exit(1)
+		}
+		serverCfg.jwtSecretAcceptedUntil = parsed
 	}
 
 	if *dbg {
 		serverCfg.databasePath = DEBUG_DATABASE_FILE
+		serverCfg.mediaPath = DEBUG_MEDIA_DIR
+	}
+
+	if host == "create-admin" {
+		// the debug database is reset when the server starts, the admin would
+		// be gone right away
+		if *dbg {
+			fmt.Printf("create-admin doesn't work with --debug\n")
+			os.Exit(1)
+		}
+		if err := createAdmin(serverCfg, flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *dbg {
 		_ = os.Remove(serverCfg.databasePath)
 	}
 
@@ -722,40 +1215,27 @@ func emptyPath(next http.Handler) http.Handler {
 	}
 }
 
-// validates the autheticity of a JWT token. If an error occured, w will already be written to and should not be used further
-//
-// TODO: having w "sometimes" being written to is kinda confusing, should change that
-func validateJWT(w http.ResponseWriter, req *http.Request, secret []byte) (*jwt.Token, error) {
-	// header format:
-	//	  Authorization: Bearer <token>
-	auth := req.Header.Get("Authorization")
-
-	const prefix = "Bearer "
-	if !strings.HasPrefix(auth, prefix) {
-		respondWithError(w, http.StatusBadRequest, `Malformed "Authorization" in Header`)
-		return nil, ErrBadAuthHeader
+// reads a non-negative number from the environment variable name, or returns
+// def if it is not set. Exits if the variable is set to anything else.
+func envNonNegativeInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
 	}
-	tokStr := strings.TrimPrefix(auth, prefix)
-	claims := jwt.RegisteredClaims{}
 
-	token, err := jwt.ParseWithClaims(tokStr, &claims, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
-	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-			return nil, ErrUnauthorizedToken
-		}
-		respondWithError(w, http.StatusBadRequest, "Bad Request")
-		return nil, fmt.Errorf("parsing JWT token: %w\n", err)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		fmt.Printf("%s must be a non-negative number\n", name)
+		os.Exit(1)
 	}
 
-	if !token.Valid {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return nil, ErrUnauthorizedToken
-	}
+	return n
+}
 
-	return token, nil
+// reports whether email is a plain address like "user@example.com"
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
 }
 
 func filter[T any](pred func(T) bool, elements []T) []T {
@@ -2,18 +2,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/horriblename/go-web-server/db"
+	"github.com/horriblename/go-web-server/mailer"
+	"github.com/horriblename/go-web-server/totp"
 	"github.com/joho/godotenv"
 )
 
@@ -33,9 +43,37 @@ func TestServer(t *testing.T) {
 	}
 
 	serverErr := make(chan error, 1)
+	adminApiKey := "test-admin-key"
+	mails := &testMailer{lock: &sync.Mutex{}}
+	breachedPath := t.TempDir() + "/breached.txt"
+	assertOk(os.WriteFile(breachedPath, []byte("password123\n"), 0644))
+	// the OpenID provider needs a key pair
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	assertOk(err)
+	signingKeyPath := writePEMKey(t, t.TempDir(), "signing.pem", signingKey, false)
+	idp := newMockIdP(t, "chirpy", "sso-secret")
 	serverCfg := serverConfig{
-		address:      url,
-		databasePath: DEBUG_DATABASE_FILE,
+		address:               url,
+		databasePath:          DEBUG_DATABASE_FILE,
+		adminApiKey:           adminApiKey,
+		introspectionApiKey:   "test-introspection-key",
+		reportThreshold:       2,
+		mediaPath:             t.TempDir(),
+		mailer:                mails,
+		passwordMinLength:     8,
+		passwordMinClasses:    1,
+		breachedPasswordsPath: breachedPath,
+		// everything comes from one IP here
+		ipFreeLoginFailures: 1000,
+		jwtSigningKeyPath:   signingKeyPath,
+		oidcIssuer:          "http://" + url,
+		ssoIssuer:           idp.server.URL,
+		ssoClientID:         "chirpy",
+		ssoClientSecret:     "sso-secret",
+		ssoRedirectURL:      "http://" + url + "/app/sso/callback",
+	}
+	adminHeader := map[string]string{
+		"Authorization": "ApiKey " + adminApiKey,
 	}
 
 	godotenv.Load()
@@ -50,29 +88,62 @@ func TestServer(t *testing.T) {
 	url = "http://" + url
 
 	assertOk(testHttpRequestString("GET", nil, url+"/api/healthz", nil, http.StatusOK, "OK"))
+	jwks, err := testHttpWithResponse[JWKSet]("GET", nil, url+"/.well-known/jwks.json", nil, http.StatusOK)
+	assertOk(err)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != "EdDSA" || jwks.Keys[0].Kid == "" {
+		t.Errorf("expected the Ed25519 signing key, got %+v", *jwks)
+	}
+	discovery, err := testHttpWithResponse[OpenIDConfiguration]("GET", nil, url+"/.well-known/openid-configuration", nil, http.StatusOK)
+	assertOk(err)
+	if discovery.Issuer != url || discovery.TokenEndpoint != url+"/api/oauth/token" || discovery.AuthorizationEndpoint != url+"/app/authorize" {
+		t.Errorf("unexpected discovery document %+v", *discovery)
+	}
 	assertOk(testHttpRequest("GET", nil, url+"/app", nil, http.StatusOK, gNoCheck))
 	assertOk(testHttpRequest("GET", nil, url+"/app/assets/logo.png", nil, http.StatusOK, gNoCheck))
 
 	// TODO check it returns 2
-	assertOk(testHttpRequest("GET", nil, url+"/admin/metrics", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("GET", adminHeader, url+"/admin/metrics", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("GET", nil, url+"/admin/metrics", nil, http.StatusUnauthorized, gNoCheck))
 
 	users_url := url + "/api/users"
 	email1 := "x@ymail.com"
-	pw1 := "04234"
-	req_user := PostUserRequest{email1, pw1}
+	pw1 := "correct-horse-1"
+	handle1 := "user_one"
+	req_user := SignupRequest{email1, handle1, pw1}
 	// Register User 1
-	assertOk(testHttpRequest("POST", nil, users_url, req_user, 201, &db.UserDTO{Id: 1, Email: email1}))
+	assertOk(testHttpRequest("POST", nil, users_url, req_user, 201, &db.UserDTO{Id: 1, Email: email1, Handle: handle1, Role: db.RoleUser}))
 
 	email2 := "abc@nomail.com"
-	pw2 := "10293"
-	req_user = PostUserRequest{email2, pw2}
+	pw2 := "purple-monkey-2"
+	handle2 := "User_Two"
+	req_user = SignupRequest{email2, handle2, pw2}
 	// Register User 2
-	assertOk(testHttpRequest("POST", nil, users_url, req_user, 201, &db.UserDTO{Id: 2, Email: email2}))
+	assertOk(testHttpRequest("POST", nil, users_url, req_user, 201, &db.UserDTO{Id: 2, Email: email2, Handle: handle2, Role: db.RoleUser}))
+
+	// signup validation
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"not an email", "valid_handle", pw1}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"X@YMail.com", "valid_handle", pw1}, http.StatusConflict, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"other@ymail.com", "USER_TWO", pw1}, http.StatusConflict, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"other@ymail.com", "a", pw1}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"other@ymail.com", "admin", pw1}, http.StatusConflict, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"other@ymail.com", "", pw1}, http.StatusBadRequest, gNoCheck))
+
+	// password policy
+	weak, err := testHttpWithResponse[ValidationErrorResponse]("POST", nil, users_url, SignupRequest{"other@ymail.com", "other", "short"}, http.StatusBadRequest)
+	assertOk(err)
+	if len(weak.Errors) != 1 || weak.Errors[0].Field != "password" || weak.Errors[0].Code != passwordTooShort {
+		t.Errorf("expected a too_short password error, got %+v", *weak)
+	}
+	breached, err := testHttpWithResponse[ValidationErrorResponse]("POST", nil, users_url, SignupRequest{"other@ymail.com", "other", "password123"}, http.StatusBadRequest)
+	assertOk(err)
+	if len(breached.Errors) != 1 || breached.Errors[0].Code != passwordBreached {
+		t.Errorf("expected a breached password error, got %+v", *breached)
+	}
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{"other@ymail.com", "other", strings.Repeat("x", 73)}, http.StatusBadRequest, gNoCheck))
 
 	login_url := url + "/api/login"
 	req_login := PostUserRequest{email1, pw1}
 	var login_resp *LoginSuccessResponse
-	var err error
 	// Login User 1
 	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, req_login, 200)
 	assertOk(err)
@@ -91,11 +162,66 @@ func TestServer(t *testing.T) {
 	// Login User With Wrong Password
 	assertOk(testHttpRequestString("POST", nil, login_url, req_login, http.StatusUnauthorized, "Unauthorized"))
 
+	// Login with a handle, ignoring case
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostHandleLoginRequest{"user_two", pw2}, 200)
+	assertOk(err)
+	if login_resp.Id != 2 {
+		t.Errorf("expected logging in as user_two to log in user 2, got %d", login_resp.Id)
+	}
+
+	// unknown users look like wrong passwords
+	assertOk(testHttpRequestString("POST", nil, login_url, PostUserRequest{"nobody@nomail.com", pw1}, http.StatusUnauthorized, "Unauthorized"))
+
+	// repeated failures lock the account out, even for the right password
+	for i := 0; i <= gDefaultAccountFreeFailures; i++ {
+		assertOk(testHttpRequest("POST", nil, login_url, PostHandleLoginRequest{handle1, "guess"}, http.StatusUnauthorized, gNoCheck))
+	}
+	lockedResp, err := sendHttpRequest("POST", nil, login_url, PostUserRequest{email1, pw1}, http.StatusTooManyRequests)
+	assertOk(err)
+	lockedResp.Body.Close()
+	if lockedResp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header when locked out")
+	}
+	lockouts, err := testHttpWithResponse[[]Lockout]("GET", adminHeader, url+"/admin/lockouts", nil, http.StatusOK)
+	assertOk(err)
+	if len(*lockouts) != 1 || (*lockouts)[0].Key != "user:1" {
+		t.Errorf("expected user 1 to be locked out, got %+v", *lockouts)
+	}
+	assertOk(testHttpRequest("DELETE", adminHeader, url+"/admin/lockouts/users/1", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("DELETE", adminHeader, url+"/admin/lockouts/users/1", nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("DELETE", adminHeader, url+"/admin/lockouts/ips/nonsense", nil, http.StatusBadRequest, gNoCheck))
+	_, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email1, pw1}, http.StatusOK)
+	assertOk(err)
+
 	// test /api/chirp
 	var req_post_chirp PostChirpRequest
 	chirps_url := url + "/api/chirps"
 	assertOk(testHttpRequest("GET", nil, chirps_url, nil, http.StatusOK, gNoCheck))
 
+	// email verification
+	verify_url := users_url + "/verify"
+	verify := func(email string) {
+		token := mails.lastToken(email)
+		if token == "" {
+			t.Fatalf("no verification email sent to %s", email)
+		}
+		user, err := testHttpWithResponse[db.UserDTO]("POST", nil, verify_url, PostVerifyParameters{token}, http.StatusOK)
+		assertOk(err)
+		if !user.EmailVerified || user.Email != email {
+			t.Errorf("expected %s to be verified, got %+v", email, *user)
+		}
+		// tokens only work once
+		assertOk(testHttpRequest("POST", nil, verify_url, PostVerifyParameters{token}, http.StatusBadRequest, gNoCheck))
+	}
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), chirps_url, PostChirpRequest{"too early"}, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, verify_url, PostVerifyParameters{"not a token"}, http.StatusBadRequest, gNoCheck))
+	oldToken := mails.lastToken(email1)
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), verify_url+"/resend", nil, http.StatusAccepted, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, verify_url, PostVerifyParameters{oldToken}, http.StatusBadRequest, gNoCheck))
+	verify(email1)
+	verify(email2)
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), verify_url+"/resend", nil, http.StatusConflict, gNoCheck))
+
 	req_post_chirp = PostChirpRequest{"Hello!"}
 	header := newAuthenticatedHeader(accToken1)
 	chirp1 := db.Chirp{Id: 1, AuthorID: 1, Body: "Hello!"}
@@ -121,43 +247,198 @@ func TestServer(t *testing.T) {
 	// TODO check returned result
 	assertOk(testHttpRequest("GET", nil, url+"/api/chirps/100", nil, http.StatusNotFound, gNoCheck))
 
+	// banned word lists can be changed at runtime
+	profanity_url := url + "/admin/profanity"
+	lists := wordListFile{Lists: []wordList{
+		{Name: "default", Words: gProfanity},
+		{Name: "extra", Replacement: "[redacted]", Wildcards: []string{"blorp*"}},
+	}}
+	assertOk(testHttpRequest("PUT", adminHeader, profanity_url, lists, http.StatusOK, &lists))
+	assertOk(testHttpRequest("GET", adminHeader, profanity_url, nil, http.StatusOK, &lists))
+	assertOk(testHttpRequest("POST", adminHeader, profanity_url+"/reload", nil, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("PUT", adminHeader, profanity_url, wordListFile{Lists: []wordList{{Regexes: []string{"("}}}}, http.StatusBadRequest, gNoCheck))
+	filtered, err := testHttpWithResponse[db.Chirp]("POST", newAuthenticatedHeader(accToken1), chirps_url, PostChirpRequest{"blorpy sharbert"}, 201)
+	assertOk(err)
+	if filtered.Body != "[redacted] ****" {
+		t.Errorf("expected body to be filtered by new word lists, got %q", filtered.Body)
+	}
+	assertOk(testHttpRequest("DELETE", newAuthenticatedHeader(accToken1), chirps_url+"/3", nil, http.StatusOK, gNoCheck))
+
+	// sensitive chirps hide their body unless ?expand_sensitive=true. The ID of
+	// the deleted chirp 3 isn't reused.
+	header = newAuthenticatedHeader(accToken2)
+	req_post_sensitive := PostChirpRequestWithWarning{"the butler did it", "spoilers", true}
+	chirp4 := db.Chirp{Id: 4, AuthorID: 2, Body: "the butler did it", ContentWarning: "spoilers", Sensitive: true}
+	assertOk(testHttpRequest("POST", header, chirps_url, req_post_sensitive, 201, &chirp4))
+	hidden4 := chirp4
+	hidden4.Body = ""
+	assertOk(testHttpRequest("GET", nil, chirps_url+"/4", nil, http.StatusOK, &hidden4))
+	assertOk(testHttpRequest("GET", nil, chirps_url+"/4?expand_sensitive=true", nil, http.StatusOK, &chirp4))
+	expect = []db.Chirp{chirp1, chirp2, hidden4}
+	assertOk(testHttpRequest("GET", nil, chirps_url, nil, http.StatusOK, &expect))
+
+	// reporting and moderation
+	moderation_url := url + "/admin/moderation"
+	report_url := chirps_url + "/4/report"
+	assertOk(testHttpRequest("POST", nil, report_url, PostChirpReportParameters{Reason: db.ReportSpam}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), report_url, PostChirpReportParameters{Reason: "boring"}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), chirps_url+"/100/report", PostChirpReportParameters{Reason: db.ReportSpam}, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), report_url, PostChirpReportParameters{Reason: db.ReportSpam, Comment: "ads"}, http.StatusCreated, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken1), report_url, PostChirpReportParameters{Reason: db.ReportSpam}, http.StatusConflict, gNoCheck))
+	assertOk(testHttpRequest("GET", nil, moderation_url, nil, http.StatusUnauthorized, gNoCheck))
+	queue, err := testHttpWithResponse[[]db.ModerationItem]("GET", adminHeader, moderation_url, nil, http.StatusOK)
+	assertOk(err)
+	if len(*queue) != 1 || (*queue)[0].Chirp.Id != 4 || len((*queue)[0].Reports) != 1 {
+		t.Errorf("expected chirp 4 with one report in the moderation queue, got %+v", *queue)
+	}
+	// still visible below the threshold
+	assertOk(testHttpRequest("GET", nil, chirps_url+"/4", nil, http.StatusOK, gNoCheck))
+	// second report reaches the threshold and hides the chirp
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken2), report_url, PostChirpReportParameters{Reason: db.ReportOther}, http.StatusCreated, gNoCheck))
+	assertOk(testHttpRequest("GET", nil, chirps_url+"/4", nil, http.StatusNotFound, gNoCheck))
+	expect = []db.Chirp{chirp1, chirp2}
+	assertOk(testHttpRequest("GET", nil, chirps_url, nil, http.StatusOK, &expect))
+	// approving makes it visible again and empties the queue
+	assertOk(testHttpRequest("POST", adminHeader, moderation_url+"/chirps/4", PostModerationParameters{Action: "frobnicate"}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", adminHeader, moderation_url+"/chirps/4", PostModerationParameters{Action: db.ModerationApprove}, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("GET", nil, chirps_url+"/4", nil, http.StatusOK, &hidden4))
+	assertOk(testHttpRequest("GET", adminHeader, moderation_url, nil, http.StatusOK, &[]db.ModerationItem{}))
+	// suspended users can't post
+	assertOk(testHttpRequest("POST", adminHeader, moderation_url+"/users/2/suspend", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(accToken2), chirps_url, PostChirpRequest{"let me out"}, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("DELETE", adminHeader, moderation_url+"/users/2/suspend", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("POST", adminHeader, moderation_url+"/users/100/suspend", nil, http.StatusNotFound, gNoCheck))
+
 	header = newAuthenticatedHeader(accToken1)
-	pw1 = "043234"
-	req_put_users := PostUserRequest{
+	assertOk(testHttpRequest("PUT", header, users_url, PutUserRequest{email1, "", pw1}, http.StatusBadRequest, gNoCheck))
+	req_put_users := PutUserRequest{
 		Email:    email1,
-		Password: pw1,
+		Password: "battery-staple-1",
 	}
+	// changing the password or email needs the current password
+	assertOk(testHttpRequest("PUT", header, users_url, req_put_users, http.StatusBadRequest, gNoCheck))
+	req_put_users.CurrentPassword = "wrong password"
+	assertOk(testHttpRequest("PUT", header, users_url, req_put_users, http.StatusUnauthorized, gNoCheck))
+	req_put_users.CurrentPassword = pw1
+	pw1 = req_put_users.Password
 	// PUT /api/users: change password
 	_, err = testHttpWithResponse[LoginSuccessResponse]("PUT", header, users_url, req_put_users, 200)
 	assertOk(err)
 
 	header = newAuthenticatedHeader(accToken2)
 	email2 = "new@email.com"
-	req_put_users = PostUserRequest{
-		Email:    email2,
-		Password: pw2,
+	req_put_users = PutUserRequest{
+		Email:           email2,
+		Password:        pw2,
+		CurrentPassword: pw2,
 	}
 	// PUT /api/users: change email
 	_, err = testHttpWithResponse[LoginSuccessResponse]("PUT", header, users_url, req_put_users, 200)
 	assertOk(err)
+	// the new address has to be verified before posting again
+	assertOk(testHttpRequest("POST", header, chirps_url, PostChirpRequest{"new address"}, http.StatusForbidden, gNoCheck))
+	verify(email2)
 
 	refresh_url := url + "/api/refresh"
 	empty_req := struct{}{}
+	// refresh tokens are no access tokens
 	header = newAuthenticatedHeader(refreshToken1)
-	// refresh token
-	_, err = testHttpWithResponse[PostRefreshResponse]("POST", header, refresh_url, empty_req, 200)
+	assertOk(testHttpRequestString("POST", header, chirps_url, PostChirpRequest{"sneaky"}, http.StatusUnauthorized, "Wrong Issuer"))
+	assertOk(testHttpRequestString("DELETE", header, chirps_url+"/1", nil, http.StatusUnauthorized, "Wrong Issuer"))
+	assertOk(testHttpRequestString("GET", header, url+"/api/timeline", nil, http.StatusUnauthorized, "Wrong Issuer"))
+
+	// refresh token, each refresh hands out the next refresh token
+	refresh_resp, err := testHttpWithResponse[PostRefreshResponse]("POST", header, refresh_url, empty_req, 200)
+	assertOk(err)
+	if refresh_resp.RefreshToken == "" || refresh_resp.RefreshToken == refreshToken1 {
+		t.Fatalf("expected a new refresh token, got %q", refresh_resp.RefreshToken)
+	}
+	assertOk(testHttpRequest("GET", newAuthenticatedHeader(refresh_resp.Token), url+"/api/timeline", nil, http.StatusOK, gNoCheck))
+	refresh_resp, err = testHttpWithResponse[PostRefreshResponse]("POST", newAuthenticatedHeader(refresh_resp.RefreshToken), refresh_url, empty_req, 200)
 	assertOk(err)
 
+	// reusing a rotated refresh token revokes its whole family
+	assertOk(testHttpRequest("POST", header, refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(refresh_resp.RefreshToken), refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	// and the access tokens of that session too
+	assertOk(testHttpRequest("GET", newAuthenticatedHeader(accToken1), url+"/api/timeline", nil, http.StatusUnauthorized, gNoCheck))
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email1, pw1}, 200)
+	assertOk(err)
+	accToken1 = login_resp.Token
+
 	header = newAuthenticatedHeader(accToken2)
 	// refresh token reject wrong token
 	assertOk(testHttpRequest("POST", header, refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
 
 	revoke_url := url + "/api/revoke"
-	header = newAuthenticatedHeader(refreshToken1)
-	// revoke refresh token of user 1
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email2, pw2}, 200)
+	assertOk(err)
+	header = newAuthenticatedHeader(login_resp.RefreshToken)
+	// revoke refresh token of user 2
 	assertOk(testHttpRequest("POST", header, revoke_url, empty_req, http.StatusOK, gNoCheck))
 	assertOk(testHttpRequest("POST", header, refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
 
+	// password reset
+	forgot_url := url + "/api/password/forgot"
+	reset_url := url + "/api/password/reset"
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email2, pw2}, 200)
+	assertOk(err)
+	refreshToken2 := login_resp.RefreshToken
+	forgot := func(email string) string {
+		resp, err := sendHttpRequest("POST", nil, forgot_url, PostForgotPasswordParameters{email}, http.StatusAccepted)
+		assertOk(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assertOk(err)
+		return string(body)
+	}
+	sentBefore := mails.count()
+	// unknown emails can't be told apart
+	if unknown, known := forgot("nobody@nomail.com"), forgot(email2); unknown != known {
+		t.Errorf("expected the same response for unknown and known emails, got %q and %q", unknown, known)
+	}
+	resetToken := mails.waitToken(email2, sentBefore)
+	newPw2 := "reset-pw"
+	assertOk(testHttpRequest("POST", nil, reset_url, PostResetPasswordParameters{"bogus", newPw2}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, reset_url, PostResetPasswordParameters{resetToken, newPw2}, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, reset_url, PostResetPasswordParameters{resetToken, "reset-again"}, http.StatusBadRequest, gNoCheck))
+	// old refresh tokens and the old password stop working
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(refreshToken2), refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	assertOk(testHttpRequest("POST", nil, login_url, PostUserRequest{email2, pw2}, http.StatusUnauthorized, gNoCheck))
+	pw2 = newPw2
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email2, pw2}, 200)
+	assertOk(err)
+	refresh_resp, err = testHttpWithResponse[PostRefreshResponse]("POST", newAuthenticatedHeader(login_resp.RefreshToken), refresh_url, empty_req, http.StatusOK)
+	assertOk(err)
+
+	// sessions
+	sessions_url := url + "/api/users/me/sessions"
+	phone_resp, err := testHttpWithResponse[LoginSuccessResponse]("POST", map[string]string{"User-Agent": "phone"}, login_url, PostUserRequest{email2, pw2}, 200)
+	assertOk(err)
+	header = newAuthenticatedHeader(phone_resp.Token)
+	sessions_resp, err := testHttpWithResponse[[]db.Session]("GET", header, sessions_url, nil, http.StatusOK)
+	assertOk(err)
+	sessions := *sessions_resp
+	if len(sessions) != 2 || sessions[0].UserAgent != "phone" || sessions[0].IP != "127.0.0.1" {
+		t.Fatalf("expected the phone and the earlier session, got %+v", sessions)
+	}
+	// log the phone out from the other session
+	other_header := newAuthenticatedHeader(refresh_resp.Token)
+	assertOk(testHttpRequest("DELETE", other_header, sessions_url+"/"+sessions[0].Id, nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("DELETE", other_header, sessions_url+"/"+sessions[0].Id, nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(phone_resp.RefreshToken), refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	// its access token stops working right away
+	assertOk(testHttpRequest("GET", header, sessions_url, nil, http.StatusUnauthorized, gNoCheck))
+	// the other session is left alone, until logging out everywhere
+	assertOk(testHttpRequest("GET", other_header, sessions_url, nil, http.StatusOK, &[]db.Session{sessions[1]}))
+	assertOk(testHttpRequest("DELETE", other_header, sessions_url, nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(refresh_resp.RefreshToken), refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	// including access tokens
+	assertOk(testHttpRequest("GET", other_header, sessions_url, nil, http.StatusUnauthorized, gNoCheck))
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email2, pw2}, 200)
+	assertOk(err)
+	accToken2 = login_resp.Token
+
 	// DELETE /api/chirps/{id}
 	header = newAuthenticatedHeader(accToken1)
 	assertOk(testHttpRequest("DELETE", header, chirps_url+"/1", struct{}{}, http.StatusOK, gNoCheck))
@@ -187,6 +468,12 @@ func TestServer(t *testing.T) {
 	if !resp.IsChirpyRed {
 		t.Errorf("expected user to have chirpy red")
 	}
+	// updating the user keeps chirpy red
+	updated, err := testHttpWithResponse[db.UserDTO]("PUT", newAuthenticatedHeader(accToken2), users_url, PutUserRequest{email2, pw2, pw2}, http.StatusOK)
+	assertOk(err)
+	if !updated.IsChirpyRed {
+		t.Errorf("expected chirpy red to survive a user update, got %+v", *updated)
+	}
 
 	webhook_req = PostPolkaWebhooksParameters{
 		Event: "user.upgraded",
@@ -233,6 +520,639 @@ func TestServer(t *testing.T) {
 	if !sort.SliceIsSorted(*chirps, func(i, j int) bool { return (*chirps)[i].Id < (*chirps)[j].Id }) {
 		t.Fatalf("chirps not sorted in ascending order: %+v", chirps)
 	}
+
+	// follows and the home timeline
+	email3 := "follower@nomail.com"
+	pw3 := "tall-giraffe-3"
+	handle3 := "follower"
+	assertOk(testHttpRequest("POST", nil, users_url, SignupRequest{email3, handle3, pw3}, 201, gNoCheck))
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, 200)
+	assertOk(err)
+	header = newAuthenticatedHeader(login_resp.Token)
+	user3 := login_resp.Id
+	verify(email3)
+
+	timeline_url := url + "/api/timeline"
+	assertOk(testHttpRequest("GET", header, timeline_url, nil, http.StatusOK, &TimelineResponse{Chirps: []db.Chirp{}}))
+	assertOk(testHttpRequest("POST", header, fmt.Sprintf("%s/%d/follow", users_url, user3), nil, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", header, users_url+"/100/follow", nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("POST", header, users_url+"/1/follow", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("POST", header, users_url+"/2/follow", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("POST", header, users_url+"/2/follow", nil, http.StatusOK, gNoCheck))
+	followers, err := testHttpWithResponse[[]db.Follow]("GET", nil, users_url+"/2/followers", nil, http.StatusOK)
+	assertOk(err)
+	if len(*followers) != 1 || (*followers)[0].UserID != user3 {
+		t.Errorf("expected user %d to be the only follower of user 2, got %+v", user3, *followers)
+	}
+	following, err := testHttpWithResponse[[]db.Follow]("GET", nil, fmt.Sprintf("%s/%d/following", users_url, user3), nil, http.StatusOK)
+	assertOk(err)
+	if len(*following) != 2 {
+		t.Errorf("expected user %d to follow 2 users, got %+v", user3, *following)
+	}
+
+	// all chirps by users 1 and 2, newest first, in pages of 2
+	all, err := testHttpWithResponse[[]db.Chirp]("GET", nil, chirps_url+"?sort=desc", nil, http.StatusOK)
+	assertOk(err)
+	paged := []db.Chirp{}
+	page_url := timeline_url + "?limit=2&expand_sensitive=true"
+	for page_url != "" {
+		page, err := testHttpWithResponse[TimelineResponse]("GET", header, page_url, nil, http.StatusOK)
+		assertOk(err)
+		paged = append(paged, page.Chirps...)
+		page_url = ""
+		if page.NextBefore != 0 {
+			page_url = fmt.Sprintf("%s?limit=2&expand_sensitive=true&before=%d", timeline_url, page.NextBefore)
+		}
+	}
+	expand := func(chirps []db.Chirp) []db.Chirp {
+		for i := range chirps {
+			if chirps[i].Sensitive || chirps[i].ContentWarning != "" {
+				chirps[i].Body = ""
+			}
+		}
+		return chirps
+	}
+	if !reflect.DeepEqual(expand(paged), expand(*all)) {
+		t.Errorf("expected timeline to contain all chirps newest first\nexpected %+v\ngot %+v", *all, paged)
+	}
+
+	assertOk(testHttpRequest("DELETE", header, users_url+"/2/follow", nil, http.StatusOK, gNoCheck))
+	page, err := testHttpWithResponse[TimelineResponse]("GET", header, timeline_url, nil, http.StatusOK)
+	assertOk(err)
+	for _, chirp := range page.Chirps {
+		if chirp.AuthorID != 1 {
+			t.Errorf("expected only chirps by user 1 after unfollowing user 2, got %+v", page.Chirps)
+		}
+	}
+	assertOk(testHttpRequest("GET", nil, timeline_url, nil, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("GET", header, timeline_url+"?limit=0", nil, http.StatusBadRequest, gNoCheck))
+
+	// API keys
+	api_keys_url := users_url + "/me/api-keys"
+	assertOk(testHttpRequest("POST", header, api_keys_url, PostAPIKeyParameters{"bot", []string{"chirps:delete"}}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", header, api_keys_url, PostAPIKeyParameters{"", []string{scopeChirpsWrite}}, http.StatusBadRequest, gNoCheck))
+	bot_key, err := testHttpWithResponse[APIKeyResponse]("POST", header, api_keys_url, PostAPIKeyParameters{"bot", []string{scopeChirpsWrite}}, http.StatusCreated)
+	assertOk(err)
+	if !strings.HasPrefix(bot_key.Key, "chirpy_") {
+		t.Errorf("expected the key to be shown on creation, got %+v", *bot_key)
+	}
+	key_header := map[string]string{"Authorization": "ApiKey " + bot_key.Key}
+	bot_chirp, err := testHttpWithResponse[db.Chirp]("POST", key_header, chirps_url, PostChirpRequest{"beep boop"}, http.StatusCreated)
+	assertOk(err)
+	if bot_chirp.AuthorID != user3 {
+		t.Errorf("expected the chirp to be posted as user %d, got %+v", user3, *bot_chirp)
+	}
+	assertOk(testHttpRequest("DELETE", key_header, fmt.Sprintf("%s/%d", chirps_url, bot_chirp.Id), nil, http.StatusOK, gNoCheck))
+	// only the granted scopes
+	assertOk(testHttpRequest("GET", key_header, timeline_url, nil, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("GET", key_header, users_url+"/me", nil, http.StatusForbidden, gNoCheck))
+	reader_key, err := testHttpWithResponse[APIKeyResponse]("POST", header, api_keys_url, PostAPIKeyParameters{"reader", []string{scopeChirpsRead, scopeProfileRead}}, http.StatusCreated)
+	assertOk(err)
+	reader_header := map[string]string{"Authorization": "ApiKey " + reader_key.Key}
+	assertOk(testHttpRequest("GET", reader_header, timeline_url, nil, http.StatusOK, gNoCheck))
+	me, err := testHttpWithResponse[ProfileResponse]("GET", reader_header, users_url+"/me", nil, http.StatusOK)
+	assertOk(err)
+	if me.Id != user3 {
+		t.Errorf("expected the profile of user %d, got %+v", user3, *me)
+	}
+	assertOk(testHttpRequest("POST", reader_header, chirps_url, PostChirpRequest{"no"}, http.StatusForbidden, gNoCheck))
+	// keys can't manage keys
+	assertOk(testHttpRequest("POST", reader_header, api_keys_url, PostAPIKeyParameters{"more", []string{scopeChirpsWrite}}, http.StatusForbidden, gNoCheck))
+	keys, err := testHttpWithResponse[[]APIKeyResponse]("GET", header, api_keys_url, nil, http.StatusOK)
+	assertOk(err)
+	if len(*keys) != 2 || (*keys)[0].Name != "bot" || (*keys)[0].Key != "" || (*keys)[0].LastUsedAt.IsZero() {
+		t.Errorf("expected the bot and reader keys without secrets, got %+v", *keys)
+	}
+	assertOk(testHttpRequest("DELETE", header, api_keys_url+"/"+bot_key.Id, nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("DELETE", header, api_keys_url+"/"+bot_key.Id, nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("POST", key_header, chirps_url, PostChirpRequest{"beep"}, http.StatusUnauthorized, gNoCheck))
+	assertOk(testHttpRequest("GET", map[string]string{"Authorization": "ApiKey chirpy_nope_nope"}, timeline_url, nil, http.StatusUnauthorized, gNoCheck))
+
+	// OpenID Connect
+	oauth_url := url + "/api/oauth"
+	client_url := url + "/admin/oauth/clients"
+	redirect := "https://app.example/callback"
+	assertOk(testHttpRequest("POST", adminHeader, client_url, PostOAuthClientParameters{"app", []string{"http://app.example/callback"}, false}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("POST", header, client_url, PostOAuthClientParameters{"app", []string{redirect}, false}, http.StatusForbidden, gNoCheck))
+	app, err := testHttpWithResponse[OAuthClientResponse]("POST", adminHeader, client_url, PostOAuthClientParameters{"app", []string{redirect}, false}, http.StatusCreated)
+	assertOk(err)
+	if app.ClientSecret == "" || app.Public {
+		t.Errorf("expected a confidential client with a secret, got %+v", *app)
+	}
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	authorize := AuthorizeParameters{
+		ResponseType:        "code",
+		ClientID:            app.ClientID,
+		RedirectURI:         redirect,
+		Scope:               "openid profile email",
+		State:               "xyz",
+		Nonce:               "n-0S6",
+		CodeChallenge:       codeChallengeS256(verifier),
+		CodeChallengeMethod: "S256",
+	}
+	authorize_url := oauth_url + "/authorize?" + authorizeQuery(authorize)
+	assertOk(testHttpRequest("GET", nil, authorize_url, nil, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("GET", header, authorize_url, nil, http.StatusOK, &AuthorizeResponse{app.ClientID, "app", []string{"openid", "profile", "email"}, false}))
+	unregistered := authorize
+	unregistered.RedirectURI = "https://evil.example/callback"
+	assertOk(testHttpRequest("GET", header, oauth_url+"/authorize?"+authorizeQuery(unregistered), nil, http.StatusBadRequest, gNoCheck))
+	no_pkce := authorize
+	no_pkce.CodeChallengeMethod = "plain"
+	assertOk(testHttpRequest("GET", header, oauth_url+"/authorize?"+authorizeQuery(no_pkce), nil, http.StatusBadRequest, gNoCheck))
+	// denying sends the user back with an error
+	redirect_resp, err := testHttpWithResponse[PostAuthorizeResponse]("POST", header, oauth_url+"/authorize", PostAuthorizeParameters{authorize, false}, http.StatusOK)
+	assertOk(err)
+	if redirect_resp.RedirectTo != redirect+"?error=access_denied&error_description=the+user+denied+access&state=xyz" {
+		t.Errorf("expected access_denied, got %+v", *redirect_resp)
+	}
+	code := func() string {
+		redirect_resp, err := testHttpWithResponse[PostAuthorizeResponse]("POST", header, oauth_url+"/authorize", PostAuthorizeParameters{authorize, true}, http.StatusOK)
+		assertOk(err)
+		code, state := redirectCode(redirect_resp.RedirectTo)
+		if code == "" || state != "xyz" {
+			t.Errorf("expected a code and the state, got %+v", *redirect_resp)
+		}
+		return code
+	}
+	token_form := map[string][]string{
+		"grant_type":    {"authorization_code"},
+		"code":          {code()},
+		"redirect_uri":  {redirect},
+		"code_verifier": {verifier},
+		"client_id":     {app.ClientID},
+		"client_secret": {app.ClientSecret},
+	}
+	// the consent is remembered
+	assertOk(testHttpRequest("GET", header, authorize_url, nil, http.StatusOK, &AuthorizeResponse{app.ClientID, "app", []string{"openid", "profile", "email"}, true}))
+	wrong_verifier := map[string][]string{}
+	for key, value := range token_form {
+		wrong_verifier[key] = value
+	}
+	wrong_verifier["code_verifier"] = []string{strings.Repeat("a", 43)}
+	assertOk(postOAuthToken(oauth_url+"/token", wrong_verifier, http.StatusBadRequest, &OAuthError{oauthInvalidGrant, "the code was not issued for this request"}))
+	// codes are single use, even after a failed attempt
+	assertOk(postOAuthToken(oauth_url+"/token", token_form, http.StatusBadRequest, &OAuthError{oauthInvalidGrant, "the code is invalid or expired"}))
+	token_form["code"] = []string{code()}
+	wrong_secret := map[string][]string{}
+	for key, value := range token_form {
+		wrong_secret[key] = value
+	}
+	wrong_secret["client_secret"] = []string{"nope"}
+	assertOk(postOAuthToken(oauth_url+"/token", wrong_secret, http.StatusUnauthorized, &OAuthError{Error: oauthInvalidClient}))
+	token_form["code"] = []string{code()}
+	tokens := &OAuthTokenResponse{}
+	assertOk(postOAuthToken(oauth_url+"/token", token_form, http.StatusOK, tokens))
+	if tokens.TokenType != "Bearer" || tokens.Scope != "openid profile email" {
+		t.Errorf("unexpected token response %+v", *tokens)
+	}
+	id_claims := IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, &id_claims, func(*jwt.Token) (interface{}, error) {
+		key, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+		return ed25519.PublicKey(key), err
+	}, jwt.WithIssuer(url), jwt.WithAudience(app.ClientID))
+	assertOk(err)
+	if id_claims.Subject != fmt.Sprint(user3) || id_claims.Nonce != "n-0S6" || id_claims.PreferredUsername != handle3 || id_claims.Email != email3 {
+		t.Errorf("unexpected ID token claims %+v", id_claims)
+	}
+	app_header := newAuthenticatedHeader(tokens.AccessToken)
+	assertOk(testHttpRequest("GET", app_header, oauth_url+"/userinfo", nil, http.StatusOK, &UserClaims{
+		Subject:           fmt.Sprint(user3),
+		PreferredUsername: handle3,
+		Email:             email3,
+		EmailVerified:     id_claims.EmailVerified,
+	}))
+	// app tokens only get the scopes the user consented to
+	assertOk(testHttpRequest("GET", app_header, timeline_url, nil, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("GET", app_header, users_url+"/me/sessions", nil, http.StatusForbidden, gNoCheck))
+	consents, err := testHttpWithResponse[[]db.Consent]("GET", header, users_url+"/me/consents", nil, http.StatusOK)
+	assertOk(err)
+	if len(*consents) != 1 || (*consents)[0].ClientID != app.ClientID {
+		t.Errorf("expected a consent for the app, got %+v", *consents)
+	}
+	assertOk(testHttpRequest("DELETE", header, users_url+"/me/consents/"+app.ClientID, nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("DELETE", header, users_url+"/me/consents/"+app.ClientID, nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("GET", header, authorize_url, nil, http.StatusOK, &AuthorizeResponse{app.ClientID, "app", []string{"openid", "profile", "email"}, false}))
+	clients, err := testHttpWithResponse[[]OAuthClientResponse]("GET", adminHeader, client_url, nil, http.StatusOK)
+	assertOk(err)
+	if len(*clients) != 1 || (*clients)[0].ClientSecret != "" {
+		t.Errorf("expected the app without its secret, got %+v", *clients)
+	}
+	assertOk(testHttpRequest("DELETE", adminHeader, client_url+"/"+app.ClientID, nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("GET", header, authorize_url, nil, http.StatusBadRequest, gNoCheck))
+
+	// public profiles
+	profile_url := fmt.Sprintf("%s/%d", users_url, user3)
+	displayName := "Follower Three"
+	bio := "I read everything"
+	expectProfile := ProfileResponse{Profile: db.Profile{Id: user3, Handle: handle3, FollowingCount: 1}}
+	assertOk(testHttpRequest("GET", nil, profile_url, nil, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("GET", nil, users_url+"/100", nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("PATCH", nil, users_url+"/me", PatchUserParameters{DisplayName: &displayName}, http.StatusBadRequest, gNoCheck))
+	longBio := strings.Repeat("a", 161)
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Bio: &longBio}, http.StatusBadRequest, gNoCheck))
+	expectProfile.DisplayName = displayName
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{DisplayName: &displayName}, http.StatusOK, &expectProfile))
+	expectProfile.Bio = bio
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Bio: &bio}, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("GET", nil, profile_url, nil, http.StatusOK, &expectProfile))
+	profileFields, err := testHttpWithResponse[map[string]any]("GET", nil, profile_url, nil, http.StatusOK)
+	assertOk(err)
+	if _, ok := (*profileFields)["email"]; ok {
+		t.Errorf("expected public profile to not contain an email, got %+v", *profileFields)
+	}
+
+	// changing the email or password needs the current password
+	email3 = "reader@nomail.com"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Email: &email3}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Email: &email3, CurrentPassword: "wrong password"}, http.StatusUnauthorized, gNoCheck))
+	taken_email := email1
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Email: &taken_email, CurrentPassword: pw3}, http.StatusConflict, gNoCheck))
+	weak_pw := "weak"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Password: &weak_pw, CurrentPassword: pw3}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Email: &email3, CurrentPassword: pw3}, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("POST", header, chirps_url, PostChirpRequest{"new address"}, http.StatusForbidden, gNoCheck))
+	verify(email3)
+	new_pw3 := "taller-giraffe-3"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Password: &new_pw3, CurrentPassword: pw3}, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("POST", nil, login_url, PostUserRequest{email3, pw3}, http.StatusUnauthorized, gNoCheck))
+	pw3 = new_pw3
+	_, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, http.StatusOK)
+	assertOk(err)
+	assertOk(testHttpRequest("GET", nil, profile_url, nil, http.StatusOK, &expectProfile))
+
+	// handles
+	assertOk(testHttpRequest("GET", nil, users_url+"/by-handle/FOLLOWER", nil, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("GET", nil, users_url+"/by-handle/nobody", nil, http.StatusNotFound, gNoCheck))
+	taken := "user_ONE"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &taken}, http.StatusConflict, gNoCheck))
+	invalid := "no spaces allowed"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &invalid}, http.StatusBadRequest, gNoCheck))
+	handle3 = "reader"
+	expectProfile.Handle = handle3
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &handle3}, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("GET", nil, users_url+"/by-handle/follower", nil, http.StatusNotFound, gNoCheck))
+	// changing case only is always allowed, anything else is rate limited
+	handle3 = "Reader"
+	expectProfile.Handle = handle3
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &handle3}, http.StatusOK, &expectProfile))
+	another := "writer"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &another}, http.StatusTooManyRequests, gNoCheck))
+	// a failed change leaves every other field as it was
+	otherBio := "changed along with the handle"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &another, Bio: &otherBio}, http.StatusTooManyRequests, gNoCheck))
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Handle: &taken, Bio: &otherBio}, http.StatusConflict, gNoCheck))
+	otherEmail := "unused@nomail.com"
+	assertOk(testHttpRequest("PATCH", header, users_url+"/me", PatchUserParameters{Email: &otherEmail, Handle: &taken, CurrentPassword: pw3}, http.StatusConflict, gNoCheck))
+	assertOk(testHttpRequest("GET", nil, profile_url, nil, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("POST", nil, login_url, PostUserRequest{otherEmail, pw3}, http.StatusUnauthorized, gNoCheck))
+	_, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostHandleLoginRequest{"READER", pw3}, 200)
+	assertOk(err)
+
+	// avatars
+	assertOk(testHttpRequest("GET", nil, profile_url+"/avatar", nil, http.StatusNotFound, gNoCheck))
+	logo, err := os.ReadFile("assets/logo.png")
+	assertOk(err)
+	avatarReq, err := http.NewRequest("PUT", users_url+"/me/avatar", bytes.NewReader(logo))
+	assertOk(err)
+	avatarReq.Header.Set("Authorization", "Bearer "+login_resp.Token)
+	avatarResp, err := http.DefaultClient.Do(avatarReq)
+	assertOk(err)
+	avatarResp.Body.Close()
+	if avatarResp.StatusCode != http.StatusOK {
+		t.Errorf("expected uploading an avatar to succeed, got %d", avatarResp.StatusCode)
+	}
+	withAvatar, err := testHttpWithResponse[ProfileResponse]("GET", nil, profile_url, nil, http.StatusOK)
+	assertOk(err)
+	if withAvatar.AvatarURL != fmt.Sprintf("/api/users/%d/avatar", user3) {
+		t.Errorf("unexpected avatar url %q", withAvatar.AvatarURL)
+	}
+	avatarResp, err = sendHttpRequest("GET", nil, url+withAvatar.AvatarURL, nil, http.StatusOK)
+	assertOk(err)
+	gotAvatar, err := io.ReadAll(avatarResp.Body)
+	avatarResp.Body.Close()
+	assertOk(err)
+	if !bytes.Equal(gotAvatar, logo) || avatarResp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("expected the uploaded png back, got %d bytes of %s", len(gotAvatar), avatarResp.Header.Get("Content-Type"))
+	}
+	// not an image
+	assertOk(testHttpRequest("PUT", header, users_url+"/me/avatar", "hello", http.StatusUnsupportedMediaType, gNoCheck))
+	assertOk(testHttpRequest("DELETE", header, users_url+"/me/avatar", nil, http.StatusOK, &expectProfile))
+	assertOk(testHttpRequest("GET", nil, profile_url+"/avatar", nil, http.StatusNotFound, gNoCheck))
+
+	// two-factor authentication
+	mfa_url := users_url + "/me/mfa/totp"
+	login_mfa_url := login_url + "/mfa"
+	assertOk(testHttpRequest("POST", header, mfa_url+"/confirm", ConfirmTOTPParameters{"123456"}, http.StatusConflict, gNoCheck))
+	enrollment, err := testHttpWithResponse[EnrollTOTPResponse]("POST", header, mfa_url, nil, http.StatusOK)
+	assertOk(err)
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/Chirpy:") {
+		t.Errorf("unexpected provisioning URI %q", enrollment.ProvisioningURI)
+	}
+	totpSecret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	assertOk(err)
+	// not enabled until confirmed
+	_, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, http.StatusOK)
+	assertOk(err)
+	assertOk(testHttpRequest("POST", header, mfa_url+"/confirm", ConfirmTOTPParameters{"000000"}, http.StatusBadRequest, gNoCheck))
+	confirmed, err := testHttpWithResponse[ConfirmTOTPResponse]("POST", header, mfa_url+"/confirm", ConfirmTOTPParameters{totp.Code(totpSecret, time.Now())}, http.StatusOK)
+	assertOk(err)
+	if len(confirmed.RecoveryCodes) != gRecoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %+v", gRecoveryCodeCount, confirmed.RecoveryCodes)
+	}
+	assertOk(testHttpRequest("POST", header, mfa_url, nil, http.StatusConflict, gNoCheck))
+	loginMFA := func(code string, status int) *LoginSuccessResponse {
+		challenge, err := testHttpWithResponse[MFAChallengeResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, http.StatusOK)
+		assertOk(err)
+		if !challenge.MFARequired || challenge.MFAToken == "" {
+			t.Fatalf("expected an MFA challenge, got %+v", *challenge)
+		}
+		if status != http.StatusOK {
+			assertOk(testHttpRequest("POST", nil, login_mfa_url, PostLoginMFAParameters{MFAToken: challenge.MFAToken, Code: code}, status, gNoCheck))
+			// a failed attempt uses up the challenge
+			assertOk(testHttpRequest("POST", nil, login_mfa_url, PostLoginMFAParameters{MFAToken: challenge.MFAToken, Code: code}, http.StatusUnauthorized, gNoCheck))
+			return nil
+		}
+		tokens, err := testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_mfa_url, PostLoginMFAParameters{MFAToken: challenge.MFAToken, Code: code}, status)
+		assertOk(err)
+		return tokens
+	}
+	loginMFA("000000", http.StatusUnauthorized)
+	// the code used for confirming can't be used again, the next one can
+	loginMFA(totp.Code(totpSecret, time.Now().Add(-totp.Period*time.Second)), http.StatusUnauthorized)
+	if tokens := loginMFA(totp.Code(totpSecret, time.Now().Add(totp.Period*time.Second)), http.StatusOK); tokens.Id != user3 {
+		t.Errorf("expected to log in as user %d, got %+v", user3, *tokens)
+	}
+	loginMFA(strings.ToUpper(confirmed.RecoveryCodes[0]), http.StatusOK)
+	loginMFA(confirmed.RecoveryCodes[0], http.StatusUnauthorized)
+	// guessing the password locks the account out, the reused recovery code
+	// above was the first failure
+	for i := 0; i < gDefaultAccountFreeFailures; i++ {
+		assertOk(testHttpRequest("DELETE", header, mfa_url, DisableTOTPParameters{"wrong password", confirmed.RecoveryCodes[1]}, http.StatusUnauthorized, gNoCheck))
+	}
+	assertOk(testHttpRequest("DELETE", header, mfa_url, DisableTOTPParameters{pw3, confirmed.RecoveryCodes[1]}, http.StatusTooManyRequests, gNoCheck))
+	assertOk(testHttpRequest("DELETE", adminHeader, fmt.Sprintf("%s/admin/lockouts/users/%d", url, user3), nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("DELETE", header, mfa_url, DisableTOTPParameters{pw3, confirmed.RecoveryCodes[1]}, http.StatusOK, gNoCheck))
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, http.StatusOK)
+	assertOk(err)
+	if login_resp.Token == "" {
+		t.Errorf("expected tokens right away after disabling two-factor authentication")
+	}
+
+	// account deletion
+	refreshToken3 := login_resp.RefreshToken
+	for i := 0; i <= gDefaultAccountFreeFailures; i++ {
+		assertOk(testHttpRequest("DELETE", header, users_url+"/me", DeleteUserParameters{"wrong password"}, http.StatusUnauthorized, gNoCheck))
+	}
+	assertOk(testHttpRequest("DELETE", header, users_url+"/me", DeleteUserParameters{pw3}, http.StatusTooManyRequests, gNoCheck))
+	assertOk(testHttpRequest("DELETE", adminHeader, fmt.Sprintf("%s/admin/lockouts/users/%d", url, user3), nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("DELETE", header, users_url+"/me", DeleteUserParameters{pw3}, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("GET", nil, profile_url, nil, http.StatusNotFound, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(refreshToken3), refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	assertOk(testHttpRequest("GET", header, timeline_url, nil, http.StatusUnauthorized, gNoCheck))
+	webhook_req.Data.UserID = user3
+	assertOk(testHttpRequest("POST", map[string]string{"Authorization": "ApiKey " + polkaApiKey}, polka_webhooks_url, webhook_req, http.StatusNotFound, gNoCheck))
+	followers, err = testHttpWithResponse[[]db.Follow]("GET", nil, users_url+"/1/followers", nil, http.StatusOK)
+	assertOk(err)
+	if len(*followers) != 0 {
+		t.Errorf("expected deleted user to no longer follow user 1, got %+v", *followers)
+	}
+	// the ID of a deleted user is not reused
+	newUser, err := testHttpWithResponse[db.UserDTO]("POST", nil, users_url, SignupRequest{email3, handle3, pw3}, 201)
+	assertOk(err)
+	if newUser.Id == user3 {
+		t.Errorf("expected a new ID for a new account, got the deleted user's ID %d", user3)
+	}
+
+	// logging in with the company identity provider creates an account
+	api_url := url + "/api"
+	employee := mockAccount{Subject: "emp-1", Email: "emp@corp.example", EmailVerified: true, PreferredUsername: "emp.one"}
+	sso_resp, err := ssoLogin(api_url, idp, employee, http.StatusOK)
+	assertOk(err)
+	if sso_resp.Email != employee.Email || sso_resp.Token == "" || sso_resp.RefreshToken == "" {
+		t.Errorf("expected tokens for a new account, got %+v", *sso_resp)
+	}
+	assertOk(testHttpRequest("GET", newAuthenticatedHeader(sso_resp.Token), users_url+"/me", nil, http.StatusOK,
+		&ProfileResponse{Profile: db.Profile{Id: sso_resp.Id, Handle: "emp_one"}}))
+	again, err := ssoLogin(api_url, idp, employee, http.StatusOK)
+	assertOk(err)
+	if again.Id != sso_resp.Id {
+		t.Errorf("expected the same account on the next login, got %d and %d", sso_resp.Id, again.Id)
+	}
+	// existing accounts are linked by email, but only if the provider checked it
+	_, err = ssoLogin(api_url, idp, mockAccount{Subject: "emp-2", Email: email2}, http.StatusConflict)
+	assertOk(err)
+	linked, err := ssoLogin(api_url, idp, mockAccount{Subject: "emp-2", Email: email2, EmailVerified: true}, http.StatusOK)
+	assertOk(err)
+	if linked.Id != 2 {
+		t.Errorf("expected to be linked to user 2, got %+v", *linked)
+	}
+	_, err = ssoLogin(api_url, idp, mockAccount{Subject: "emp-3"}, http.StatusBadRequest)
+	assertOk(err)
+	// nor if the existing account never verified the address
+	_, err = ssoLogin(api_url, idp, mockAccount{Subject: "emp-5", Email: email3, EmailVerified: true}, http.StatusConflict)
+	assertOk(err)
+	// a handle is no email
+	_, err = ssoLogin(api_url, idp, mockAccount{Subject: "emp-4", Email: "user_ONE", EmailVerified: true}, http.StatusBadRequest)
+	assertOk(err)
+	// the callback only works in the browser that started the login
+	assertOk(testHttpRequest("POST", nil, api_url+"/sso/callback", SSOCallbackParameters{Code: "code", State: "state"}, http.StatusBadRequest, gNoCheck))
+
+	// browser sessions keep the tokens in cookies
+	cookie_login, err := sendHttpRequest("POST", nil, login_url, PostLoginParameters{Email: email3, Password: pw3, Cookies: true}, http.StatusOK)
+	assertOk(err)
+	var cookie_resp LoginSuccessResponse
+	assertOk(json.NewDecoder(cookie_login.Body).Decode(&cookie_resp))
+	cookie_login.Body.Close()
+	if cookie_resp.Token != "" || cookie_resp.RefreshToken != "" || cookie_resp.CSRFToken == "" {
+		t.Errorf("expected only the CSRF token in the body, got %+v", cookie_resp)
+	}
+	cookies := sessionCookies(cookie_login.Cookies())
+	for name, cookie := range cookies {
+		if !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.HttpOnly != (name != gCSRFCookie) {
+			t.Errorf("unexpected attributes of cookie %+v", *cookie)
+		}
+	}
+	if len(cookies) != 3 || cookies[gCSRFCookie].Value != cookie_resp.CSRFToken {
+		t.Errorf("expected access, refresh and CSRF cookies, got %+v", cookies)
+	}
+	cookie_header := map[string]string{"Cookie": cookieHeader(cookies)}
+	csrf_header := map[string]string{"Cookie": cookieHeader(cookies), gCSRFHeader: cookie_resp.CSRFToken}
+	assertOk(testHttpRequest("GET", cookie_header, users_url+"/me", nil, http.StatusOK, gNoCheck))
+	bio = "cookie monster"
+	assertOk(testHttpRequest("PATCH", cookie_header, users_url+"/me", PatchUserParameters{Bio: &bio}, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("PATCH", map[string]string{"Cookie": cookieHeader(cookies), gCSRFHeader: "forged"}, users_url+"/me", PatchUserParameters{Bio: &bio}, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("PATCH", csrf_header, users_url+"/me", PatchUserParameters{Bio: &bio}, http.StatusOK, gNoCheck))
+	// refreshing replaces the cookies, the old refresh token is spent
+	assertOk(testHttpRequest("POST", cookie_header, url+"/api/session/refresh", nil, http.StatusForbidden, gNoCheck))
+	refreshed, err := sendHttpRequest("POST", csrf_header, url+"/api/session/refresh", nil, http.StatusOK)
+	assertOk(err)
+	refreshed.Body.Close()
+	new_cookies := sessionCookies(refreshed.Cookies())
+	if new_cookies[gRefreshCookie] == nil || new_cookies[gRefreshCookie].Value == cookies[gRefreshCookie].Value ||
+		new_cookies[gCSRFCookie].Value != cookie_resp.CSRFToken {
+		t.Errorf("expected a new refresh token and the same CSRF token, got %+v", new_cookies)
+	}
+	assertOk(testHttpRequest("POST", csrf_header, url+"/api/session/refresh", nil, http.StatusUnauthorized, gNoCheck))
+	// reusing the old token revoked the session
+	new_csrf_header := map[string]string{"Cookie": cookieHeader(new_cookies), gCSRFHeader: cookie_resp.CSRFToken}
+	assertOk(testHttpRequest("POST", new_csrf_header, url+"/api/session/refresh", nil, http.StatusUnauthorized, gNoCheck))
+	// logging out revokes the session and clears the cookies
+	cookie_login, err = sendHttpRequest("POST", nil, login_url, PostLoginParameters{Email: email3, Password: pw3, Cookies: true}, http.StatusOK)
+	assertOk(err)
+	assertOk(json.NewDecoder(cookie_login.Body).Decode(&cookie_resp))
+	cookie_login.Body.Close()
+	cookies = sessionCookies(cookie_login.Cookies())
+	// the CSRF token of another session doesn't work, nor does a planted cookie
+	assertOk(testHttpRequest("PATCH", map[string]string{"Cookie": cookieHeader(cookies), gCSRFHeader: new_csrf_header[gCSRFHeader]}, users_url+"/me", PatchUserParameters{Bio: &bio}, http.StatusForbidden, gNoCheck))
+	planted := *cookies[gCSRFCookie]
+	planted.Value = "planted"
+	assertOk(testHttpRequest("PATCH", map[string]string{"Cookie": cookieHeader(map[string]*http.Cookie{gAccessCookie: cookies[gAccessCookie], gCSRFCookie: &planted}), gCSRFHeader: planted.Value}, users_url+"/me", PatchUserParameters{Bio: &bio}, http.StatusForbidden, gNoCheck))
+	csrf_header = map[string]string{"Cookie": cookieHeader(cookies), gCSRFHeader: cookie_resp.CSRFToken}
+	logout, err := sendHttpRequest("POST", csrf_header, url+"/api/session/logout", nil, http.StatusOK)
+	assertOk(err)
+	logout.Body.Close()
+	for _, cookie := range logout.Cookies() {
+		if cookie.MaxAge >= 0 {
+			t.Errorf("expected cookie %s to be cleared, got %+v", cookie.Name, *cookie)
+		}
+	}
+	assertOk(testHttpRequest("POST", csrf_header, url+"/api/session/refresh", nil, http.StatusUnauthorized, gNoCheck))
+
+	// token introspection
+	introspect_url := url + "/api/introspect"
+	introspect := func(token string) IntrospectionResponse {
+		resp, err := introspectToken(introspect_url, "test-introspection-key", token, http.StatusOK)
+		assertOk(err)
+		return *resp
+	}
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, 200)
+	assertOk(err)
+	_, err = introspectToken(introspect_url, "wrong", login_resp.Token, http.StatusUnauthorized)
+	assertOk(err)
+	_, err = introspectToken(introspect_url, "test-introspection-key", "", http.StatusBadRequest)
+	assertOk(err)
+	active := introspect(login_resp.Token)
+	if !active.Active || active.TokenType != tokenTypeAccess || active.Subject != fmt.Sprint(newUser.Id) ||
+		active.Username != handle3 || active.ExpiresAt <= time.Now().Unix() || active.Scope != "" {
+		t.Errorf("expected an active access token of user %d, got %+v", newUser.Id, active)
+	}
+	if active := introspect(login_resp.RefreshToken); !active.Active || active.TokenType != tokenTypeRefresh {
+		t.Errorf("expected an active refresh token, got %+v", active)
+	}
+	if inactive := introspect("garbage"); inactive != (IntrospectionResponse{}) {
+		t.Errorf("expected only active=false for garbage, got %+v", inactive)
+	}
+	refresh_resp, err = testHttpWithResponse[PostRefreshResponse]("POST", newAuthenticatedHeader(login_resp.RefreshToken), refresh_url, empty_req, http.StatusOK)
+	assertOk(err)
+	if introspect(login_resp.RefreshToken).Active || !introspect(refresh_resp.RefreshToken).Active {
+		t.Errorf("expected only the latest refresh token to be active")
+	}
+	reader_key, err = testHttpWithResponse[APIKeyResponse]("POST", newAuthenticatedHeader(login_resp.Token), api_keys_url, PostAPIKeyParameters{"reader", []string{scopeChirpsRead}}, http.StatusCreated)
+	assertOk(err)
+	if active := introspect(reader_key.Key); !active.Active || active.TokenType != tokenTypeAPIKey || active.Scope != scopeChirpsRead {
+		t.Errorf("expected an active API key, got %+v", active)
+	}
+
+	// admins revoke all tokens of a user
+	revoke_tokens_url := fmt.Sprintf("%s/admin/users/%d/revoke-tokens", url, newUser.Id)
+	assertOk(testHttpRequest("POST", nil, revoke_tokens_url, nil, http.StatusUnauthorized, gNoCheck))
+	assertOk(testHttpRequest("POST", adminHeader, url+"/admin/users/100/revoke-tokens", nil, http.StatusNotFound, gNoCheck))
+	revoked, err := testHttpWithResponse[RevokeUserTokensResponse]("POST", adminHeader, revoke_tokens_url, nil, http.StatusOK)
+	assertOk(err)
+	if introspect(login_resp.Token).Active || introspect(refresh_resp.Token).Active || introspect(refresh_resp.RefreshToken).Active {
+		t.Errorf("expected the tokens issued before %s to be revoked", revoked.TokensValidAfter)
+	}
+	assertOk(testHttpRequest("GET", newAuthenticatedHeader(refresh_resp.Token), users_url+"/me", nil, http.StatusUnauthorized, gNoCheck))
+	assertOk(testHttpRequest("POST", newAuthenticatedHeader(refresh_resp.RefreshToken), refresh_url, empty_req, http.StatusUnauthorized, gNoCheck))
+	// API keys are revoked one by one
+	if !introspect(reader_key.Key).Active {
+		t.Errorf("expected the API key to stay active")
+	}
+	// revoking up to an earlier time doesn't bring tokens back, nor affect newer ones
+	login_resp, err = testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{email3, pw3}, 200)
+	assertOk(err)
+	again_revoked, err := testHttpWithResponse[RevokeUserTokensResponse]("POST", adminHeader, revoke_tokens_url, PostRevokeUserTokensParameters{time.Now().Add(-time.Hour)}, http.StatusOK)
+	assertOk(err)
+	if !again_revoked.TokensValidAfter.Equal(revoked.TokensValidAfter) || !introspect(login_resp.Token).Active {
+		t.Errorf("expected tokens to stay valid after %s, got %s", revoked.TokensValidAfter, again_revoked.TokensValidAfter)
+	}
+
+	// roles
+	var out bytes.Buffer
+	if err := createAdmin(serverCfg, []string{"root@chirpy.example", "chief"}, strings.NewReader("short\n"), &out); err == nil {
+		t.Errorf("expected the password policy to apply")
+	}
+	assertOk(createAdmin(serverCfg, []string{"root@chirpy.example", "chief"}, strings.NewReader("admin-pass-123\n"), &out))
+	if err := createAdmin(serverCfg, []string{"root2@chirpy.example", "chief2"}, strings.NewReader("admin-pass-123\n"), &out); err != db.ErrAdminExists {
+		t.Errorf(`Expected error to be %s, got %v`, db.ErrAdminExists, err)
+	}
+	admin_login, err := testHttpWithResponse[LoginSuccessResponse]("POST", nil, login_url, PostUserRequest{"root@chirpy.example", "admin-pass-123"}, http.StatusOK)
+	assertOk(err)
+	var admin_claims chirpyClaims
+	_, _, err = jwt.NewParser().ParseUnverified(admin_login.Token, &admin_claims)
+	assertOk(err)
+	if admin_claims.Role != db.RoleAdmin {
+		t.Errorf("expected the access token to carry the admin role, got %q", admin_claims.Role)
+	}
+	// times are whole seconds, as other verifiers expect
+	raw_claims := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(admin_login.Token, raw_claims)
+	assertOk(err)
+	if iat, ok := raw_claims["iat"].(float64); !ok || iat != float64(int64(iat)) {
+		t.Errorf("expected iat to be whole seconds, got %v", raw_claims["iat"])
+	}
+	admin_user_header := newAuthenticatedHeader(admin_login.Token)
+	assertOk(testHttpRequest("GET", admin_user_header, url+"/admin/metrics", nil, http.StatusOK, gNoCheck))
+
+	role_url := fmt.Sprintf("%s/admin/users/%d/role", url, newUser.Id)
+	moderator_header := newAuthenticatedHeader(login_resp.Token)
+	assertOk(testHttpRequest("GET", moderator_header, moderation_url, nil, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("PUT", admin_user_header, role_url, PutUserRoleParameters{"superuser"}, http.StatusBadRequest, gNoCheck))
+	assertOk(testHttpRequest("PUT", moderator_header, role_url, PutUserRoleParameters{db.RoleAdmin}, http.StatusForbidden, gNoCheck))
+	moderator, err := testHttpWithResponse[db.UserDTO]("PUT", admin_user_header, role_url, PutUserRoleParameters{db.RoleModerator}, http.StatusOK)
+	assertOk(err)
+	if moderator.Role != db.RoleModerator {
+		t.Errorf("expected user %d to be a moderator, got %+v", newUser.Id, *moderator)
+	}
+	// the current role counts, not the one in the token
+	assertOk(testHttpRequest("GET", moderator_header, moderation_url, nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("GET", moderator_header, url+"/admin/metrics", nil, http.StatusForbidden, gNoCheck))
+	// API keys never act with the role of their user
+	assertOk(testHttpRequest("GET", map[string]string{"Authorization": "ApiKey " + reader_key.Key}, moderation_url, nil, http.StatusForbidden, gNoCheck))
+	assertOk(testHttpRequest("PUT", adminHeader, fmt.Sprintf("%s/admin/users/%d/role", url, admin_login.Id), PutUserRoleParameters{db.RoleUser}, http.StatusConflict, gNoCheck))
+	// nor can the last admin delete their account
+	assertOk(testHttpRequest("DELETE", admin_user_header, users_url+"/me", DeleteUserParameters{"admin-pass-123"}, http.StatusConflict, gNoCheck))
+	assertOk(testHttpRequest("GET", admin_user_header, url+"/admin/metrics", nil, http.StatusOK, gNoCheck))
+	assertOk(testHttpRequest("PUT", adminHeader, url+"/admin/users/100/role", PutUserRoleParameters{db.RoleUser}, http.StatusNotFound, gNoCheck))
+}
+
+func TestApplyProfanityPolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		body       string
+		warning    string
+		expectBody string
+		expectWarn string
+	}{
+		{profanityPolicyMask, "what a kerfuffle", "", "what a ****", ""},
+		{profanityPolicyMask, "what a kerfuffle", "rant", "what a ****", "rant"},
+		{profanityPolicyWarn, "what a kerfuffle", "", "what a kerfuffle", gProfanityWarning},
+		{profanityPolicyWarn, "what a kerfuffle", "rant", "what a kerfuffle", "rant"},
+		{profanityPolicyWarn, "all clean", "", "all clean", ""},
+	}
+
+	filter, err := newProfanityFilter("")
+	if err != nil {
+		t.Fatalf("creating profanity filter: %s", err)
+	}
+
+	for _, test := range tests {
+		body, warning := applyProfanityPolicy(filter, test.policy, test.body, test.warning)
+		if body != test.expectBody || warning != test.expectWarn {
+			t.Errorf("applyProfanityPolicy(%q, %q, %q) = (%q, %q), expected (%q, %q)",
+				test.policy, test.body, test.warning, body, warning, test.expectBody, test.expectWarn)
+		}
+	}
 }
 
 func testHttpRequestString(method string, headers map[string]string, url string, req any, code int, expect string) error {
@@ -253,17 +1173,92 @@ func testHttpRequestString(method string, headers map[string]string, url string,
 	return nil
 }
 
+// records emails instead of sending them
+type testMailer struct {
+	lock *sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *testMailer) Send(msg mailer.Message) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+var gMailTokenRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// returns the token in the last email sent to addr, or "" if there is none
+func (m *testMailer) lastToken(addr string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == addr {
+			return gMailTokenRegexp.FindString(m.sent[i].Body)
+		}
+	}
+
+	return ""
+}
+
+func (m *testMailer) count() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.sent)
+}
+
+// waits for an email to addr after the first n emails sent and returns its token
+func (m *testMailer) waitToken(addr string, n int) string {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		m.lock.Lock()
+		for _, msg := range m.sent[n:] {
+			if msg.To == addr {
+				m.lock.Unlock()
+				return gMailTokenRegexp.FindString(msg.Body)
+			}
+		}
+		m.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return ""
+}
+
 type PostChirpRequest struct {
 	Body string `json:"body"`
 }
+type PostChirpRequestWithWarning struct {
+	Body           string `json:"body"`
+	ContentWarning string `json:"content_warning"`
+	Sensitive      bool   `json:"sensitive"`
+}
 type genericFailMessage struct {
 	Error string `json:"error"`
 }
+type SignupRequest struct {
+	Email    string `json:"email"`
+	Handle   string `json:"handle"`
+	Password string `json:"password"`
+}
+type PostHandleLoginRequest struct {
+	Handle   string `json:"handle"`
+	Password string `json:"password"`
+}
 type PostUserRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
+type PutUserRequest struct {
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+}
+
 func sendHttpRequest(method string, header map[string]string, url string, req any, code int) (*http.Response, error) {
 	var dat []byte
 	var err error
@@ -344,6 +1339,111 @@ func testHttpWithResponse[T any](method string, headers map[string]string, url s
 	return &got, nil
 }
 
+// asks the introspection endpoint at url about token
+func introspectToken(url, apiKey, token string, code int) (*IntrospectionResponse, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(neturl.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "ApiKey "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf(`Posting to %s: %w`, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != code {
+		return nil, fmt.Errorf("Expected status code %d, got %d", code, resp.StatusCode)
+	}
+	if code != http.StatusOK {
+		return nil, nil
+	}
+
+	var got IntrospectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		return nil, fmt.Errorf(`Decoding response: %w`, err)
+	}
+	return &got, nil
+}
+
+// the session cookies by name
+func sessionCookies(cookies []*http.Cookie) map[string]*http.Cookie {
+	byName := map[string]*http.Cookie{}
+	for _, cookie := range cookies {
+		switch cookie.Name {
+		case gAccessCookie, gRefreshCookie, gCSRFCookie:
+			byName[cookie.Name] = cookie
+		}
+	}
+	return byName
+}
+
+// a Cookie header sending cookies back
+func cookieHeader(cookies map[string]*http.Cookie) string {
+	pairs := []string{}
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// the query of an authorization request
+func authorizeQuery(params AuthorizeParameters) string {
+	return neturl.Values{
+		"response_type":         {params.ResponseType},
+		"client_id":             {params.ClientID},
+		"redirect_uri":          {params.RedirectURI},
+		"scope":                 {params.Scope},
+		"state":                 {params.State},
+		"nonce":                 {params.Nonce},
+		"code_challenge":        {params.CodeChallenge},
+		"code_challenge_method": {params.CodeChallengeMethod},
+	}.Encode()
+}
+
+// the code and state the client gets redirected back with
+func redirectCode(redirectTo string) (code, state string) {
+	uri, err := neturl.Parse(redirectTo)
+	if err != nil {
+		return "", ""
+	}
+	return uri.Query().Get("code"), uri.Query().Get("state")
+}
+
+// posts a form to the OAuth token endpoint and decodes the response into
+// expect, or compares it with expect if it is an OAuthError
+func postOAuthToken(url string, form neturl.Values, code int, expect any) error {
+	resp, err := http.PostForm(url, form)
+	if err != nil {
+		return fmt.Errorf(`Posting to %s: %w`, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != code {
+		return fmt.Errorf("Expected status code %d, got %d", code, resp.StatusCode)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		return fmt.Errorf("Expected token responses not to be cached")
+	}
+
+	if oauthErr, ok := expect.(*OAuthError); ok {
+		var got OAuthError
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			return fmt.Errorf(`Decoding response: %w`, err)
+		}
+		if got != *oauthErr {
+			return fmt.Errorf(`Expected %+v\nGot %+v`, *oauthErr, got)
+		}
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(expect); err != nil {
+		return fmt.Errorf(`Decoding response: %w`, err)
+	}
+	return nil
+}
+
 func newAuthenticatedHeader(jwt_token string) map[string]string {
 	return map[string]string{
 		"Authorization": "Bearer " + jwt_token,
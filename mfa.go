@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/horriblename/go-web-server/db"
+	"github.com/horriblename/go-web-server/totp"
+)
+
+const (
+	gTOTPIssuer         = "Chirpy"
+	gTOTPSkew           = 1 // time steps
+	gMFAChallengeTTL    = 5 * time.Minute
+	gRecoveryCodeCount  = 10
+	gRecoveryCodeLength = 10
+	gMFAKeySize         = 32 // AES-256
+)
+
+var ErrBadSealedSecret = errors.New("sealed secret is malformed")
+
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+type PostLoginMFAParameters struct {
+	MFAToken string `json:"mfa_token"`
+	// a TOTP code or a recovery code
+	Code string `json:"code"`
+	// see PostLoginParameters
+	Cookies bool `json:"cookies"`
+}
+
+type EnrollTOTPResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type ConfirmTOTPParameters struct {
+	Code string `json:"code"`
+}
+
+type ConfirmTOTPResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DisableTOTPParameters struct {
+	Password string `json:"password"`
+	// a TOTP code or a recovery code
+	Code string `json:"code"`
+}
+
+// derives the key TOTP secrets are encrypted with from the JWT secret, for
+// when no key of its own is configured
+func deriveMFAKey(jwtSecret []byte) []byte {
+	sum := sha256.Sum256(append([]byte("chirpy totp secret encryption\x00"), jwtSecret...))
+	return sum[:]
+}
+
+// encrypts a TOTP secret with AES-GCM. The user ID is authenticated along with
+// it, so a secret copied to another user doesn't decrypt.
+func sealSecret(key []byte, userID int, secret []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, secret, []byte(strconv.Itoa(userID))), nil
+}
+
+func openSecret(key []byte, userID int, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrBadSealedSecret
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(userID)))
+}
+
+// generates recovery codes formatted like "abcde-fghij"
+func generateRecoveryCodes() ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, gRecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(raw))[:gRecoveryCodeLength]
+		codes[i] = code[:gRecoveryCodeLength/2] + "-" + code[gRecoveryCodeLength/2:]
+	}
+
+	return codes, nil
+}
+
+// recovery codes are compared ignoring case, dashes and spaces
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totp.Digits {
+		return false
+	}
+	_, err := strconv.Atoi(code)
+	return err == nil
+}
+
+// checks a TOTP code or a recovery code of a user with two-factor
+// authentication enabled. Each code is accepted only once.
+func (cfg *apiConfig) checkSecondFactor(user *db.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	if isTOTPCode(code) {
+		secret, err := openSecret(cfg.mfaKey, user.Id, user.TOTPSecret)
+		if err != nil {
+			return false, fmt.Errorf("decrypting TOTP secret: %w", err)
+		}
+
+		step, ok := totp.Validate(secret, code, time.Now(), gTOTPSkew)
+		if !ok {
+			return false, nil
+		}
+		if err := cfg.db.UseTOTPStep(user.Id, step); err == db.ErrTOTPCodeReused {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if err := cfg.db.UseRecoveryCode(user.Id, normalizeRecoveryCode(code)); err == db.ErrInvalidRecoveryCode {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// POST /api/login/mfa
+//
+// the second step of logging in with two-factor authentication, exchanges the
+// token from /api/login and a code for the usual tokens
+func (cfg *apiConfig) handlePostLoginMFA(w http.ResponseWriter, req *http.Request) {
+	var params PostLoginMFAParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.db.ConsumeMFAChallenge(params.MFAToken)
+	if err == db.ErrInvalidToken {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if err != nil {
+		fmt.Printf("consuming MFA challenge: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	// wrong codes count as failed logins, the password alone doesn't reset them
+	account, ip := accountKey(user.Id, ""), clientIP(req)
+	if wait := cfg.loginLimiter.Blocked(account, ip); wait > 0 {
+		respondLockedOut(w, wait)
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(user, params.Code)
+	if err != nil {
+		fmt.Printf("checking second factor of user %d: %s\n", user.Id, err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	if !ok {
+		cfg.loginLimiter.Failure(account, ip)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	cfg.loginLimiter.Success(account)
+
+	cfg.respondWithLoginTokens(w, req, db.NewUserDTO(*user), params.Cookies)
+}
+
+// POST /api/users/me/mfa/totp
+//
+// starts enrolling in two-factor authentication. The secret only takes effect
+// once a code for it is sent to /api/users/me/mfa/totp/confirm.
+func (cfg *apiConfig) handlePostEnrollTOTP(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		fmt.Printf("generating TOTP secret: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	sealed, err := sealSecret(cfg.mfaKey, userID, secret)
+	if err != nil {
+		fmt.Printf("encrypting TOTP secret: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	err = cfg.db.BeginTOTPEnrollment(userID, sealed)
+	if err == db.ErrMFAAlreadyEnabled {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
+		fmt.Printf("storing TOTP secret of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, EnrollTOTPResponse{
+		Secret:          totp.EncodeSecret(secret),
+		ProvisioningURI: totp.ProvisioningURI(gTOTPIssuer, user.Email, secret),
+	})
+}
+
+// POST /api/users/me/mfa/totp/confirm
+//
+// enables two-factor authentication with a code for the secret from
+// enrollment, and returns the recovery codes. They are only shown this once.
+func (cfg *apiConfig) handlePostConfirmTOTP(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params ConfirmTOTPParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	if user.PendingTOTPSecret == nil {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: db.ErrNoPendingTOTP.Error()})
+		return
+	}
+
+	secret, err := openSecret(cfg.mfaKey, userID, user.PendingTOTPSecret)
+	if err != nil {
+		fmt.Printf("decrypting TOTP secret of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	step, ok := totp.Validate(secret, strings.TrimSpace(params.Code), time.Now(), gTOTPSkew)
+	if !ok {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Invalid code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		fmt.Printf("generating recovery codes: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = normalizeRecoveryCode(code)
+	}
+
+	err = cfg.db.EnableTOTP(userID, step, normalized)
+	if err == db.ErrNoPendingTOTP {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
+		fmt.Printf("enabling TOTP for user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, ConfirmTOTPResponse{RecoveryCodes: codes})
+}
+
+// DELETE /api/users/me/mfa/totp
+//
+// turns two-factor authentication off, needs both the password and a code
+func (cfg *apiConfig) handleDeleteTOTP(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params DisableTOTPParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if !cfg.confirmPassword(w, req, userID, params.Password) {
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	if user.TOTPSecret == nil {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: db.ErrMFANotEnabled.Error()})
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(user, params.Code)
+	if err != nil {
+		fmt.Printf("checking second factor of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := cfg.db.DisableTOTP(userID); err != nil && err != db.ErrMFANotEnabled {
+		fmt.Printf("disabling TOTP for user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealSecret(t *testing.T) {
+	key := deriveMFAKey([]byte("secret"))
+	secret := []byte("12345678901234567890")
+
+	sealed, err := sealSecret(key, 1, secret)
+	if err != nil {
+		t.Fatalf("sealSecret: %s", err)
+	}
+	if bytes.Contains(sealed, secret) {
+		t.Errorf("expected sealed secret to not contain the plain secret")
+	}
+
+	opened, err := openSecret(key, 1, sealed)
+	if err != nil || !bytes.Equal(opened, secret) {
+		t.Errorf("expected to get the secret back, got %q (%v)", opened, err)
+	}
+	if _, err := openSecret(key, 2, sealed); err == nil {
+		t.Errorf("expected a secret sealed for another user to not open")
+	}
+	if _, err := openSecret(deriveMFAKey([]byte("other")), 1, sealed); err == nil {
+		t.Errorf("expected a secret sealed with another key to not open")
+	}
+	if _, err := openSecret(key, 1, sealed[:4]); err == nil {
+		t.Errorf("expected a truncated secret to not open")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes: %s", err)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != gRecoveryCodeLength+1 || code[gRecoveryCodeLength/2] != '-' {
+			t.Errorf("unexpected recovery code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate recovery code %q", code)
+		}
+		seen[code] = true
+	}
+
+	if got := normalizeRecoveryCode("ABCDE-fghij "); got != "abcdefghij" {
+		t.Errorf("normalizeRecoveryCode = %q, expected %q", got, "abcdefghij")
+	}
+}
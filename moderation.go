@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	db "github.com/horriblename/go-web-server/db"
+)
+
+const gDefaultReportThreshold = 3
+
+type PostChirpReportParameters struct {
+	Reason  db.ReportReason `json:"reason"`
+	Comment string          `json:"comment"`
+}
+
+type PostModerationParameters struct {
+	Action        db.ModerationAction `json:"action"`
+	SuspendAuthor bool                `json:"suspend_author"`
+}
+
+func (cfg *apiConfig) handlePostChirpReport(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params PostChirpReportParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if !db.ValidReportReason(params.Reason) {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Unknown report reason"})
+		return
+	}
+
+	chirpID, ok := req.Context().Value("chirpID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	report, err := cfg.db.ReportChirp(chirpID, userID, params.Reason, params.Comment, cfg.reportThreshold)
+	if err == db.ErrChirpNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err == db.ErrAlreadyReported {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: "Chirp already reported"})
+		return
+	} else if err != nil {
+		fmt.Printf("reporting chirp %d: %s\n", chirpID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+func (cfg *apiConfig) handleGetModerationQueue(w http.ResponseWriter, req *http.Request) {
+	queue, err := cfg.db.GetModerationQueue()
+	if err != nil {
+		fmt.Printf("getting moderation queue: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, queue)
+}
+
+func (cfg *apiConfig) handlePostModerationAction(w http.ResponseWriter, req *http.Request) {
+	var params PostModerationParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	chirpID, ok := req.Context().Value("chirpID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err == db.ErrChirpNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("getting chirp with ID %d: %s\n", chirpID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	err = cfg.db.ModerateChirp(chirpID, params.Action)
+	if err == db.ErrUnknownModerationAction {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Unknown moderation action"})
+		return
+	} else if err != nil {
+		fmt.Printf("moderating chirp %d: %s\n", chirpID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	if params.SuspendAuthor {
+		if err := cfg.db.SetUserSuspended(chirp.AuthorID, true); err != nil && err != db.ErrUserNotFound {
+			fmt.Printf("suspending user %d: %s\n", chirp.AuthorID, err)
+			respondWithError(w, http.StatusInternalServerError, "Database Error")
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// returns a handler that suspends (or reinstates) the user in the URL
+func (cfg *apiConfig) handleSetUserSuspended(suspended bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		userID, ok := req.Context().Value("userID").(int)
+		if !ok {
+			respondWithError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+
+		err := cfg.db.SetUserSuspended(userID, suspended)
+		if err == db.ErrUserNotFound {
+			respondWithError(w, http.StatusNotFound, "Not Found")
+			return
+		} else if err != nil {
+			fmt.Printf("suspending user %d: %s\n", userID, err)
+			respondWithError(w, http.StatusInternalServerError, "Database Error")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, struct{}{})
+	}
+}
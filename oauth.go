@@ -0,0 +1,617 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	jwt "github.com/golang-jwt/jwt/v5"
+	db "github.com/horriblename/go-web-server/db"
+)
+
+const (
+	gAuthorizationCodeTTL  = 5 * time.Minute
+	gMaxOAuthClientNameLen = 50
+	// RFC 7636 section 4.1
+	gMinCodeVerifierLength = 43
+	gMaxCodeVerifierLength = 128
+)
+
+// scopes only OAuth clients ask for, in addition to gAPIKeyScopes
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+var gOIDCScopes = []string{scopeOpenID, scopeProfile, scopeEmail}
+
+// OAuth error codes, RFC 6749 sections 4.1.2.1 and 5.2
+const (
+	oauthInvalidRequest          = "invalid_request"
+	oauthInvalidClient           = "invalid_client"
+	oauthInvalidGrant            = "invalid_grant"
+	oauthInvalidScope            = "invalid_scope"
+	oauthUnsupportedResponseType = "unsupported_response_type"
+	oauthUnsupportedGrantType    = "unsupported_grant_type"
+	oauthAccessDenied            = "access_denied"
+)
+
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// the query of the authorization request, sent on to the API by the consent
+// page of the web app
+type AuthorizeParameters struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+type PostAuthorizeParameters struct {
+	AuthorizeParameters
+	// whether the user allowed the client in
+	Approve bool `json:"approve"`
+}
+
+// what the consent page shows the user
+type AuthorizeResponse struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+	// the user allowed all scopes before, the page may approve right away
+	ConsentGiven bool `json:"consent_given"`
+}
+
+// where the consent page sends the browser next
+type PostAuthorizeResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token,omitempty"`
+	Scope       string `json:"scope"`
+}
+
+// claims about a user in ID tokens and the userinfo response, depending on
+// the scopes
+type UserClaims struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+}
+
+type PostOAuthClientParameters struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// single page and mobile apps, which can't keep a secret
+	Public bool `json:"public"`
+}
+
+// ClientSecret is only set when the client is created
+type OAuthClientResponse struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+}
+
+func newOAuthClientResponse(client db.OAuthClient) OAuthClientResponse {
+	return OAuthClientResponse{
+		ClientID:     client.Id,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Public:       client.Public(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// the provider needs a key pair, clients can't verify ID tokens signed with
+// our secret
+func (cfg *apiConfig) oidcEnabled() bool {
+	return cfg.oidcIssuer != "" && cfg.jwtKeys.signing != nil
+}
+
+func (cfg *apiConfig) middlewareOIDCEnabled(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !cfg.oidcEnabled() {
+			respondWithError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func validOAuthScope(scope string) bool {
+	for _, known := range gOIDCScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return validScope(scope)
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// the S256 PKCE challenge of verifier, RFC 7636 section 4.2
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// redirect URIs have to be absolute without fragment, and use https unless
+// they point to the machine itself
+func validRedirectURI(raw string) bool {
+	uri, err := url.Parse(raw)
+	if err != nil || !uri.IsAbs() || uri.Fragment != "" || uri.Host == "" {
+		return false
+	}
+
+	switch uri.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := uri.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// checks an authorization request, returns the client and the requested
+// scopes. The redirect URI is only trusted if the error is nil.
+func (cfg *apiConfig) checkAuthorizeRequest(params AuthorizeParameters) (db.OAuthClient, []string, *OAuthError) {
+	client, err := cfg.db.GetOAuthClient(params.ClientID)
+	if err == db.ErrClientNotFound {
+		return db.OAuthClient{}, nil, &OAuthError{oauthInvalidClient, "unknown client_id"}
+	} else if err != nil {
+		fmt.Printf("getting OAuth client: %s\n", err)
+		return db.OAuthClient{}, nil, &OAuthError{"server_error", ""}
+	}
+	if !containsScope(client.RedirectURIs, params.RedirectURI) {
+		return db.OAuthClient{}, nil, &OAuthError{oauthInvalidRequest, "redirect_uri is not registered for the client"}
+	}
+
+	if params.ResponseType != "code" {
+		return client, nil, &OAuthError{oauthUnsupportedResponseType, "only the code response type is supported"}
+	}
+	if params.CodeChallengeMethod != "S256" || params.CodeChallenge == "" {
+		return client, nil, &OAuthError{oauthInvalidRequest, "a PKCE code_challenge with the S256 method is required"}
+	}
+
+	scopes := strings.Fields(params.Scope)
+	if !containsScope(scopes, scopeOpenID) {
+		return client, nil, &OAuthError{oauthInvalidScope, "the openid scope is required"}
+	}
+	for _, scope := range scopes {
+		if !validOAuthScope(scope) {
+			return client, nil, &OAuthError{oauthInvalidScope, fmt.Sprintf("unknown scope %q", scope)}
+		}
+	}
+
+	return client, scopes, nil
+}
+
+// appends the query to a redirect URI
+func redirectWithQuery(redirectURI string, query url.Values) string {
+	uri, _ := url.Parse(redirectURI)
+	values := uri.Query()
+	for key := range query {
+		values.Set(key, query.Get(key))
+	}
+	uri.RawQuery = values.Encode()
+	return uri.String()
+}
+
+// GET /.well-known/openid-configuration
+func (cfg *apiConfig) handleGetOpenIDConfiguration(w http.ResponseWriter, req *http.Request) {
+	scopes := append(append([]string{}, gOIDCScopes...), gAPIKeyScopes...)
+
+	respondWithJSON(w, http.StatusOK, OpenIDConfiguration{
+		Issuer:                            cfg.oidcIssuer,
+		AuthorizationEndpoint:             cfg.oidcAuthorizeURL,
+		TokenEndpoint:                     cfg.oidcIssuer + "/api/oauth/token",
+		UserinfoEndpoint:                  cfg.oidcIssuer + "/api/oauth/userinfo",
+		JWKSURI:                           cfg.oidcIssuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{cfg.jwtKeys.signing.method.Alg()},
+		ScopesSupported:                   scopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "nonce", "preferred_username", "name", "email", "email_verified"},
+	})
+}
+
+// GET /api/oauth/authorize?<authorization request>
+//
+// checks an authorization request for the consent page
+func (cfg *apiConfig) handleGetAuthorize(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+	query := req.URL.Query()
+	params := AuthorizeParameters{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+
+	client, scopes, oauthErr := cfg.checkAuthorizeRequest(params)
+	if oauthErr != nil {
+		respondWithJSON(w, http.StatusBadRequest, oauthErr)
+		return
+	}
+
+	consentGiven, err := cfg.db.HasConsent(userID, client.Id, scopes)
+	if err != nil {
+		fmt.Printf("checking consent of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, AuthorizeResponse{
+		ClientID:     client.Id,
+		ClientName:   client.Name,
+		Scopes:       scopes,
+		ConsentGiven: consentGiven,
+	})
+}
+
+// POST /api/oauth/authorize
+//
+// records the user's decision and returns where to send the browser: the
+// client's redirect URI with either a code or an error
+func (cfg *apiConfig) handlePostAuthorize(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params PostAuthorizeParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	client, scopes, oauthErr := cfg.checkAuthorizeRequest(params.AuthorizeParameters)
+	if oauthErr != nil && client.Id == "" {
+		// the redirect URI can't be trusted
+		respondWithJSON(w, http.StatusBadRequest, oauthErr)
+		return
+	}
+
+	query := url.Values{}
+	if params.State != "" {
+		query.Set("state", params.State)
+	}
+	if oauthErr == nil && !params.Approve {
+		oauthErr = &OAuthError{oauthAccessDenied, "the user denied access"}
+	}
+	if oauthErr != nil {
+		query.Set("error", oauthErr.Error)
+		query.Set("error_description", oauthErr.ErrorDescription)
+		respondWithJSON(w, http.StatusOK, PostAuthorizeResponse{redirectWithQuery(params.RedirectURI, query)})
+		return
+	}
+
+	if err := cfg.db.GrantConsent(userID, client.Id, scopes); err != nil {
+		fmt.Printf("recording consent of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	code, err := cfg.db.CreateAuthorizationCode(db.AuthorizationCode{
+		UserID:        userID,
+		ClientID:      client.Id,
+		RedirectURI:   params.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: params.CodeChallenge,
+		Nonce:         params.Nonce,
+	}, gAuthorizationCodeTTL)
+	if err != nil {
+		fmt.Printf("creating authorization code: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	query.Set("code", code)
+	respondWithJSON(w, http.StatusOK, PostAuthorizeResponse{redirectWithQuery(params.RedirectURI, query)})
+}
+
+func respondWithOAuthError(w http.ResponseWriter, code int, oauthErr OAuthError) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, oauthErr)
+}
+
+// POST /api/oauth/token
+//
+// exchanges an authorization code for tokens, RFC 6749 section 4.1.3. Clients
+// authenticate with HTTP basic auth or client_id and client_secret in the form.
+func (cfg *apiConfig) handlePostOAuthToken(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, OAuthError{oauthInvalidRequest, "malformed form"})
+		return
+	}
+
+	clientID, secret, ok := req.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+	client, err := cfg.db.AuthenticateOAuthClient(clientID, secret)
+	if err == db.ErrInvalidClient {
+		respondWithOAuthError(w, http.StatusUnauthorized, OAuthError{oauthInvalidClient, ""})
+		return
+	} else if err != nil {
+		fmt.Printf("authenticating OAuth client: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	if grantType := req.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		respondWithOAuthError(w, http.StatusBadRequest, OAuthError{oauthUnsupportedGrantType, ""})
+		return
+	}
+
+	code, err := cfg.db.ConsumeAuthorizationCode(req.PostForm.Get("code"))
+	if err == db.ErrInvalidToken {
+		respondWithOAuthError(w, http.StatusBadRequest, OAuthError{oauthInvalidGrant, "the code is invalid or expired"})
+		return
+	} else if err != nil {
+		fmt.Printf("consuming authorization code: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	verifier := req.PostForm.Get("code_verifier")
+	if code.ClientID != client.Id || code.RedirectURI != req.PostForm.Get("redirect_uri") ||
+		len(verifier) < gMinCodeVerifierLength || len(verifier) > gMaxCodeVerifierLength ||
+		subtle.ConstantTimeCompare([]byte(codeChallengeS256(verifier)), []byte(code.CodeChallenge)) != 1 {
+		respondWithOAuthError(w, http.StatusBadRequest, OAuthError{oauthInvalidGrant, "the code was not issued for this request"})
+		return
+	}
+
+	user, err := cfg.db.GetUser(code.UserID)
+	if err == db.ErrUserNotFound {
+		respondWithOAuthError(w, http.StatusBadRequest, OAuthError{oauthInvalidGrant, "the user no longer exists"})
+		return
+	} else if err != nil {
+		fmt.Printf("getting user %d: %s\n", code.UserID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	accessToken, err := cfg.signClientAccessToken(user.Id, user.TokenGeneration, client.Id, code.Scopes)
+	if err != nil {
+		fmt.Printf("signing JWT token: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	userClaims := newUserClaims(user, code.Scopes)
+	idToken, err := cfg.jwtKeys.Sign(IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.oidcIssuer,
+			Subject:   userClaims.Subject,
+			Audience:  jwt.ClaimStrings{client.Id},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(gAccessTokenExpirationInSeconds) * time.Second)),
+		},
+		Nonce:             code.Nonce,
+		PreferredUsername: userClaims.PreferredUsername,
+		Name:              userClaims.Name,
+		Email:             userClaims.Email,
+		EmailVerified:     userClaims.EmailVerified,
+	})
+	if err != nil {
+		fmt.Printf("signing ID token: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   gAccessTokenExpirationInSeconds,
+		IDToken:     idToken,
+		Scope:       strings.Join(code.Scopes, " "),
+	})
+}
+
+// the claims about user the scopes allow
+func newUserClaims(user *db.User, scopes []string) UserClaims {
+	claims := UserClaims{Subject: strconv.Itoa(user.Id)}
+	if scopes == nil || containsScope(scopes, scopeProfile) {
+		claims.PreferredUsername = user.Handle
+		claims.Name = user.DisplayName
+	}
+	if scopes == nil || containsScope(scopes, scopeEmail) {
+		verified := user.EmailVerified
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	return claims
+}
+
+// GET /api/oauth/userinfo
+func (cfg *apiConfig) handleGetUserinfo(w http.ResponseWriter, req *http.Request) {
+	p := principalFrom(req)
+
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		fmt.Printf("getting user %d: %s\n", p.UserID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newUserClaims(user, p.Scopes))
+}
+
+// GET /api/users/me/consents
+func (cfg *apiConfig) handleGetConsents(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	consents, err := cfg.db.Consents(userID)
+	if err != nil {
+		fmt.Printf("listing consents of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, consents)
+}
+
+// DELETE /api/users/me/consents/{clientID}
+//
+// the client has to ask again next time. Tokens it already has stay valid
+// until they expire.
+func (cfg *apiConfig) handleDeleteConsent(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	err := cfg.db.RevokeConsent(userID, chi.URLParam(req, "clientID"))
+	if err == db.ErrClientNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("revoking consent of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// POST /admin/oauth/clients
+func (cfg *apiConfig) handlePostOAuthClient(w http.ResponseWriter, req *http.Request) {
+	var params PostOAuthClientParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || utf8.RuneCountInString(params.Name) > gMaxOAuthClientNameLen {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{
+			Error: fmt.Sprintf("name must be between 1 and %d characters", gMaxOAuthClientNameLen),
+		})
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "at least one redirect URI is required"})
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: fmt.Sprintf("invalid redirect URI %q", uri)})
+			return
+		}
+	}
+
+	client, secret, err := cfg.db.CreateOAuthClient(params.Name, params.RedirectURIs, params.Public)
+	if err != nil {
+		fmt.Printf("creating OAuth client: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	resp := newOAuthClientResponse(client)
+	resp.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// GET /admin/oauth/clients
+func (cfg *apiConfig) handleGetOAuthClients(w http.ResponseWriter, req *http.Request) {
+	clients, err := cfg.db.OAuthClients()
+	if err != nil {
+		fmt.Printf("listing OAuth clients: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	resp := make([]OAuthClientResponse, 0, len(clients))
+	for _, client := range clients {
+		resp = append(resp, newOAuthClientResponse(client))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// DELETE /admin/oauth/clients/{clientID}
+func (cfg *apiConfig) handleDeleteOAuthClient(w http.ResponseWriter, req *http.Request) {
+	err := cfg.db.DeleteOAuthClient(chi.URLParam(req, "clientID"))
+	if err == db.ErrClientNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("deleting OAuth client: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
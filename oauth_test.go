@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestCodeChallengeS256(t *testing.T) {
+	// RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	expect := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got := codeChallengeS256(verifier); got != expect {
+		t.Errorf("codeChallengeS256(%q) = %q, expected %q", verifier, got, expect)
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri   string
+		valid bool
+	}{
+		{"https://app.example/callback", true},
+		{"https://app.example/callback?from=chirpy", true},
+		{"http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://app.example/callback", false},
+		{"https://app.example/callback#token", false},
+		{"/callback", false},
+		{"app.example/callback", false},
+		{"javascript:alert(1)", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := validRedirectURI(test.uri); got != test.valid {
+			t.Errorf("validRedirectURI(%q) = %v, expected %v", test.uri, got, test.valid)
+		}
+	}
+}
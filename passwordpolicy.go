@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	gDefaultPasswordMinLength  = 8
+	gDefaultPasswordMinClasses = 1
+	// bcrypt only looks at the first 72 bytes
+	gBcryptMaxPasswordLength = 72
+)
+
+// codes of password policy violations
+const (
+	passwordRequired       = "required"
+	passwordTooShort       = "too_short"
+	passwordTooLong        = "too_long"
+	passwordTooFewClasses  = "too_few_character_classes"
+	passwordBreached       = "breached"
+	validationErrorMessage = "Validation failed"
+)
+
+// ValidationError describes what is wrong with one field of a request
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrorResponse struct {
+	Error  string            `json:"error"`
+	Errors []ValidationError `json:"errors"`
+}
+
+func respondWithValidationErrors(w http.ResponseWriter, errs []ValidationError) {
+	respondWithJSON(w, http.StatusBadRequest, ValidationErrorResponse{
+		Error:  validationErrorMessage,
+		Errors: errs,
+	})
+}
+
+// passwordPolicy decides which passwords users may choose
+type passwordPolicy struct {
+	// in characters
+	minLength int
+	// in bytes, at most gBcryptMaxPasswordLength
+	maxLength int
+	// how many of lowercase letters, uppercase letters, digits and other
+	// characters a password has to contain
+	minClasses int
+	// upper case hex SHA-1 hashes of breached passwords
+	breached map[string]struct{}
+}
+
+// newPasswordPolicy creates a policy with the given limits. maxLength is capped
+// at gBcryptMaxPasswordLength, 0 means the cap. If breachedPath is not empty,
+// passwords in that file are rejected, see loadBreachedPasswords.
+func newPasswordPolicy(minLength, maxLength, minClasses int, breachedPath string) (*passwordPolicy, error) {
+	if maxLength <= 0 || maxLength > gBcryptMaxPasswordLength {
+		maxLength = gBcryptMaxPasswordLength
+	}
+	if minLength > maxLength {
+		return nil, fmt.Errorf("minimum password length %d is over the maximum %d", minLength, maxLength)
+	}
+	if minClasses > 4 {
+		return nil, fmt.Errorf("there are only 4 character classes, can't require %d", minClasses)
+	}
+
+	policy := passwordPolicy{
+		minLength:  minLength,
+		maxLength:  maxLength,
+		minClasses: minClasses,
+		breached:   map[string]struct{}{},
+	}
+
+	if breachedPath != "" {
+		breached, err := loadBreachedPasswords(breachedPath)
+		if err != nil {
+			return nil, err
+		}
+		policy.breached = breached
+	}
+
+	return &policy, nil
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadBreachedPasswords reads a file with one breached password per line.
+// Lines may also be SHA-1 hashes in hex, optionally followed by ":<count>" as in
+// the downloadable Have I Been Pwned lists. Empty lines and lines starting with
+// '#' are skipped.
+func loadBreachedPasswords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening breached password list: %w", err)
+	}
+	defer f.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			breached[strings.ToUpper(hash)] = struct{}{}
+		} else {
+			breached[sha1Hex(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading breached password list: %w", err)
+	}
+
+	return breached, nil
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// counts how many of lowercase, uppercase, digits and other characters appear
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	return lower + upper + digit + other
+}
+
+// Check returns everything that is wrong with password, nil if it is allowed
+func (p *passwordPolicy) Check(password string) []ValidationError {
+	if password == "" {
+		return []ValidationError{{"password", passwordRequired, "Password is required"}}
+	}
+
+	errs := []ValidationError{}
+	if utf8.RuneCountInString(password) < p.minLength {
+		errs = append(errs, ValidationError{"password", passwordTooShort,
+			fmt.Sprintf("Password must be at least %d characters", p.minLength)})
+	}
+	if len(password) > p.maxLength {
+		errs = append(errs, ValidationError{"password", passwordTooLong,
+			fmt.Sprintf("Password must be at most %d bytes", p.maxLength)})
+	}
+	if characterClasses(password) < p.minClasses {
+		errs = append(errs, ValidationError{"password", passwordTooFewClasses,
+			fmt.Sprintf("Password must contain at least %d of lowercase letters, uppercase letters, digits and symbols", p.minClasses)})
+	}
+	if _, ok := p.breached[sha1Hex(password)]; ok {
+		errs = append(errs, ValidationError{"password", passwordBreached,
+			"Password appears in a list of breached passwords"})
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
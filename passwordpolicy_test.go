@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	breachedPath := filepath.Join(t.TempDir(), "breached.txt")
+	breached := strings.Join([]string{
+		"# plain and hashed entries",
+		"Password1!",
+		"",
+		// "letmein-now"
+		"6C194038455F4B9939F744ACAD5EA3E831C7B88B:42",
+	}, "\n")
+	if err := os.WriteFile(breachedPath, []byte(breached), 0644); err != nil {
+		t.Fatalf("writing breached password list: %s", err)
+	}
+
+	policy, err := newPasswordPolicy(8, 20, 3, breachedPath)
+	if err != nil {
+		t.Fatalf("creating password policy: %s", err)
+	}
+
+	tests := []struct {
+		password string
+		expect   []string
+	}{
+		{"Good-pass1", nil},
+		{"Ünïcödé-9", nil},
+		{"", []string{passwordRequired}},
+		{"Ab1!", []string{passwordTooShort}},
+		{"Aa1-" + strings.Repeat("x", 17), []string{passwordTooLong}},
+		{"alllowercase", []string{passwordTooFewClasses}},
+		{"short", []string{passwordTooShort, passwordTooFewClasses}},
+		{"Password1!", []string{passwordBreached}},
+		{"letmein-now", []string{passwordTooFewClasses, passwordBreached}},
+	}
+
+	for _, test := range tests {
+		codes := []string(nil)
+		for _, err := range policy.Check(test.password) {
+			codes = append(codes, err.Code)
+		}
+		if !reflect.DeepEqual(codes, test.expect) {
+			t.Errorf("Check(%q) = %v, expected %v", test.password, codes, test.expect)
+		}
+	}
+}
+
+func TestPasswordPolicyLimits(t *testing.T) {
+	policy, err := newPasswordPolicy(0, 1000, 0, "")
+	if err != nil {
+		t.Fatalf("creating password policy: %s", err)
+	}
+	if policy.maxLength != gBcryptMaxPasswordLength {
+		t.Errorf("expected maximum length to be capped at %d, got %d", gBcryptMaxPasswordLength, policy.maxLength)
+	}
+
+	if _, err := newPasswordPolicy(100, 0, 0, ""); err == nil {
+		t.Errorf("expected a minimum length over the maximum to be rejected")
+	}
+	if _, err := newPasswordPolicy(8, 0, 5, ""); err == nil {
+		t.Errorf("expected more than 4 character classes to be rejected")
+	}
+	if _, err := newPasswordPolicy(8, 0, 0, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected a missing breached password file to be an error")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	db "github.com/horriblename/go-web-server/db"
+	"github.com/horriblename/go-web-server/mailer"
+)
+
+const gPasswordResetTokenTTL = 1 * time.Hour
+
+type PostForgotPasswordParameters struct {
+	Email string `json:"email"`
+}
+
+type PostResetPasswordParameters struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// POST /api/password/forgot
+//
+// emails a password reset token. The response is the same whether the email is
+// registered or not, and the work is done in the background so the response
+// time doesn't tell either; otherwise this could be used to find out who has an
+// account.
+func (cfg *apiConfig) handlePostForgotPassword(w http.ResponseWriter, req *http.Request) {
+	var params PostForgotPasswordParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	go cfg.sendPasswordResetEmail(params.Email)
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func (cfg *apiConfig) sendPasswordResetEmail(email string) {
+	token, user, err := cfg.db.CreatePasswordResetToken(email, gPasswordResetTokenTTL)
+	if err == db.ErrUnregisteredEmail {
+		return
+	} else if err != nil {
+		fmt.Printf("creating password reset token: %s\n", err)
+		return
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(`Someone asked to reset the password of your Chirpy account.
+
+To choose a new password, send this token to POST /api/password/reset:
+
+%s
+
+The token expires in %d minutes. If you didn't ask for this, ignore this email; your password stays the same.`,
+			token, int(gPasswordResetTokenTTL.Minutes())),
+	}
+	if err := cfg.mailer.Send(msg); err != nil {
+		fmt.Printf("sending password reset email to user %d: %s\n", user.Id, err)
+	}
+}
+
+// POST /api/password/reset
+//
+// sets a new password using a token from /api/password/forgot and logs the
+// user out everywhere
+func (cfg *apiConfig) handlePostResetPassword(w http.ResponseWriter, req *http.Request) {
+	var params PostResetPasswordParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if errs := cfg.passwordPolicy.Check(params.Password); errs != nil {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	user, err := cfg.db.ResetPassword(params.Token, params.Password)
+	if err == db.ErrInvalidToken {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
+		fmt.Printf("resetting password: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// confirmPassword checks the current password of a user before a sensitive
+// change. Failures count towards the account's login lockout, so a stolen
+// access token can't be used to guess the password. Responds and returns false
+// if the password is missing or wrong, or the account is locked out.
+func (cfg *apiConfig) confirmPassword(w http.ResponseWriter, req *http.Request, userID int, password string) bool {
+	if password == "" {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "the current password is required to confirm this change"})
+		return false
+	}
+
+	account, ip := accountKey(userID, ""), clientIP(req)
+	if wait := cfg.loginLimiter.Blocked(account, ip); wait > 0 {
+		respondLockedOut(w, wait)
+		return false
+	}
+
+	err := cfg.db.CheckPassword(userID, password)
+	if err == db.ErrWrongPassword {
+		cfg.loginLimiter.Failure(account, ip)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return false
+	} else if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return false
+	} else if err != nil {
+		fmt.Printf("checking password of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return false
+	}
+	cfg.loginLimiter.Success(account)
+
+	return true
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var gProfanity []string = []string{"kerfuffle", "sharbert", "fornax"}
+
+const gProfanityMask = "****"
+
+// homoglyphs maps characters that look like latin letters onto the letter they
+// imitate. Only lowercase forms are needed since tokens are case folded first.
+var homoglyphs = map[rune]rune{
+	// cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// leetspeak maps digits and symbols commonly used in place of letters. 'l' is
+// folded onto 'i' as well, because '1' is used for both.
+var leetspeak = map[rune]rune{
+	'0': 'o', '1': 'i', 'l': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'9': 'g', '@': 'a', '$': 's',
+}
+
+var gFolder = cases.Fold()
+
+// a word in the input text. start and end are byte offsets into the original
+// string. folded and normalized are the forms used for matching against banned
+// words (see foldWord and normalizeWord).
+type token struct {
+	start      int
+	end        int
+	folded     string
+	normalized string
+}
+
+func newToken(input string, start, end int) token {
+	folded := foldWord(input[start:end])
+	return token{start, end, folded, unleet(folded)}
+}
+
+func isWordRune(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+		return true
+	}
+
+	_, ok := leetspeak[r]
+	return ok
+}
+
+// tokenize splits input into words. Anything that is not a letter, digit,
+// combining mark or leetspeak symbol separates words, so punctuation and any
+// kind of whitespace are left out of the tokens.
+func tokenize(input string) []token {
+	tokens := []token{}
+	start := -1
+	for i, r := range input {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		if start >= 0 {
+			tokens = append(tokens, newToken(input, start, i))
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, newToken(input, start, len(input)))
+	}
+
+	return tokens
+}
+
+// foldWord reduces a word to a canonical spelling: compatibility normalized
+// (NFKC), stripped of accents, case folded, with homoglyphs replaced by the
+// latin letters they imitate.
+func foldWord(word string) string {
+	// decompose first so accents become separate combining marks we can drop,
+	// the result is recomposed at the end
+	decomposed := gFolder.String(norm.NFKD.String(word))
+
+	out := strings.Builder{}
+	for _, r := range decomposed {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if mapped, ok := homoglyphs[r]; ok {
+			r = mapped
+		}
+		out.WriteRune(r)
+	}
+
+	return norm.NFKC.String(out.String())
+}
+
+// replaces leetspeak in an already folded word
+func unleet(folded string) string {
+	return strings.Map(func(r rune) rune {
+		if mapped, ok := leetspeak[r]; ok {
+			return mapped
+		}
+		return r
+	}, folded)
+}
+
+// normalizeWord is foldWord with leetspeak replaced as well. Note that this
+// reads 'l' as 'i'.
+func normalizeWord(word string) string {
+	return unleet(foldWord(word))
+}
+
+// a named list of banned words. Words are matched exactly, Wildcards may use
+// '*' (any number of characters) and '?' (a single character), and Regexes use
+// RE2 syntax and must match the whole word.
+//
+// Words and Wildcards are normalized the same way the chirp is, so they can be
+// written plainly. Regexes are tried against both the folded and the normalized
+// form of each word (see foldWord and normalizeWord), and should be written in
+// lowercase latin letters.
+type wordList struct {
+	Name        string   `json:"name"`
+	Replacement string   `json:"replacement,omitempty"`
+	Words       []string `json:"words,omitempty"`
+	Wildcards   []string `json:"wildcards,omitempty"`
+	Regexes     []string `json:"regexes,omitempty"`
+}
+
+// the on-disk format of a banned word list file
+type wordListFile struct {
+	Lists []wordList `json:"lists"`
+}
+
+// how a pattern in the Aho-Corasick automaton has to line up with a word
+type matchKind int
+
+const (
+	matchExact    matchKind = iota // the whole word, from Words or "abc"
+	matchPrefix                    // start of the word, from "abc*"
+	matchSuffix                    // end of the word, from "*abc"
+	matchContains                  // anywhere in the word, from "*abc*"
+)
+
+type matchEntry struct {
+	list int
+	kind matchKind
+}
+
+// wordMatcher is the compiled form of a set of word lists. Words and simple
+// wildcards go into a single Aho-Corasick automaton, so a chirp is scanned
+// once no matter how many of them there are. Wildcards that can't be expressed
+// that way and regexes are combined into one regular expression per list.
+type wordMatcher struct {
+	replacements []string
+	ac           *acMatcher
+	entries      []matchEntry
+	// per list, nil if the list has none
+	wildcards []*regexp.Regexp
+	regexes   []*regexp.Regexp
+}
+
+// profanityFilter masks banned words in chirps. The word lists can be replaced
+// at runtime with SetLists, or re-read from the backing file with Reload.
+type profanityFilter struct {
+	path     string
+	lock     *sync.RWMutex
+	lists    []wordList
+	compiled *wordMatcher
+	modTime  time.Time
+}
+
+var ErrNoWordListFile = errors.New("no word list file configured")
+
+func defaultWordLists() []wordList {
+	return []wordList{{Name: "default", Words: gProfanity}}
+}
+
+// newProfanityFilter creates a profanityFilter with the word lists in the file
+// at path. If path is empty, the built-in gProfanity list is used and changes
+// made with SetLists are kept in memory only.
+func newProfanityFilter(path string) (*profanityFilter, error) {
+	filter := profanityFilter{path: path, lock: &sync.RWMutex{}}
+	if path == "" {
+		return &filter, filter.SetLists(defaultWordLists())
+	}
+
+	return &filter, filter.Reload()
+}
+
+func compileWordLists(lists []wordList) (*wordMatcher, error) {
+	m := wordMatcher{
+		replacements: make([]string, len(lists)),
+		wildcards:    make([]*regexp.Regexp, len(lists)),
+		regexes:      make([]*regexp.Regexp, len(lists)),
+	}
+	patterns := []string{}
+	addPattern := func(pattern string, list int, kind matchKind) {
+		patterns = append(patterns, pattern)
+		m.entries = append(m.entries, matchEntry{list, kind})
+	}
+
+	for i, list := range lists {
+		m.replacements[i] = list.Replacement
+		if m.replacements[i] == "" {
+			m.replacements[i] = gProfanityMask
+		}
+
+		for _, word := range list.Words {
+			if normalized := normalizeWord(word); normalized != "" {
+				addPattern(normalized, i, matchExact)
+			}
+		}
+
+		complexWildcards := []string{}
+		for _, wildcard := range list.Wildcards {
+			if literal, kind, ok := simpleWildcard(wildcard); ok {
+				addPattern(literal, i, kind)
+			} else {
+				complexWildcards = append(complexWildcards, wildcardToRegexp(wildcard))
+			}
+		}
+
+		if len(complexWildcards) > 0 {
+			pattern, err := regexp.Compile("^(?:" + strings.Join(complexWildcards, "|") + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("list %q: wildcards: %w", list.Name, err)
+			}
+			m.wildcards[i] = pattern
+		}
+
+		for _, expr := range list.Regexes {
+			if _, err := regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("list %q: regex %q: %w", list.Name, expr, err)
+			}
+		}
+		if len(list.Regexes) > 0 {
+			pattern, err := regexp.Compile("^(?:(?:" + strings.Join(list.Regexes, ")|(?:") + "))$")
+			if err != nil {
+				return nil, fmt.Errorf("list %q: regexes: %w", list.Name, err)
+			}
+			m.regexes[i] = pattern
+		}
+	}
+
+	m.ac = newACMatcher(patterns)
+	return &m, nil
+}
+
+// simpleWildcard reports whether wildcard only has '*' at its start and/or end,
+// and if so returns its normalized literal part and how it has to match.
+func simpleWildcard(wildcard string) (string, matchKind, bool) {
+	literal := strings.Trim(wildcard, "*")
+	if literal == "" || strings.ContainsAny(literal, "*?") {
+		return "", 0, false
+	}
+
+	normalized := normalizeWord(literal)
+	if normalized == "" {
+		return "", 0, false
+	}
+
+	leading := strings.HasPrefix(wildcard, "*")
+	trailing := strings.HasSuffix(wildcard, "*")
+	switch {
+	case leading && trailing:
+		return normalized, matchContains, true
+	case leading:
+		return normalized, matchSuffix, true
+	case trailing:
+		return normalized, matchPrefix, true
+	default:
+		return normalized, matchExact, true
+	}
+}
+
+// converts a wildcard like "f?rnax*" to an (unanchored) regular expression.
+// The literal parts are normalized the same way words are.
+func wildcardToRegexp(wildcard string) string {
+	out := strings.Builder{}
+	literal := strings.Builder{}
+	flush := func() {
+		out.WriteString(regexp.QuoteMeta(normalizeWord(literal.String())))
+		literal.Reset()
+	}
+
+	for _, r := range wildcard {
+		switch r {
+		case '*':
+			flush()
+			out.WriteString(".*")
+		case '?':
+			flush()
+			out.WriteString(".")
+		default:
+			literal.WriteRune(r)
+		}
+	}
+	flush()
+
+	return out.String()
+}
+
+// Match returns, for each token, the index of the first list that bans it, or
+// -1 if none does. The normalized tokens are joined into a single text and
+// scanned once by the automaton, matches are then checked against the word
+// boundaries.
+func (m *wordMatcher) Match(tokens []token) []int {
+	best := make([]int, len(tokens))
+	for i := range best {
+		best[i] = len(m.replacements)
+	}
+
+	text := strings.Builder{}
+	starts := make([]int, len(tokens))
+	ends := make([]int, len(tokens))
+	for i, tok := range tokens {
+		starts[i] = text.Len()
+		text.WriteString(tok.normalized)
+		ends[i] = text.Len()
+		// never part of a word, so patterns can't match across words
+		text.WriteByte(0)
+	}
+
+	// matches are reported in order of their end, so the word a match is in
+	// only ever moves forward
+	cur := 0
+	m.ac.Scan(text.String(), func(pattern, start, end int) {
+		for ends[cur] < end {
+			cur++
+		}
+
+		entry := m.entries[pattern]
+		if entry.list >= best[cur] {
+			return
+		}
+
+		var ok bool
+		switch entry.kind {
+		case matchExact:
+			ok = start == starts[cur] && end == ends[cur]
+		case matchPrefix:
+			ok = start == starts[cur]
+		case matchSuffix:
+			ok = end == ends[cur]
+		case matchContains:
+			ok = true
+		}
+		if ok {
+			best[cur] = entry.list
+		}
+	})
+
+	for i, tok := range tokens {
+		for list := 0; list < best[i]; list++ {
+			if m.wildcards[list] != nil && m.wildcards[list].MatchString(tok.normalized) {
+				best[i] = list
+				break
+			}
+			if m.regexes[list] != nil && (m.regexes[list].MatchString(tok.folded) || m.regexes[list].MatchString(tok.normalized)) {
+				best[i] = list
+				break
+			}
+		}
+
+		if best[i] == len(m.replacements) {
+			best[i] = -1
+		}
+	}
+
+	return best
+}
+
+// Lists returns the word lists currently in use.
+func (f *profanityFilter) Lists() []wordList {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.lists
+}
+
+// SetLists replaces the word lists in use. The lists are validated first and
+// left untouched on error. If the filter is backed by a file, the new lists are
+// written to it as well.
+func (f *profanityFilter) SetLists(lists []wordList) error {
+	compiled, err := compileWordLists(lists)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.path != "" {
+		if err := writeWordListFile(f.path, lists); err != nil {
+			return err
+		}
+		if info, err := os.Stat(f.path); err == nil {
+			f.modTime = info.ModTime()
+		}
+	}
+
+	f.lists = lists
+	f.compiled = compiled
+	return nil
+}
+
+// Reload re-reads the word list file. On error the current lists stay in use.
+func (f *profanityFilter) Reload() error {
+	if f.path == "" {
+		return ErrNoWordListFile
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	dat, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var file wordListFile
+	if err := json.Unmarshal(dat, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", f.path, err)
+	}
+
+	compiled, err := compileWordLists(file.Lists)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.lists = file.Lists
+	f.compiled = compiled
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// Watch polls the word list file every interval and reloads it when it has
+// been modified. It never returns, so run it in its own goroutine.
+func (f *profanityFilter) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			fmt.Printf("watching word lists: %s\n", err)
+			continue
+		}
+
+		f.lock.RLock()
+		modified := info.ModTime() != f.modTime
+		f.lock.RUnlock()
+
+		if modified {
+			if err := f.Reload(); err != nil {
+				fmt.Printf("reloading word lists: %s\n", err)
+			}
+		}
+	}
+}
+
+func writeWordListFile(path string, lists []wordList) error {
+	dat, err := json.MarshalIndent(wordListFile{Lists: lists}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a watcher never sees a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, dat, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Filter replaces every word of input that matches one of the word lists with
+// that list's replacement. Whitespace and punctuation around the replaced words
+// are kept.
+func (f *profanityFilter) Filter(input string) string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	tokens := tokenize(input)
+	matches := f.compiled.Match(tokens)
+
+	out := strings.Builder{}
+	last := 0
+	for i, tok := range tokens {
+		if matches[i] < 0 {
+			continue
+		}
+
+		out.WriteString(input[last:tok.start])
+		out.WriteString(f.compiled.replacements[matches[i]])
+		last = tok.end
+	}
+	out.WriteString(input[last:])
+
+	return out.String()
+}
+
+func (cfg *apiConfig) handleGetProfanityLists(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, wordListFile{Lists: cfg.profanity.Lists()})
+}
+
+func (cfg *apiConfig) handlePutProfanityLists(w http.ResponseWriter, req *http.Request) {
+	var params wordListFile
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if err := cfg.profanity.SetLists(params.Lists); err != nil {
+		fmt.Printf("setting word lists: %s\n", err)
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, wordListFile{Lists: cfg.profanity.Lists()})
+}
+
+func (cfg *apiConfig) handlePostProfanityReload(w http.ResponseWriter, req *http.Request) {
+	err := cfg.profanity.Reload()
+	if err == ErrNoWordListFile {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
+		fmt.Printf("reloading word lists: %s\n", err)
+		respondWithJSON(w, http.StatusInternalServerError, genericErrorMsg{Error: err.Error()})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, wordListFile{Lists: cfg.profanity.Lists()})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfanityFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{"clean", "hello world", "hello world"},
+		{"empty", "", ""},
+		{"single word", "kerfuffle", "****"},
+		{"mixed case", "This is a keRfUfFle opinion", "This is a **** opinion"},
+		{"trailing punctuation", "Kerfuffle!", "****!"},
+		{"trailing comma", "what a kerfuffle, really", "what a ****, really"},
+		{"quoted", `he said "sharbert".`, `he said "****".`},
+		{"possessive", "fornax's fault", "****'s fault"},
+		{"newline separated", "kerfuffle\nsharbert", "****\n****"},
+		{"tab separated", "kerfuffle\tfornax", "****\t****"},
+		{"repeated spaces kept", "a  kerfuffle   b", "a  ****   b"},
+		{"trailing space kept", "kerfuffle ", "**** "},
+		{"leading space kept", " kerfuffle", " ****"},
+		{"substring not matched", "kerfufflement", "kerfufflement"},
+		{"fullwidth", "ｋｅｒｆｕｆｆｌｅ", "****"},
+		{"accents", "kérfüfflé", "****"},
+		{"combining accents", "kérfuffle", "****"},
+		{"cyrillic homoglyphs", "kеrfufflе", "****"},
+		{"greek homoglyphs", "fοrnαx", "****"},
+		{"leetspeak", "k3rfuff13", "****"},
+		{"leetspeak symbols", "$h@rb3rt", "****"},
+		{"uppercase leetspeak", "F0RN4X", "****"},
+		{"non-latin text kept", "日本語 kerfuffle 日本語", "日本語 **** 日本語"},
+	}
+
+	filter, err := newProfanityFilter("")
+	if err != nil {
+		t.Fatalf("creating profanity filter: %s", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := filter.Filter(test.input)
+			if got != test.expect {
+				t.Errorf("Filter(%q) = %q, expected %q", test.input, got, test.expect)
+			}
+		})
+	}
+}
+
+func TestWordListPatterns(t *testing.T) {
+	lists := []wordList{
+		{Name: "exact", Words: []string{"kerfuffle"}},
+		{Name: "wildcards", Replacement: "[removed]", Wildcards: []string{"fornax*", "*bert", "gr?nk"}},
+		{Name: "regexes", Replacement: "#", Regexes: []string{"blo+rp", "z[a-c]p"}},
+	}
+
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{"kerfuffle", "****"},
+		{"fornaxes abound", "[removed] abound"},
+		{"Sharbert!", "[removed]!"},
+		{"grunk grank grnk", "[removed] [removed] grnk"},
+		{"bloooorp zbp zdp", "# # zdp"},
+		{"xbloorpx", "xbloorpx"},
+		{"F0RNAXIAN", "[removed]"},
+	}
+
+	filter, err := newProfanityFilter("")
+	if err != nil {
+		t.Fatalf("creating profanity filter: %s", err)
+	}
+	if err := filter.SetLists(lists); err != nil {
+		t.Fatalf("SetLists: %s", err)
+	}
+
+	for _, test := range tests {
+		if got := filter.Filter(test.input); got != test.expect {
+			t.Errorf("Filter(%q) = %q, expected %q", test.input, got, test.expect)
+		}
+	}
+
+	// invalid lists are rejected and the old ones kept
+	err = filter.SetLists([]wordList{{Name: "broken", Regexes: []string{"("}}})
+	if err == nil {
+		t.Errorf("expected invalid regex to be rejected")
+	}
+	if got := filter.Filter("kerfuffle"); got != "****" {
+		t.Errorf("expected previous lists to stay in use, got %q", got)
+	}
+}
+
+func TestWordListPriority(t *testing.T) {
+	lists := []wordList{
+		{Name: "first", Replacement: "1", Wildcards: []string{"*bar"}},
+		{Name: "second", Replacement: "2", Words: []string{"foobar"}, Wildcards: []string{"*oo*", "b?z"}},
+		{Name: "third", Replacement: "3", Words: []string{"baz", "zoo"}},
+	}
+
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		// matched by the first and second list, the first one wins
+		{"foobar", "1"},
+		{"zoo", "2"},
+		{"baz", "2"},
+		{"bar rebar barn", "1 1 barn"},
+		{"moon boo oo o", "2 2 2 o"},
+	}
+
+	filter, err := newProfanityFilter("")
+	if err != nil {
+		t.Fatalf("creating profanity filter: %s", err)
+	}
+	if err := filter.SetLists(lists); err != nil {
+		t.Fatalf("SetLists: %s", err)
+	}
+
+	for _, test := range tests {
+		if got := filter.Filter(test.input); got != test.expect {
+			t.Errorf("Filter(%q) = %q, expected %q", test.input, got, test.expect)
+		}
+	}
+}
+
+func TestWordListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.json")
+	writeLists := func(lists []wordList) {
+		if err := writeWordListFile(path, lists); err != nil {
+			t.Fatalf("writing word list file: %s", err)
+		}
+	}
+
+	writeLists([]wordList{{Name: "first", Words: []string{"alpha"}}})
+	filter, err := newProfanityFilter(path)
+	if err != nil {
+		t.Fatalf("creating profanity filter: %s", err)
+	}
+	if got := filter.Filter("alpha beta"); got != "**** beta" {
+		t.Errorf("expected alpha to be masked, got %q", got)
+	}
+
+	writeLists([]wordList{{Name: "second", Words: []string{"beta"}}})
+	if err := filter.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if got := filter.Filter("alpha beta"); got != "alpha ****" {
+		t.Errorf("expected beta to be masked after reload, got %q", got)
+	}
+
+	// SetLists writes through to the file
+	if err := filter.SetLists([]wordList{{Name: "third", Words: []string{"gamma"}}}); err != nil {
+		t.Fatalf("SetLists: %s", err)
+	}
+	reopened, err := newProfanityFilter(path)
+	if err != nil {
+		t.Fatalf("reopening word list file: %s", err)
+	}
+	if got := reopened.Filter("beta gamma"); got != "beta ****" {
+		t.Errorf("expected lists set at runtime to be persisted, got %q", got)
+	}
+
+	// a broken file is not loaded
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatalf("writing broken file: %s", err)
+	}
+	if err := filter.Reload(); err == nil {
+		t.Errorf("expected reloading a broken file to fail")
+	}
+	if got := filter.Filter("gamma"); got != "****" {
+		t.Errorf("expected previous lists to stay in use, got %q", got)
+	}
+}
+
+func TestWordListWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.json")
+	if err := writeWordListFile(path, []wordList{{Name: "first", Words: []string{"alpha"}}}); err != nil {
+		t.Fatalf("writing word list file: %s", err)
+	}
+
+	filter, err := newProfanityFilter(path)
+	if err != nil {
+		t.Fatalf("creating profanity filter: %s", err)
+	}
+	go filter.Watch(10 * time.Millisecond)
+
+	// make sure the modification time changes on coarse-grained filesystems
+	later := time.Now().Add(time.Second)
+	if err := writeWordListFile(path, []wordList{{Name: "second", Words: []string{"beta"}}}); err != nil {
+		t.Fatalf("writing word list file: %s", err)
+	}
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("touching word list file: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for filter.Filter("beta") != "****" {
+		if time.Now().After(deadline) {
+			t.Fatalf("word list file was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect []token
+	}{
+		{"", []token{}},
+		{"  ", []token{}},
+		{"Hi, there!", []token{{0, 2, "hi", "hi"}, {4, 9, "there", "there"}}},
+		{"a\tb\nc", []token{{0, 1, "a", "a"}, {2, 3, "b", "b"}, {4, 5, "c", "c"}}},
+		{"Straße", []token{{0, 7, "strasse", "strasse"}}},
+		{"ﬁne", []token{{0, 5, "fine", "fine"}}},
+		{"B1ÖRP", []token{{0, 6, "b1orp", "biorp"}}},
+		{"hello", []token{{0, 5, "hello", "heiio"}}},
+	}
+
+	for _, test := range tests {
+		got := tokenize(test.input)
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("tokenize(%q) = %+v, expected %+v", test.input, got, test.expect)
+		}
+	}
+}
+
+// generates n distinct pseudo-random lowercase words
+func generateWords(n int) []string {
+	rng := rand.New(rand.NewSource(int64(n)))
+	const letters = "abcdefghjkmnpqrtuvwxyz"
+	seen := map[string]struct{}{}
+	words := make([]string, 0, n)
+	for len(words) < n {
+		word := make([]byte, 6+rng.Intn(6))
+		for i := range word {
+			word[i] = letters[rng.Intn(len(letters))]
+		}
+		if _, ok := seen[string(word)]; ok {
+			continue
+		}
+		seen[string(word)] = struct{}{}
+		words = append(words, string(word))
+	}
+
+	return words
+}
+
+// The time per chirp should stay roughly the same as the word lists grow, since
+// the chirp is scanned once by the automaton regardless of the list size.
+func BenchmarkProfanityFilter(b *testing.B) {
+	chirp := "This is a keRfUfFle opinion I need to share, with the world: sh@rb3rt & f0rnax!"
+
+	for _, size := range []int{10, 100, 1000, 5000, 20000} {
+		words := generateWords(size)
+		lists := []wordList{{
+			Name:      "generated",
+			Words:     append(append([]string{}, words[:size/2]...), gProfanity...),
+			Wildcards: wildcardsFor(words[size/2:]),
+		}}
+
+		filter, err := newProfanityFilter("")
+		if err != nil {
+			b.Fatalf("creating profanity filter: %s", err)
+		}
+		if err := filter.SetLists(lists); err != nil {
+			b.Fatalf("SetLists: %s", err)
+		}
+
+		b.Run(fmt.Sprintf("words=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				filter.Filter(chirp)
+			}
+		})
+	}
+}
+
+func wildcardsFor(words []string) []string {
+	wildcards := make([]string, len(words))
+	for i, word := range words {
+		switch i % 3 {
+		case 0:
+			wildcards[i] = word + "*"
+		case 1:
+			wildcards[i] = "*" + word
+		default:
+			wildcards[i] = "*" + word + "*"
+		}
+	}
+
+	return wildcards
+}
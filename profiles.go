@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	db "github.com/horriblename/go-web-server/db"
+)
+
+const (
+	gHandleChangeCooldown = 30 * 24 * time.Hour
+	gMaxDisplayNameLength = 50
+	gMaxBioLength         = 160
+	gMaxAvatarSize        = 1 << 20 // 1 MiB
+)
+
+// avatar formats we accept, by sniffed content type
+var gAvatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type ProfileResponse struct {
+	db.Profile
+	AvatarURL string `json:"avatar_url"`
+}
+
+// fields left out are not changed. Changing the email or password needs the
+// current password as well.
+type PatchUserParameters struct {
+	Handle          *string `json:"handle,omitempty"`
+	DisplayName     *string `json:"display_name,omitempty"`
+	Bio             *string `json:"bio,omitempty"`
+	Email           *string `json:"email,omitempty"`
+	Password        *string `json:"password,omitempty"`
+	CurrentPassword string  `json:"current_password,omitempty"`
+}
+
+func newProfileResponse(profile db.Profile) ProfileResponse {
+	resp := ProfileResponse{Profile: profile}
+	if profile.Avatar != "" {
+		resp.AvatarURL = fmt.Sprintf("/api/users/%d/avatar", profile.Id)
+	}
+
+	return resp
+}
+
+// checks that a profile text field is short enough and has no control characters
+func validateProfileText(field, value string, maxLength int) error {
+	if utf8.RuneCountInString(value) > maxLength {
+		return fmt.Errorf("%s must be at most %d characters", field, maxLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) && r != '\n' {
+			return fmt.Errorf("%s must not contain control characters", field)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *apiConfig) handleGetUserByID(w http.ResponseWriter, req *http.Request) {
+	userID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	profile, err := cfg.db.GetProfile(userID)
+	if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("getting profile of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newProfileResponse(*profile))
+}
+
+func (cfg *apiConfig) handleGetUserByHandle(w http.ResponseWriter, req *http.Request) {
+	handle := chi.URLParam(req, "handle")
+
+	profile, err := cfg.db.GetProfileByHandle(handle)
+	if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("getting profile of @%s: %s\n", handle, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newProfileResponse(*profile))
+}
+
+// GET /api/users/me
+func (cfg *apiConfig) handleGetUserMe(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	profile, err := cfg.db.GetProfile(userID)
+	if err != nil {
+		fmt.Printf("getting profile of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newProfileResponse(*profile))
+}
+
+// PATCH /api/users/me
+//
+// updates the caller's account and profile
+func (cfg *apiConfig) handlePatchUserMe(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	var params PatchUserParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if params.DisplayName != nil {
+		trimmed := strings.TrimSpace(*params.DisplayName)
+		params.DisplayName = &trimmed
+		if err := validateProfileText("display_name", trimmed, gMaxDisplayNameLength); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+			return
+		}
+	}
+	if params.Bio != nil {
+		if err := validateProfileText("bio", *params.Bio, gMaxBioLength); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+			return
+		}
+	}
+	if params.Email != nil && !validEmail(*params.Email) {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Invalid email"})
+		return
+	}
+	if params.Password != nil {
+		if errs := cfg.passwordPolicy.Check(*params.Password); errs != nil {
+			respondWithValidationErrors(w, errs)
+			return
+		}
+	}
+
+	if params.Handle != nil {
+		if err := db.ValidateHandle(*params.Handle); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+			return
+		}
+	}
+
+	if params.Email != nil || params.Password != nil {
+		if !cfg.confirmPassword(w, req, userID, params.CurrentPassword) {
+			return
+		}
+	}
+
+	result, err := cfg.db.UpdateAccount(userID, db.AccountUpdate{
+		UserUpdate:    db.UserUpdate{Email: params.Email, Password: params.Password},
+		ProfileUpdate: db.ProfileUpdate{DisplayName: params.DisplayName, Bio: params.Bio},
+		Handle:        params.Handle,
+	}, gHandleChangeCooldown)
+	if err == db.ErrInvalidHandle {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err == db.ErrEmailTaken || err == db.ErrHandleTaken {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err == db.ErrHandleChangeTooSoon {
+		next := result.NextHandleChange
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next).Seconds())+1))
+		respondWithJSON(w, http.StatusTooManyRequests, genericErrorMsg{
+			Error: fmt.Sprintf("handle can be changed again after %s", next.Format(time.RFC3339)),
+		})
+		return
+	} else if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("updating account of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	// a new address has to be verified again
+	if result.EmailChanged {
+		cfg.sendVerificationEmail(userID, *params.Email)
+	}
+
+	respondWithJSON(w, http.StatusOK, newProfileResponse(result.Profile))
+}
+
+// PUT /api/users/me/avatar
+//
+// the request body is the image itself, PNG, JPEG, GIF or WebP up to 1 MiB
+func (cfg *apiConfig) handlePutAvatar(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	dat, err := io.ReadAll(io.LimitReader(req.Body, gMaxAvatarSize+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read body")
+		return
+	}
+	if len(dat) > gMaxAvatarSize {
+		respondWithJSON(w, http.StatusRequestEntityTooLarge, genericErrorMsg{Error: "Avatar is too large"})
+		return
+	}
+
+	ext, ok := gAvatarExtensions[http.DetectContentType(dat)]
+	if !ok {
+		respondWithJSON(w, http.StatusUnsupportedMediaType, genericErrorMsg{Error: "Avatar must be a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		fmt.Printf("generating avatar name: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	name := fmt.Sprintf("avatar-%d-%s%s", userID, hex.EncodeToString(random), ext)
+
+	if err := os.WriteFile(filepath.Join(cfg.mediaPath, name), dat, 0644); err != nil {
+		fmt.Printf("writing avatar: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	cfg.replaceAvatar(w, userID, name)
+}
+
+func (cfg *apiConfig) handleDeleteAvatar(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	cfg.replaceAvatar(w, userID, "")
+}
+
+// sets the avatar of a user, removes the old file and responds with the profile
+func (cfg *apiConfig) replaceAvatar(w http.ResponseWriter, userID int, name string) {
+	previous, err := cfg.db.SetAvatar(userID, name)
+	if err != nil {
+		if name != "" {
+			os.Remove(filepath.Join(cfg.mediaPath, name))
+		}
+		if err == db.ErrUserNotFound {
+			respondWithError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		fmt.Printf("setting avatar of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	if previous != "" {
+		if err := os.Remove(filepath.Join(cfg.mediaPath, previous)); err != nil {
+			fmt.Printf("removing old avatar: %s\n", err)
+		}
+	}
+
+	profile, err := cfg.db.GetProfile(userID)
+	if err != nil {
+		fmt.Printf("getting profile of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newProfileResponse(*profile))
+}
+
+func (cfg *apiConfig) handleGetAvatar(w http.ResponseWriter, req *http.Request) {
+	userID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	profile, err := cfg.db.GetProfile(userID)
+	if err == db.ErrUserNotFound || (err == nil && profile.Avatar == "") {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("getting profile of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	// the file name is generated by us, but never trust it to stay in the directory
+	http.ServeFile(w, req, filepath.Join(cfg.mediaPath, filepath.Base(profile.Avatar)))
+}
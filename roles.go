@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	db "github.com/horriblename/go-web-server/db"
+)
+
+type PutUserRoleParameters struct {
+	Role db.Role `json:"role"`
+}
+
+// requireRole only lets requests through whose principal has at least role.
+// Goes after authenticate.
+func requireRole(role db.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if p := principalFrom(req); p == nil || !p.Role.AtLeast(role) {
+				respondWithJSON(w, http.StatusForbidden, genericErrorMsg{Error: fmt.Sprintf("needs the %s role", role)})
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// middlewareAdminAuth lets requests through that carry the admin API key:
+//
+//	Authorization: ApiKey <key>
+//
+// or an access token of a user with at least role. If no admin API key is
+// configured, only users are let through.
+func (cfg *apiConfig) middlewareAdminAuth(role db.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		byRole := cfg.authenticate("")(requireRole(role)(next))
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			auth := req.Header.Get("Authorization")
+			if cfg.adminApiKey != "" && auth == "ApiKey "+cfg.adminApiKey {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if _, err := req.Cookie(gAccessCookie); auth == "" && err != nil {
+				respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+
+			byRole.ServeHTTP(w, req)
+		})
+	}
+}
+
+// PUT /admin/users/{userID}/role
+func (cfg *apiConfig) handlePutUserRole(w http.ResponseWriter, req *http.Request) {
+	userID, ok := req.Context().Value("userID").(int)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	var params PutUserRoleParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.db.SetUserRole(userID, params.Role)
+	if err == db.ErrUnknownRole {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "Unknown role"})
+		return
+	} else if err == db.ErrUserNotFound {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err == db.ErrLastAdmin {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: "The last admin can't be demoted"})
+		return
+	} else if err != nil {
+		fmt.Printf("setting role of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// createAdmin implements
+//
+//	chirpy create-admin <email> <handle>
+//
+// which creates the first admin in the database of serverCfg, before the
+// server is started. The password is read from the first line of stdin and has
+// to follow the password policy.
+func createAdmin(serverCfg serverConfig, args []string, stdin io.Reader, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: chirpy create-admin <email> <handle>, with the password on stdin")
+	}
+	email, handle := args[0], args[1]
+	if !validEmail(email) {
+		return fmt.Errorf("invalid email %q", email)
+	}
+
+	fmt.Fprintf(out, "Password: ")
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("reading password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	policy, err := newPasswordPolicy(serverCfg.passwordMinLength, serverCfg.passwordMaxLength,
+		serverCfg.passwordMinClasses, serverCfg.breachedPasswordsPath)
+	if err != nil {
+		return fmt.Errorf("setting up password policy: %w", err)
+	}
+	if errs := policy.Check(password); errs != nil {
+		return errors.New(errs[0].Message)
+	}
+
+	database, err := db.New(serverCfg.databasePath)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	user, err := database.CreateFirstAdmin(email, handle, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nCreated admin %s with ID %d\n", user.Handle, user.Id)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	db "github.com/horriblename/go-web-server/db"
+)
+
+// user agents are cut off after at most this many bytes before they are
+// stored, without splitting a character
+const gMaxUserAgentLength = 256
+
+// the device a request comes from, as stored with sessions
+func requestClient(req *http.Request) db.Client {
+	userAgent := req.UserAgent()
+	if len(userAgent) > gMaxUserAgentLength {
+		end := gMaxUserAgentLength
+		for end > 0 && !utf8.RuneStart(userAgent[end]) {
+			end--
+		}
+		userAgent = userAgent[:end]
+	}
+
+	return db.Client{
+		UserAgent: userAgent,
+		IP:        clientIP(req),
+	}
+}
+
+// GET /api/users/me/sessions
+func (cfg *apiConfig) handleGetSessions(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	sessions, err := cfg.db.Sessions(userID)
+	if err != nil {
+		fmt.Printf("listing sessions of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+// DELETE /api/users/me/sessions/{sessionID}
+func (cfg *apiConfig) handleDeleteSession(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	err := cfg.db.RevokeSession(userID, chi.URLParam(req, "sessionID"))
+	if err == db.ErrTokenRevoked {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		fmt.Printf("revoking session of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// DELETE /api/users/me/sessions logs the user out everywhere
+func (cfg *apiConfig) handleDeleteSessions(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	if err := cfg.db.RevokeAllSessions(userID); err != nil {
+		fmt.Printf("revoking sessions of user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRequestClientTruncatesUserAgent(t *testing.T) {
+	for _, userAgent := range []string{
+		strings.Repeat("a", gMaxUserAgentLength+10),
+		// the limit falls in the middle of a character
+		"a" + strings.Repeat("ü", gMaxUserAgentLength),
+		strings.Repeat("😀", gMaxUserAgentLength),
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", userAgent)
+
+		got := requestClient(req).UserAgent
+		if len(got) > gMaxUserAgentLength || len(got) < gMaxUserAgentLength-utf8.UTFMax+1 {
+			t.Errorf("expected about %d bytes, got %d", gMaxUserAgentLength, len(got))
+		}
+		if !utf8.ValidString(got) || !strings.HasPrefix(userAgent, got) {
+			t.Errorf("expected a valid prefix of the user agent, got %q", got)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	if got := requestClient(req).UserAgent; got != "curl/8.0" {
+		t.Errorf("expected short user agents to be kept, got %q", got)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	db "github.com/horriblename/go-web-server/db"
+)
+
+const (
+	// how long a user has to log in at the identity provider
+	gSSOLoginTTL = 10 * time.Minute
+	// the JWKS is fetched again for unknown keys at most this often
+	gSSOKeysRefreshInterval = time.Minute
+	gSSOStateCookie         = "chirpy_sso_state"
+	gSSOHTTPTimeout         = 10 * time.Second
+)
+
+var (
+	ErrIdPUnavailable = errors.New("identity provider unavailable")
+	ErrInvalidIDToken = errors.New("invalid ID token")
+)
+
+// the parts of the provider's discovery document we use
+type ssoDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// a login started at the identity provider
+type ssoPending struct {
+	nonce     string
+	verifier  string
+	expiresAt time.Time
+}
+
+type ssoClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// ssoProvider logs users in with an external OpenID Connect provider, using
+// the authorization code flow with PKCE. The discovery document and keys are
+// fetched on first use, so the server starts even if the provider is down.
+// Pending logins are kept in memory only.
+type ssoProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	// our callback, the page of the web app that posts the code to
+	// /api/sso/callback
+	redirectURL string
+	client      *http.Client
+
+	lock      *sync.Mutex
+	discovery *ssoDiscovery
+	// kid -> public key
+	keys          map[string]any
+	keysFetchedAt time.Time
+	// state -> login
+	pending map[string]ssoPending
+	now     func() time.Time
+}
+
+func newSSOProvider(issuer, clientID, clientSecret, redirectURL string) *ssoProvider {
+	return &ssoProvider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		client:       &http.Client{Timeout: gSSOHTTPTimeout},
+		lock:         &sync.Mutex{},
+		keys:         map[string]any{},
+		pending:      map[string]ssoPending{},
+		now:          time.Now,
+	}
+}
+
+// random URL safe string
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (sso *ssoProvider) getJSON(uri string, v any) error {
+	resp, err := sso.client.Get(uri)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIdPUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s: status %d", ErrIdPUnavailable, uri, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: decoding %s: %s", ErrIdPUnavailable, uri, err)
+	}
+	return nil
+}
+
+// the provider's discovery document, fetched once. Must be called with the
+// lock held.
+func (sso *ssoProvider) discover() (ssoDiscovery, error) {
+	if sso.discovery != nil {
+		return *sso.discovery, nil
+	}
+
+	var discovery ssoDiscovery
+	if err := sso.getJSON(sso.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return ssoDiscovery{}, err
+	}
+	if discovery.Issuer != sso.issuer {
+		return ssoDiscovery{}, fmt.Errorf("%w: discovery document is for issuer %q", ErrIdPUnavailable, discovery.Issuer)
+	}
+
+	sso.discovery = &discovery
+	return discovery, nil
+}
+
+// Start begins a login and returns its state and the URL to send the user to
+func (sso *ssoProvider) Start() (string, string, error) {
+	sso.lock.Lock()
+	defer sso.lock.Unlock()
+
+	discovery, err := sso.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = randomToken(); err != nil {
+			return "", "", err
+		}
+	}
+
+	now := sso.now()
+	for s, pending := range sso.pending {
+		if now.After(pending.expiresAt) {
+			delete(sso.pending, s)
+		}
+	}
+	sso.pending[state] = ssoPending{nonce, verifier, now.Add(gSSOLoginTTL)}
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: authorization endpoint: %s", ErrIdPUnavailable, err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", sso.clientID)
+	query.Set("redirect_uri", sso.redirectURL)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallengeS256(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	return state, authURL.String(), nil
+}
+
+// Finish exchanges the code of the login with state for an ID token and
+// returns its verified claims. Each login can only be finished once.
+func (sso *ssoProvider) Finish(state, code string) (*ssoClaims, error) {
+	sso.lock.Lock()
+	pending, ok := sso.pending[state]
+	delete(sso.pending, state)
+	discovery, err := sso.discover()
+	sso.lock.Unlock()
+
+	if !ok || sso.now().After(pending.expiresAt) {
+		return nil, fmt.Errorf("%w: unknown or expired state", ErrInvalidIDToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {sso.redirectURL},
+		"code_verifier": {pending.verifier},
+	}
+	tokenReq, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: token endpoint: %s", ErrIdPUnavailable, err)
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(sso.clientID), url.QueryEscape(sso.clientSecret))
+
+	resp, err := sso.client.Do(tokenReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIdPUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("%w: decoding token response: %s", ErrIdPUnavailable, err)
+	}
+	if resp.StatusCode == http.StatusBadRequest && tokens.Error == "invalid_grant" {
+		return nil, fmt.Errorf("%w: code rejected", ErrInvalidIDToken)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: token endpoint: status %d %s", ErrIdPUnavailable, resp.StatusCode, tokens.Error)
+	}
+
+	return sso.verifyIDToken(tokens.IDToken, pending.nonce)
+}
+
+func (sso *ssoProvider) verifyIDToken(idToken, nonce string) (*ssoClaims, error) {
+	claims := ssoClaims{}
+	_, err := jwt.ParseWithClaims(idToken, &claims, sso.keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(sso.issuer),
+		jwt.WithAudience(sso.clientID),
+	)
+	if errors.Is(err, ErrIdPUnavailable) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidIDToken, err)
+	}
+
+	if claims.ExpiresAt == nil || claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing exp or sub", ErrInvalidIDToken)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+// picks the provider's key for a token by kid, fetching the provider's keys
+// again if it is unknown, for jwt.Parse
+func (sso *ssoProvider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	sso.lock.Lock()
+	defer sso.lock.Unlock()
+
+	if key, ok := sso.keys[kid]; ok {
+		return key, nil
+	}
+	if sso.now().Sub(sso.keysFetchedAt) < gSSOKeysRefreshInterval {
+		return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, kid)
+	}
+
+	discovery, err := sso.discover()
+	if err != nil {
+		return nil, err
+	}
+	var set JWKSet
+	if err := sso.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	sso.keysFetchedAt = sso.now()
+
+	sso.keys = map[string]any{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.PublicKey(); err == nil {
+			sso.keys[jwk.Kid] = key
+		}
+	}
+
+	if key, ok := sso.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, kid)
+}
+
+// PublicKey decodes an RSA, P-256 or Ed25519 public key
+func (jwk JWK) PublicKey() (any, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := b64(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := b64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return key, nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := b64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", jwk.Kty, jwk.Crv)
+}
+
+type SSOLoginResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// what the identity provider sent back to the web app's callback page
+type SSOCallbackParameters struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+	// see PostLoginParameters
+	Cookies bool `json:"cookies"`
+}
+
+func (cfg *apiConfig) middlewareSSOEnabled(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if cfg.sso == nil {
+			respondWithError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// the state cookie ties a login to the browser that started it, so nobody can
+// log someone else into their account
+func (cfg *apiConfig) ssoStateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     gSSOStateCookie,
+		Value:    state,
+		Path:     "/api/sso",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.sso.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// POST /api/sso/login
+//
+// starts a login with the identity provider and returns where to send the
+// browser
+func (cfg *apiConfig) handlePostSSOLogin(w http.ResponseWriter, req *http.Request) {
+	state, authURL, err := cfg.sso.Start()
+	if errors.Is(err, ErrIdPUnavailable) {
+		fmt.Printf("starting SSO login: %s\n", err)
+		respondWithError(w, http.StatusBadGateway, "Identity Provider Unavailable")
+		return
+	} else if err != nil {
+		fmt.Printf("starting SSO login: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+
+	http.SetCookie(w, cfg.ssoStateCookie(state, int(gSSOLoginTTL.Seconds())))
+	respondWithJSON(w, http.StatusOK, SSOLoginResponse{authURL})
+}
+
+// POST /api/sso/callback
+//
+// finishes a login with the identity provider. The account is found by its
+// link to the provider, then by a verified email address, and created if there
+// is none. Responds like POST /api/login.
+func (cfg *apiConfig) handlePostSSOCallback(w http.ResponseWriter, req *http.Request) {
+	var params SSOCallbackParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	cookie, err := req.Cookie(gSSOStateCookie)
+	if err != nil || params.State == "" || cookie.Value != params.State {
+		respondWithError(w, http.StatusBadRequest, "State Mismatch")
+		return
+	}
+	http.SetCookie(w, cfg.ssoStateCookie("", -1))
+
+	claims, err := cfg.sso.Finish(params.State, params.Code)
+	if errors.Is(err, ErrInvalidIDToken) {
+		fmt.Printf("SSO login failed: %s\n", err)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	} else if err != nil {
+		fmt.Printf("finishing SSO login: %s\n", err)
+		respondWithError(w, http.StatusBadGateway, "Identity Provider Unavailable")
+		return
+	}
+
+	user, err := cfg.ssoUser(claims)
+	if err == db.ErrEmailTaken {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{
+			Error: "An account with this email already exists and the identity provider did not verify the address",
+		})
+		return
+	} else if err == errSSOEmailUnverified {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{
+			Error: "An account with this email already exists but its address is not verified, log in with its password and verify it first",
+		})
+		return
+	} else if err == errNoSSOEmail {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: "The identity provider did not share a valid email address"})
+		return
+	} else if err != nil {
+		fmt.Printf("finding SSO user: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	cfg.completeLogin(w, req, user, params.Cookies)
+}
+
+var (
+	errNoSSOEmail         = errors.New("no valid email in ID token")
+	errSSOEmailUnverified = errors.New("the account with the SSO email hasn't verified it")
+)
+
+// the user the provider's account belongs to, linking or creating one if
+// needed
+func (cfg *apiConfig) ssoUser(claims *ssoClaims) (db.UserDTO, error) {
+	issuer := cfg.sso.issuer
+	user, err := cfg.db.UserByIdentity(issuer, claims.Subject)
+	if err != db.ErrUserNotFound {
+		return user, err
+	}
+
+	if !validEmail(claims.Email) {
+		return db.UserDTO{}, errNoSSOEmail
+	}
+
+	existing, err := cfg.db.UserByEmail(claims.Email)
+	if err == db.ErrUserNotFound {
+		handle := claims.PreferredUsername
+		if handle == "" {
+			handle, _, _ = strings.Cut(claims.Email, "@")
+		}
+		return cfg.db.CreateUserWithIdentity(claims.Email, handle, claims.EmailVerified, issuer, claims.Subject)
+	} else if err != nil {
+		return db.UserDTO{}, err
+	}
+
+	// anyone could claim an address the provider didn't check
+	if !claims.EmailVerified {
+		return db.UserDTO{}, db.ErrEmailTaken
+	}
+	// nor could the local account's owner have typed in someone else's
+	if !existing.EmailVerified {
+		return db.UserDTO{}, errSSOEmailUnverified
+	}
+	if err := cfg.db.LinkIdentity(existing.Id, issuer, claims.Subject); err != nil {
+		return db.UserDTO{}, err
+	}
+	return cfg.db.UserByIdentity(issuer, claims.Subject)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// an account at the mock identity provider
+type mockAccount struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+type mockIdPCode struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+	account     mockAccount
+}
+
+// mockIdP is a minimal OpenID provider. Whoever visits /authorize is logged in
+// as next.
+type mockIdP struct {
+	server       *httptest.Server
+	key          ed25519.PrivateKey
+	kid          string
+	clientID     string
+	clientSecret string
+
+	lock  *sync.Mutex
+	next  mockAccount
+	codes map[string]mockIdPCode
+}
+
+func newMockIdP(t *testing.T, clientID, clientSecret string) *mockIdP {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating IdP key: %s", err)
+	}
+	idp := &mockIdP{
+		key:          key,
+		kid:          "idp-key",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		lock:         &sync.Mutex{},
+		codes:        map[string]mockIdPCode{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		respondWithJSON(w, http.StatusOK, ssoDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		respondWithJSON(w, http.StatusOK, JWKSet{Keys: []JWK{{
+			Kty: "OKP",
+			Kid: idp.kid,
+			Use: "sig",
+			Alg: "EdDSA",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		}}})
+	})
+	mux.HandleFunc("/authorize", idp.handleAuthorize)
+	mux.HandleFunc("/token", idp.handleToken)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) handleAuthorize(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("client_id") != idp.clientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" {
+		respondWithError(w, http.StatusBadRequest, "bad authorization request")
+		return
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	idp.lock.Lock()
+	idp.codes[code] = mockIdPCode{query.Get("redirect_uri"), query.Get("nonce"), query.Get("code_challenge"), idp.next}
+	idp.lock.Unlock()
+
+	http.Redirect(w, req, redirectWithQuery(query.Get("redirect_uri"), url.Values{
+		"code":  {code},
+		"state": {query.Get("state")},
+	}), http.StatusFound)
+}
+
+func (idp *mockIdP) handleToken(w http.ResponseWriter, req *http.Request) {
+	clientID, secret, _ := req.BasicAuth()
+	if clientID != idp.clientID || secret != idp.clientSecret {
+		respondWithJSON(w, http.StatusUnauthorized, OAuthError{Error: oauthInvalidClient})
+		return
+	}
+
+	idp.lock.Lock()
+	code, ok := idp.codes[req.PostFormValue("code")]
+	delete(idp.codes, req.PostFormValue("code"))
+	idp.lock.Unlock()
+	if !ok || code.redirectURI != req.PostFormValue("redirect_uri") ||
+		codeChallengeS256(req.PostFormValue("code_verifier")) != code.challenge {
+		respondWithJSON(w, http.StatusBadRequest, OAuthError{Error: oauthInvalidGrant})
+		return
+	}
+
+	idToken, err := idp.sign(idp.claims(code.account, code.nonce), idp.key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, OAuthTokenResponse{IDToken: idToken, TokenType: "Bearer"})
+}
+
+func (idp *mockIdP) claims(account mockAccount, nonce string) ssoClaims {
+	return ssoClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   account.Subject,
+			Audience:  jwt.ClaimStrings{idp.clientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+		},
+		Nonce:             nonce,
+		Email:             account.Email,
+		EmailVerified:     account.EmailVerified,
+		PreferredUsername: account.PreferredUsername,
+	}
+}
+
+func (idp *mockIdP) sign(claims ssoClaims, key ed25519.PrivateKey) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = idp.kid
+	return token.SignedString(key)
+}
+
+// logs in to the API at apiURL as account of idp, returns the login response
+// if code is 200
+func ssoLogin(apiURL string, idp *mockIdP, account mockAccount, code int) (*LoginSuccessResponse, error) {
+	idp.lock.Lock()
+	idp.next = account
+	idp.lock.Unlock()
+
+	resp, err := sendHttpRequest("POST", nil, apiURL+"/sso/login", nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var login SSOLoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return nil, err
+	}
+	var stateCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == gSSOStateCookie {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil || !stateCookie.HttpOnly {
+		return nil, errors.New("expected an HttpOnly state cookie")
+	}
+
+	// the user logs in at the provider, which sends them back with a code
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	idpResp, err := noRedirects.Get(login.RedirectTo)
+	if err != nil {
+		return nil, err
+	}
+	idpResp.Body.Close()
+	authCode, state := redirectCode(idpResp.Header.Get("Location"))
+
+	cookieHeader := map[string]string{"Cookie": stateCookie.Name + "=" + stateCookie.Value}
+	if code != http.StatusOK {
+		resp, err := sendHttpRequest("POST", cookieHeader, apiURL+"/sso/callback", SSOCallbackParameters{Code: authCode, State: state}, code)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	return testHttpWithResponse[LoginSuccessResponse]("POST", cookieHeader, apiURL+"/sso/callback", SSOCallbackParameters{Code: authCode, State: state}, code)
+}
+
+func TestSSOVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t, "chirpy", "secret")
+	sso := newSSOProvider(idp.server.URL, "chirpy", "secret", "http://localhost/callback")
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	account := mockAccount{Subject: "42", Email: "someone@corp.example", EmailVerified: true}
+
+	tests := []struct {
+		name   string
+		modify func(*ssoClaims)
+		key    ed25519.PrivateKey
+		valid  bool
+	}{
+		{"valid", func(*ssoClaims) {}, idp.key, true},
+		{"other issuer", func(c *ssoClaims) { c.Issuer = "https://evil.example" }, idp.key, false},
+		{"other audience", func(c *ssoClaims) { c.Audience = jwt.ClaimStrings{"someone-else"} }, idp.key, false},
+		{"expired", func(c *ssoClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, idp.key, false},
+		{"no expiry", func(c *ssoClaims) { c.ExpiresAt = nil }, idp.key, false},
+		{"no subject", func(c *ssoClaims) { c.Subject = "" }, idp.key, false},
+		{"wrong nonce", func(c *ssoClaims) { c.Nonce = "replayed" }, idp.key, false},
+		{"wrong key", func(*ssoClaims) {}, otherKey, false},
+	}
+
+	for _, test := range tests {
+		claims := idp.claims(account, "nonce")
+		test.modify(&claims)
+		idToken, err := idp.sign(claims, test.key)
+		if err != nil {
+			t.Fatalf("%s: signing: %s", test.name, err)
+		}
+
+		got, err := sso.verifyIDToken(idToken, "nonce")
+		if test.valid && (err != nil || got.Email != account.Email) {
+			t.Errorf("%s: expected the token to be accepted, got %+v (%v)", test.name, got, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("%s: expected ErrInvalidIDToken, got %v", test.name, err)
+		}
+	}
+
+	if _, err := sso.Finish("unknown state", "code"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("expected unknown states to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var gRFCSecret = []byte("12345678901234567890")
+
+// test vectors from RFC 4226, appendix D
+func TestHOTP(t *testing.T) {
+	expect := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range expect {
+		if got := hotp(gRFCSecret, uint64(counter), 6); got != code {
+			t.Errorf("hotp(counter=%d) = %s, expected %s", counter, got, code)
+		}
+	}
+}
+
+// SHA-1 test vectors from RFC 6238, appendix B
+func TestTOTP(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, test := range tests {
+		step := Step(time.Unix(test.unix, 0))
+		if got := hotp(gRFCSecret, uint64(step), 8); got != test.code {
+			t.Errorf("TOTP at %d = %s, expected %s", test.unix, got, test.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %s", err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	step, ok := Validate(secret, Code(secret, now), now, 1)
+	if !ok || step != Step(now) {
+		t.Errorf("expected current code to be valid at step %d, got %d (%v)", Step(now), step, ok)
+	}
+	if _, ok := Validate(secret, Code(secret, now.Add(-Period*time.Second)), now, 1); !ok {
+		t.Errorf("expected previous code to be accepted with a skew of 1")
+	}
+	if _, ok := Validate(secret, Code(secret, now.Add(-2*Period*time.Second)), now, 1); ok {
+		t.Errorf("expected code from two steps ago to be rejected")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Errorf("expected a short code to be rejected")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Chirpy", "user@example.com", gRFCSecret)
+
+	for _, expect := range []string{
+		"otpauth://totp/Chirpy:user@example.com?",
+		"secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"issuer=Chirpy",
+		"digits=6",
+		"period=30",
+	} {
+		if !strings.Contains(uri, expect) {
+			t.Errorf("expected %q to contain %q", uri, expect)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	db "github.com/horriblename/go-web-server/db"
+	"github.com/horriblename/go-web-server/mailer"
+)
+
+const gVerificationTokenTTL = 24 * time.Hour
+
+type PostVerifyParameters struct {
+	Token string `json:"token"`
+}
+
+// sends a new verification token to the user's current address. Failures are
+// only logged, the user can ask for another one.
+func (cfg *apiConfig) sendVerificationEmail(userID int, email string) {
+	token, err := cfg.db.CreateVerificationToken(userID, gVerificationTokenTTL)
+	if err != nil {
+		fmt.Printf("creating verification token for user %d: %s\n", userID, err)
+		return
+	}
+
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(`Welcome to Chirpy!
+
+To verify your email address, send this token to POST /api/users/verify:
+
+%s
+
+The token expires in %d hours. If you didn't sign up for Chirpy, ignore this email.`,
+			token, int(gVerificationTokenTTL.Hours())),
+	}
+	if err := cfg.mailer.Send(msg); err != nil {
+		fmt.Printf("sending verification email to user %d: %s\n", userID, err)
+	}
+}
+
+// POST /api/users/verify
+func (cfg *apiConfig) handlePostVerify(w http.ResponseWriter, req *http.Request) {
+	var params PostVerifyParameters
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.db.VerifyEmail(params.Token)
+	if err == db.ErrInvalidToken {
+		respondWithJSON(w, http.StatusBadRequest, genericErrorMsg{Error: err.Error()})
+		return
+	} else if err != nil {
+		fmt.Printf("verifying email: %s\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// POST /api/users/verify/resend
+func (cfg *apiConfig) handlePostResendVerification(w http.ResponseWriter, req *http.Request) {
+	userID := principalFrom(req).UserID
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		fmt.Printf("getting user %d: %s\n", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	if user.EmailVerified {
+		respondWithJSON(w, http.StatusConflict, genericErrorMsg{Error: "Email already verified"})
+		return
+	}
+
+	cfg.sendVerificationEmail(user.Id, user.Email)
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}